@@ -0,0 +1,103 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/repo"
+)
+
+type CheckOptions struct {
+	// Also check the files modified since they were hashed
+	All bool
+
+	Walk repo.WalkOptions
+
+	// Called for each file that differs, as soon as it is checked, can be nil
+	Checked func(f FileCheck)
+}
+
+// A file whose content or modification time changed since it was hashed
+type FileCheck struct {
+	Path string
+
+	// Hash of the current content
+	Hash []byte
+
+	// The modification time changed since the file was hashed
+	TimeChanged bool
+
+	// The content changed. If the modification time did not change, the file
+	// is corrupt.
+	HashChanged bool
+}
+
+// Return true if the content changed while the modification time did not
+func (f FileCheck) Corrupt() bool {
+	return f.HashChanged && !f.TimeChanged
+}
+
+// Hash the unmodified files of dir, or all the hashed files with
+// CheckOptions.All, and return those that differ from their recorded hash
+func Check(ctx context.Context, dir string, opts CheckOptions) ([]FileCheck, error, []error) {
+	var res []FileCheck
+	var errs []error
+
+	err := opts.Walk.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if repo.IsLoop(err) {
+			errs = append(errs, err)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Skip .dirstore/ at root
+		if filepath.Base(path) == attrs.DirStoreName && filepath.Dir(path) == dir && info.IsDir() {
+			return filepath.SkipDir
+		} else if info.IsDir() {
+			return nil
+		}
+
+		hashTimeStr, err := attrs.Get(path, repo.XattrHashTime)
+		if err != nil {
+			return nil
+		}
+
+		hashTime, err := time.Parse(time.RFC3339Nano, string(hashTimeStr))
+		if err != nil {
+			return err
+		}
+
+		timeEqual := hashTime == info.ModTime()
+		if !opts.All && !timeEqual {
+			return nil
+		}
+
+		hash, err := attrs.Get(path, repo.XattrHash)
+		if err != nil {
+			return err
+		}
+
+		digest, err := repo.HashFile(path, info)
+		if err != nil {
+			return err
+		}
+
+		hashEqual := bytes.Equal(hash, digest)
+		if !timeEqual || !hashEqual {
+			f := FileCheck{path, digest, !timeEqual, !hashEqual}
+			res = append(res, f)
+			if opts.Checked != nil {
+				opts.Checked(f)
+			}
+		}
+		return nil
+	})
+	return res, err, errs
+}
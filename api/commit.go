@@ -0,0 +1,200 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/ignore"
+	"github.com/mildred/doc/repo"
+)
+
+type CommitOptions struct {
+	// Write the extended attributes of read only files, by making them
+	// writable for a moment
+	Force bool
+
+	// Do not write .doccommit, only hash the modified files
+	NoDocCommit bool
+
+	// Include the files ignored by the .docignore files
+	NoDocIgnore bool
+
+	Walk repo.WalkOptions
+
+	// Called for each file hashed, can be nil
+	Hashed func(f HashedFile)
+}
+
+type HashedFile struct {
+	Path string
+	Hash []byte
+
+	// The file was read only and was made writable to set the attributes
+	Forced bool
+}
+
+type CommitResult struct {
+	// Files hashed because they were new or modified
+	Hashed []HashedFile
+
+	// Files whose hash could not be recorded in the extended attributes,
+	// usually because they are read only
+	Failed []error
+}
+
+// Hash the new and modified files of dir, or of the file dir, and record
+// their hash in .doccommit
+func Commit(ctx context.Context, dir string, opts CommitOptions) (*CommitResult, error, []error) {
+	res := &CommitResult{}
+	var errs []error
+	var c *commit.Commit
+	var cDir string
+	doCommit := !opts.NoDocCommit
+
+	st, err := opts.Walk.Stat(dir)
+	if err != nil {
+		return res, err, nil
+	}
+
+	if st.IsDir() {
+		cDir = dir
+		c, err = commit.ReadCommit(dir)
+		if err != nil {
+			return res, fmt.Errorf("%s commit: %s", dir, err.Error()), nil
+		}
+		c.DropTree("")
+	} else {
+		cDir = filepath.Dir(dir)
+		c, err = commit.ReadCommit(cDir)
+		if err != nil {
+			return res, fmt.Errorf("%s commit: %s", dir, err.Error()), nil
+		}
+		if i, ok := c.ByPath[filepath.Base(dir)]; ok {
+			c.Entries[i].DropEntry()
+		}
+	}
+
+	ignores := ignore.New()
+	err = opts.Walk.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if repo.IsLoop(err) {
+			errs = append(errs, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		if !opts.NoDocIgnore && ignores.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip .dirstore/ at root and .doccommit
+		if filepath.Base(path) == attrs.DirStoreName && filepath.Dir(path) == dir && info.IsDir() {
+			return filepath.SkipDir
+		} else if doCommit && filepath.Join(dir, commit.Doccommit) == path {
+			return nil
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relpath, err := filepath.Rel(cDir, path)
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			relpath = relpath + "/"
+		}
+
+		hashTime, err := repo.GetHashTime(path)
+		if err != nil && !repo.IsNoData(err) {
+			errs = append(errs, fmt.Errorf("%s: %s", path, err.Error()))
+			return nil
+		}
+		hash_is_ok := err == nil && hashTime == info.ModTime()
+		var digest []byte
+
+		if hash_is_ok {
+			if doCommit {
+				digest, err = repo.GetHash(path, info, false)
+				if err != nil {
+					errs = append(errs, err)
+					return nil
+				} else if digest == nil {
+					errs = append(errs, fmt.Errorf("%s: hash not available", path))
+					return nil
+				}
+			}
+		} else {
+			var forced bool
+			digest, forced, err = CommitFile(path, info, opts.Force)
+			if err != nil {
+				res.Failed = append(res.Failed, fmt.Errorf("%s: %s", path, err.Error()))
+				return nil
+			} else if digest != nil {
+				f := HashedFile{path, digest, forced}
+				res.Hashed = append(res.Hashed, f)
+				if opts.Hashed != nil {
+					opts.Hashed(f)
+				}
+			}
+		}
+
+		if !doCommit {
+			return nil
+		}
+
+		var uuid string
+		var dev, ino uint64
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			uuid = c.UuidByDevInode[commit.DeviceInodeString(st.Dev, st.Ino)]
+			dev = st.Dev
+			ino = st.Ino
+		}
+
+		// Names rewritten when the file was copied keep their original
+		var original string
+		if i, ok := c.ByPath[relpath]; ok {
+			original = c.Entries[i].Original
+		}
+
+		c.Entries = append(c.Entries, commit.Entry{
+			Hash:     digest,
+			Path:     relpath,
+			Uuid:     uuid,
+			Device:   dev,
+			Inode:    ino,
+			Original: original,
+		})
+		return nil
+	})
+	if err != nil {
+		return res, err, errs
+	}
+
+	if doCommit {
+		err = c.Write()
+	}
+	return res, err, errs
+}
+
+// Hash path and record the hash in its extended attributes. forced is true if
+// the file was read only and force was used to set them.
+func CommitFile(path string, info os.FileInfo, force bool) (digest []byte, forced bool, err error) {
+	digest, err = repo.HashFile(path, info)
+	if err != nil {
+		return nil, false, err
+	}
+
+	forced, err = repo.CommitFileHash(path, info, digest, force)
+	return digest, forced, err
+}
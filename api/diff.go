@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/mildred/doc/commit"
+)
+
+type ChangeKind string
+
+const (
+	// The file is only in the first repository
+	Removed ChangeKind = "-"
+
+	// The file is only in the second repository
+	Added ChangeKind = "+"
+
+	// The file has a different content in each repository
+	Modified ChangeKind = "~"
+
+	// The file and Link are hard links in the first repository only
+	LinkRemoved ChangeKind = "-link"
+
+	// The file and Link are hard links in the second repository only
+	LinkAdded ChangeKind = "+link"
+)
+
+// A difference between the committed files of two repositories
+type Change struct {
+	Kind ChangeKind
+	Path string
+
+	// Entries of the file in each repository, nil if it is missing
+	A, B *commit.Entry
+
+	// For link changes, the other file linked to Path
+	Link string
+}
+
+// Return the differences between the committed files of a and b, sorted by
+// path. Files are matched by name, the path they had before it was rewritten
+// if it was.
+func Diff(ctx context.Context, a, b string) ([]Change, error) {
+	afiles, err := commit.ReadCommit(a)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", a, err.Error())
+	}
+
+	bfiles, err := commit.ReadCommit(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", b, err.Error())
+	}
+
+	var filelist []string
+	for file := range afiles.ByName {
+		filelist = append(filelist, file)
+	}
+	for file := range bfiles.ByName {
+		if _, ok := afiles.ByName[file]; !ok {
+			filelist = append(filelist, file)
+		}
+	}
+	sort.Strings(filelist)
+
+	alinks := hardLinks(afiles)
+	blinks := hardLinks(bfiles)
+
+	var res []Change
+	for _, file := range filelist {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+
+		c := Change{Path: file}
+		if i, ok := afiles.ByName[file]; ok {
+			c.A = &afiles.Entries[i]
+		}
+		if i, ok := bfiles.ByName[file]; ok {
+			c.B = &bfiles.Entries[i]
+		}
+		if c.B == nil {
+			c.Kind = Removed
+		} else if c.A == nil {
+			c.Kind = Added
+		} else if !bytes.Equal(c.A.Hash, c.B.Hash) {
+			c.Kind = Modified
+		} else {
+			res = append(res, diffLinks(c, afiles, bfiles, alinks, blinks)...)
+			continue
+		}
+		res = append(res, c)
+	}
+
+	return res, nil
+}
+
+// Hard link groups of c: paths of the entries by device and inode
+type linkGroups map[string][]string
+
+func hardLinks(c *commit.Commit) linkGroups {
+	groups := linkGroups{}
+	for _, e := range c.Entries {
+		if key := commit.DeviceInodeString(e.Device, e.Inode); key != "" {
+			groups[key] = append(groups[key], e.Name())
+		}
+	}
+	return groups
+}
+
+// Return the other files in c that are hard links to file
+func (g linkGroups) linksOf(c *commit.Commit, file string) map[string]bool {
+	links := map[string]bool{}
+	e := c.Entries[c.ByName[file]]
+	for _, path := range g[commit.DeviceInodeString(e.Device, e.Inode)] {
+		if path != file {
+			links[path] = true
+		}
+	}
+	return links
+}
+
+// Return the hard links of the file of c that are only in a or in b. Only the
+// files present on both sides are considered, and each link is returned once.
+func diffLinks(c Change, a, b *commit.Commit, agroups, bgroups linkGroups) []Change {
+	alinks := agroups.linksOf(a, c.Path)
+	blinks := bgroups.linksOf(b, c.Path)
+
+	var res []Change
+	for other := range alinks {
+		if _, ok := b.ByName[other]; ok && other > c.Path && !blinks[other] {
+			l := c
+			l.Kind, l.Link = LinkRemoved, other
+			res = append(res, l)
+		}
+	}
+	for other := range blinks {
+		if _, ok := a.ByName[other]; ok && other > c.Path && !alinks[other] {
+			l := c
+			l.Kind, l.Link = LinkAdded, other
+			res = append(res, l)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Link < res[j].Link
+	})
+	return res
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"context"
+
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/copy"
+)
+
+type PushOptions struct {
+	copy.Options
+
+	// Progress reporting, can be nil
+	Progress copy.Progress
+}
+
+type PushResult struct {
+	// Destination entries of the files copied, conflict files included
+	Copied []commit.Entry
+}
+
+// Copy the committed files of src missing from dst, as doc push and doc pull
+// do. Files that differ in dst are copied under a conflict name. The copy stops
+// before the next file when ctx is done.
+func Push(ctx context.Context, src, dst string, opts PushOptions) (*PushResult, error, []error) {
+	copts := opts.Options
+	copts.Context = ctx
+	copied, err, errs := copy.CopyEntries(src, dst, opts.Progress, copts)
+	return &PushResult{copied}, err, errs
+}
@@ -0,0 +1,139 @@
+// Package api runs the doc operations from Go programs. The functions return
+// their results instead of printing them, accept a context to stop them
+// early, and never exit the process. Like in the other packages, the first
+// error returned is fatal and the list of errors that follows contains the
+// files that could not be processed.
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/ignore"
+	"github.com/mildred/doc/repo"
+)
+
+type StatusOptions struct {
+	// Check the PAR2 redundancy of the committed files, hashing the modified
+	// files
+	Par2 bool
+
+	// Include the files ignored by the .docignore files
+	NoDocIgnore bool
+
+	Walk repo.WalkOptions
+
+	// Called for each file, as soon as its status is known, can be nil
+	Found func(st FileStatus)
+}
+
+type FileStatus struct {
+	Path string
+
+	// The file was never hashed
+	Untracked bool
+
+	// The file was modified since it was hashed
+	Modified bool
+
+	// The file is read only, its extended attributes probably cannot be set
+	ReadOnly bool
+
+	// Hash recorded for the file, nil if untracked or modified
+	Hash []byte
+
+	// PAR2 redundancy data is missing, only checked with StatusOptions.Par2
+	Unsaved bool
+
+	// The file has conflict alternatives
+	Conflict bool
+
+	// The file is a conflict alternative of another file
+	Alternative bool
+}
+
+// Return the status of the regular files in dir
+func Status(ctx context.Context, dir string, opts StatusOptions) ([]FileStatus, error, []error) {
+	var res []FileStatus
+	var errs []error
+
+	rep := repo.GetRepo(dir)
+	ignores := ignore.New()
+	err := opts.Walk.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		} else if repo.IsLoop(err) {
+			errs = append(errs, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+
+		// Skip the files and directories ignored by .docignore files
+		if !opts.NoDocIgnore && ignores.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip .dirstore/ at root
+		if filepath.Base(path) == attrs.DirStoreName && filepath.Dir(path) == dir && info.IsDir() {
+			return filepath.SkipDir
+		} else if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		st := FileStatus{
+			Path:        path,
+			ReadOnly:    info.Mode()&os.FileMode(0200) == 0,
+			Alternative: repo.ConflictFile(path) != "",
+		}
+		st.Conflict = !st.Alternative && len(repo.ConflictFileAlternatives(path)) > 0
+
+		hashTime, err := repo.GetHashTime(path)
+		if repo.IsNoData(err) {
+			st.Untracked = true
+			res = append(res, st)
+			if opts.Found != nil {
+				opts.Found(st)
+			}
+			return nil
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", path, err.Error()))
+			return nil
+		}
+		st.Modified = hashTime != info.ModTime()
+
+		st.Hash, err = repo.GetHash(path, info, false)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", path, err.Error()))
+			return nil
+		}
+
+		if opts.Par2 && rep != nil {
+			digest := st.Hash
+			if digest == nil {
+				digest, err = repo.GetHash(path, info, true)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %s", path, err.Error()))
+					return nil
+				}
+			}
+			par2exists, _ := rep.Par2Exists(digest)
+			st.Unsaved = !par2exists
+		} else if opts.Par2 {
+			st.Unsaved = true
+		}
+
+		res = append(res, st)
+		if opts.Found != nil {
+			opts.Found(st)
+		}
+		return nil
+	})
+	return res, err, errs
+}
@@ -97,6 +97,14 @@ func FindDirStore(path string) string {
 	return res
 }
 
+// Return true if dir is the root of a repository, the directory whose dirstore
+// FindDirStore returns for the paths below it, or the root of the filesystem.
+// Files such as .docignore and .docattr above a root do not apply below it.
+func IsRoot(dir string) bool {
+	_, err := os.Lstat(filepath.Join(dir, DirStoreName))
+	return err == nil || filepath.Dir(dir) == dir
+}
+
 func findAttrDir(path string) (string, os.FileInfo, error) {
 	st, err := os.Lstat(path)
 	if err != nil {
@@ -234,3 +242,26 @@ func Get(path, name string) ([]byte, error) {
 	}
 	return res, err
 }
+
+func removeAttr(path, name string) error {
+	attrname, _, err := findAttrFile(path, name)
+	if err != nil {
+		return err
+	} else if attrname == "" {
+		return fmt.Errorf("%s: Could not find %s", path, DirStoreName)
+	}
+
+	err = os.Remove(attrname)
+	if os.IsNotExist(err) {
+		err = syscall.ENODATA
+	}
+	return err
+}
+
+func Remove(path, name string) error {
+	err := xattr.Remove(path, name)
+	if IsErrno(err, syscall.ENOTSUP) {
+		err = removeAttr(path, name)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mildred/doc/bundle"
+	"github.com/mildred/doc/commit"
+)
+
+const bundleUsage string = `doc bundle create [OPTIONS...] -against OTHER.doccommit OUT
+doc bundle apply [OPTIONS...] BUNDLE [DIR]
+doc bundle verify BUNDLE
+
+Transfer files to a repository that cannot be reached directly (sneakernet).
+
+create writes in OUT a single archive containing the committed files of the
+source directory that are missing from OTHER.doccommit (the .doccommit file of
+the other repository), along with their .doccommit entries and attributes. The
+archive can be split in several parts (OUT.001, OUT.002, ...) to fit on small
+media. The hash of each part and of the whole bundle is written in OUT.sums.
+
+apply imports the bundle into DIR or the current directory. BUNDLE can be the
+bundle name or its first part. Each file content is checked against its hash
+before it is imported. Files with identical name but different content are
+imported under another name and marked as conflicts, like doc pull does.
+
+verify checks the bundle parts against OUT.sums.
+
+Options:
+`
+
+func mainBundle(args []string) int {
+	f := flag.NewFlagSet("bundle", flag.ExitOnError)
+	opt_against := f.String("against", "", "The .doccommit file of the other repository (create)")
+	opt_from := f.String("from", ".", "Specify the source directory (create)")
+	opt_split := f.String("split", "", "Split the bundle in parts of this size, with K, M or G suffix (create)")
+	opt_quiet := f.Bool("q", false, "Quiet about attribute errors")
+	opt_verbose := f.Bool("v", false, "Print a log of operations")
+	f.Usage = func() {
+		fmt.Print(bundleUsage)
+		f.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		f.Usage()
+		return 1
+	}
+	cmd := args[0]
+	f.Parse(args[1:])
+
+	var err error
+	var errs []error
+
+	switch cmd {
+	case "create":
+		if f.NArg() != 1 || *opt_against == "" {
+			fmt.Fprintln(os.Stderr, "Expected -against and one argument")
+			return 1
+		}
+		var partSize int64
+		if *opt_split != "" {
+			partSize, err = parseSize(*opt_split)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				return 1
+			}
+		}
+		other, err := commit.ReadCommitFile(*opt_against)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		err, errs = bundle.Create(*opt_from, other, f.Arg(0), bundle.CreateOptions{
+			PartSize: partSize,
+			Progress: newPullProgress(*opt_verbose),
+			Context:  interrupt,
+		})
+	case "apply":
+		dir := "."
+		if f.NArg() == 2 {
+			dir = f.Arg(1)
+		} else if f.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Expected one or two arguments")
+			return 1
+		}
+		err, errs = bundle.Apply(interrupt, f.Arg(0), dir, newPullProgress(*opt_verbose))
+	case "verify":
+		if f.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Expected one argument")
+			return 1
+		}
+		failed, err := bundle.Verify(f.Arg(0))
+		for _, part := range failed {
+			fmt.Printf("!\t%s\n", part)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		} else if len(failed) > 0 {
+			return 1
+		}
+		return 0
+	default:
+		f.Usage()
+		return 1
+	}
+
+	res := 0
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		res = 1
+	}
+	if !*opt_quiet && len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "\n")
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "W: %s\n", e.Error())
+		}
+	}
+	return res
+}
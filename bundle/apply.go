@@ -0,0 +1,338 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	mh "github.com/jbenet/go-multihash"
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/meta"
+	"github.com/mildred/doc/repo"
+)
+
+// Import the bundle name in dstdir. Files already present with the same hash
+// are skipped, files that are different are imported under a conflict name and
+// marked in conflict with the original file, like copy.Copy does. First error
+// is fatal, other errors are non fatal issues. Once ctx is done, no new file is
+// imported: the files imported are committed and a copy.Interrupted error is
+// returned.
+func Apply(ctx context.Context, name, dstdir string, p copy.Progress) (error, []error) {
+	var errs []error
+	var successes []commit.Entry
+
+	parts, err := Parts(name)
+	if err != nil {
+		return err, nil
+	}
+
+	r, err := openParts(parts)
+	if err != nil {
+		return err, nil
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return err, nil
+	} else if hdr.Name != ManifestName {
+		return fmt.Errorf("%s: not a bundle, missing %s", name, ManifestName), nil
+	}
+
+	entries, err := commit.ReadEntries(tr)
+	if err != nil {
+		return err, nil
+	}
+	manifest := map[string]commit.Entry{}
+	for _, e := range entries {
+		manifest[e.Path] = e
+	}
+
+	os.MkdirAll(dstdir, 0777)
+
+	// The temporary files must not be removed by copies running meanwhile
+	transfers, err := copy.LockTransfers(dstdir)
+	if err != nil {
+		return err, nil
+	}
+	defer transfers.Unlock()
+
+	dst, err := commit.ReadCommit(dstdir)
+	if err != nil {
+		return err, nil
+	}
+
+	c, err := commit.OpenDirAppend(dstdir)
+	if err != nil {
+		return err, nil
+	}
+	defer c.Close()
+
+	// Directory times are set once their content is extracted
+	dirtimes := &meta.DirTimes{}
+
+	// Conflicts name the bundle as their source repository
+	namer := repo.NewConflictNamer(name, dstdir)
+
+	// Files are only written below directories inside dstdir
+	inside, err := newDirChecker(dstdir)
+	if err != nil {
+		return err, nil
+	}
+
+	var interrupted error
+	seen := 0
+	for i := 0; true; i++ {
+		if ctx.Err() != nil {
+			interrupted = &copy.Interrupted{Copied: len(successes), NotCopied: len(entries) - seen}
+			break
+		}
+
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err, errs
+		}
+
+		path := filepath.Clean(hdr.Name)
+		if filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			return fmt.Errorf("%s: invalid path in bundle", hdr.Name), errs
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			dirpath := filepath.Join(dstdir, path)
+			if err := inside.check(dirpath); err != nil {
+				return err, errs
+			}
+			errs = append(errs, applyDir(hdr, dirpath, dirtimes)...)
+			continue
+		}
+
+		s, ok := manifest[path]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: not in bundle manifest, skipped", path))
+			continue
+		}
+		seen++
+
+		if p != nil {
+			p.SetProgress(i, len(entries), "Import "+path)
+		}
+
+		// Find destination file name, a file not committed or a directory in the
+		// destination is kept and the file imported next to it
+		var d commit.Entry = commit.Entry(s)
+		di, conflict := dst.ByPath[s.Path]
+		if conflict && bytes.Equal(dst.Entries[di].Hash, s.Hash) {
+			continue
+		} else if _, err := os.Lstat(filepath.Join(dstdir, s.Path)); err == nil {
+			conflict = true
+		}
+		if conflict {
+			d.Path = commit.FindConflictFileName(s, dst, namer)
+			if d.Path == "" {
+				continue
+			}
+		}
+
+		dstpath := filepath.Join(dstdir, d.Path)
+		if err := inside.check(filepath.Dir(dstpath)); err != nil {
+			return err, errs
+		}
+
+		os.MkdirAll(filepath.Dir(dstpath), 0777)
+
+		fname, err, ers := extractTemp(tr, hdr, dstpath, s.Hash)
+		errs = append(errs, ers...)
+		if err != nil {
+			return err, errs
+		}
+
+		// On failure, the temporary file is removed and the file is skipped
+		err, ers = copy.RenameNoReplace(fname, dstpath)
+		errs = append(errs, ers...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s, skipped", dstpath, err.Error()))
+			continue
+		}
+
+		// In case of conflicts, mark the file as a conflict
+		if conflict {
+			original := filepath.Join(dstdir, s.Path)
+			errs = append(errs, repo.MarkConflict(original, dstpath, s.Hash)...)
+			if err := repo.RecordConflict(original, s.Hash); err != nil {
+				errs = append(errs, fmt.Errorf("%s: could not record conflict: %s", dstpath, err.Error()))
+			}
+		}
+
+		// Add to commit file
+		err = c.Add(d)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		successes = append(successes, d)
+	}
+
+	errs = append(errs, dirtimes.Apply()...)
+
+	err = commit.WriteDirAppend(dstdir, successes)
+
+	if p != nil && err == nil && interrupted == nil {
+		p.SetProgress(len(entries), len(entries),
+			fmt.Sprintf("%d files imported with %d errors", len(successes), len(errs)))
+	}
+	if err == nil {
+		err = interrupted
+	}
+	return err, errs
+}
+
+// Checks that directories are inside root once symbolic links are resolved
+type dirChecker struct {
+	root    string
+	checked map[string]bool
+}
+
+func newDirChecker(root string) (*dirChecker, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+	return &dirChecker{root: real, checked: map[string]bool{}}, nil
+}
+
+// Return an error if dir, or its closest parent that exists, resolves outside
+// of the root, as through a symbolic link in the destination or extracted from
+// the bundle. Directories created afterwards are created in there.
+func (c *dirChecker) check(dir string) error {
+	d, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	for !c.checked[d] {
+		real, err := filepath.EvalSymlinks(d)
+		if os.IsNotExist(err) && filepath.Dir(d) != d {
+			d = filepath.Dir(d)
+			continue
+		} else if err != nil {
+			return err
+		}
+		if real != c.root && !strings.HasPrefix(real, c.root+string(filepath.Separator)) {
+			return fmt.Errorf("%s: outside of the destination through a symbolic link", dir)
+		}
+		c.checked[d] = true
+	}
+	return nil
+}
+
+func applyDir(hdr *tar.Header, path string, dirtimes *meta.DirTimes) []error {
+	var errs []error
+	err := os.Mkdir(path, os.FileMode(hdr.Mode).Perm())
+	if err != nil && !os.IsExist(err) {
+		return []error{err}
+	}
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		errs = append(errs, err)
+	}
+	dirtimes.Add(path, hdr.AccessTime, hdr.ModTime)
+	return append(errs, setXattrs(hdr, path)...)
+}
+
+func setXattrs(hdr *tar.Header, path string) []error {
+	var errs []error
+	for key, val := range hdr.PAXRecords {
+		if strings.HasPrefix(key, paxXattr) {
+			err := attrs.Set(path, key[len(paxXattr):], []byte(val))
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// Extract the current archive member to a temporary file next to dst and check
+// its content against digest. First error is fatal, other errors are issues
+// replicating attributes.
+func extractTemp(tr *tar.Reader, hdr *tar.Header, dst string, digest []byte) (string, error, []error) {
+	var errs []error
+	hasher := sha1.New()
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), copy.TempPrefix)
+	if err != nil {
+		return "", err, nil
+	}
+	fname := f.Name()
+
+	switch hdr.Typeflag {
+	case tar.TypeSymlink:
+		f.Close()
+		err = os.Remove(fname)
+		if err == nil {
+			err = os.Symlink(hdr.Linkname, fname)
+		}
+		hasher.Write([]byte(hdr.Linkname))
+	case tar.TypeReg:
+		_, err = io.Copy(io.MultiWriter(f, hasher), tr)
+		f.Close()
+	default:
+		f.Close()
+		err = fmt.Errorf("%s: unsupported file type in bundle", hdr.Name)
+	}
+
+	if err == nil {
+		var actual []byte
+		actual, err = mh.Encode(hasher.Sum(nil), mh.SHA1)
+		if err == nil && !bytes.Equal(actual, digest) {
+			err = fmt.Errorf("%s: corrupt file in bundle, hash mismatch", hdr.Name)
+		}
+	}
+
+	if err != nil {
+		if e := os.Remove(fname); e != nil && !os.IsNotExist(e) {
+			errs = append(errs, e)
+		}
+		return "", err, errs
+	}
+
+	if err := os.Lchown(fname, hdr.Uid, hdr.Gid); err != nil {
+		errs = append(errs, err)
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(fname, os.FileMode(hdr.Mode).Perm()); err != nil {
+			errs = append(errs, err)
+		}
+		if err := os.Chtimes(fname, hdr.AccessTime, hdr.ModTime); err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, setXattrs(hdr, fname)...)
+
+		info, err := os.Lstat(fname)
+		if err == nil {
+			_, err = repo.CommitFileHash(fname, info, digest, false)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return fname, nil, errs
+}
@@ -0,0 +1,235 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/repo"
+)
+
+// Name of the first archive member, listing the bundled entries in the
+// .doccommit format.
+const ManifestName = ".docbundle"
+
+// Prefix of PAX records holding extended attributes
+const paxXattr = "SCHILY.xattr."
+
+type CreateOptions struct {
+	// Maximum size of each part, 0 to write a single file
+	PartSize int64
+
+	// Progress reporting, can be nil
+	Progress copy.Progress
+
+	// No new file is bundled once the context is done, can be nil
+	Context context.Context
+}
+
+// Return the entries of src that other lacks: entries with no counterpart of
+// the same name and with the same hash.
+func Missing(src, other *commit.Commit) []commit.Entry {
+	var res []commit.Entry
+	for _, s := range src.Entries {
+		if s.Drop || strings.HasSuffix(s.Path, "/") || len(s.Hash) == 0 {
+			continue
+		}
+		if src.GetAttr(s.Path, "private") == "1" {
+			continue
+		}
+		if oi, ok := other.ByName[s.Name()]; ok && bytes.Equal(other.Entries[oi].Hash, s.Hash) {
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// Write a bundle named out containing the committed files of srcdir that the
+// other commit lacks. Files that changed since they were committed are not
+// included. First error is fatal, other errors are skipped files. If the
+// context is done, the files bundled so far are kept in a complete bundle and
+// a copy.Interrupted error is returned.
+func Create(srcdir string, other *commit.Commit, out string, opts CreateOptions) (error, []error) {
+	var errs []error
+	p := opts.Progress
+
+	src, err := commit.ReadCommit(srcdir)
+	if err != nil {
+		return err, nil
+	}
+
+	entries := Missing(src, other)
+
+	// Keep only files that still have their committed content
+	var included []commit.Entry
+	for i, e := range entries {
+		if p != nil {
+			p.SetProgress(i, 2*len(entries)+1, "Check "+e.Path)
+		}
+		err := checkEntry(filepath.Join(srcdir, e.Path), e)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		included = append(included, e)
+	}
+
+	w := newPartWriter(out, opts.PartSize)
+	tw := tar.NewWriter(w)
+
+	var manifest bytes.Buffer
+	err = commit.WriteEntries(&manifest, included)
+	if err != nil {
+		return err, errs
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     ManifestName,
+		Mode:     0644,
+		Size:     int64(manifest.Len()),
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	})
+	if err == nil {
+		_, err = tw.Write(manifest.Bytes())
+	}
+	if err != nil {
+		return err, errs
+	}
+
+	okdirs := map[string]bool{}
+	var interrupted error
+	for i, e := range included {
+		if opts.Context != nil && opts.Context.Err() != nil {
+			interrupted = &copy.Interrupted{Copied: i, NotCopied: len(included) - i}
+			break
+		}
+		if p != nil {
+			p.SetProgress(len(entries)+i, 2*len(entries)+1, "Bundle "+e.Path)
+		}
+
+		for _, dir := range parentDirs(e.Path, okdirs) {
+			err, ers := writeEntry(tw, filepath.Join(srcdir, dir), dir+"/")
+			errs = append(errs, ers...)
+			if err != nil {
+				return err, errs
+			}
+			okdirs[dir] = true
+		}
+
+		err, ers := writeEntry(tw, filepath.Join(srcdir, e.Path), e.Path)
+		errs = append(errs, ers...)
+		if err != nil {
+			return err, errs
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return err, errs
+	}
+
+	err = w.Close()
+	if err == nil {
+		err = interrupted
+	}
+
+	if p != nil && err == nil {
+		p.SetProgress(2*len(entries)+1, 2*len(entries)+1,
+			fmt.Sprintf("%d files bundled in %d parts with %d errors", len(included), len(w.parts), len(errs)))
+	}
+
+	return err, errs
+}
+
+func checkEntry(path string, e commit.Entry) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	digest, err := repo.GetHash(path, info, true)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, e.Hash) {
+		return fmt.Errorf("%s: modified since last commit, not bundled", path)
+	}
+	return nil
+}
+
+func parentDirs(path string, ok map[string]bool) []string {
+	var res []string
+	for d := filepath.Dir(path); !ok[d] && d != "." && d != "/"; d = filepath.Dir(d) {
+		res = append([]string{d}, res...)
+	}
+	return res
+}
+
+// Write an archive member for path. First error is fatal, other errors are
+// issues reading the attributes.
+func writeEntry(tw *tar.Writer, path, name string) (error, []error) {
+	var errs []error
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err, nil
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(path)
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err, nil
+	}
+	hdr.Name = name
+	hdr.Format = tar.FormatPAX
+	hdr.PAXRecords = map[string]string{}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.AccessTime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	}
+
+	if info.Mode()&os.ModeSymlink == 0 {
+		names, values, err := attrs.GetList(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for i, name := range names {
+			hdr.PAXRecords[paxXattr+name] = string(values[i])
+		}
+	}
+
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err, errs
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, errs
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err, errs
+	}
+	defer f.Close()
+
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err, errs
+}
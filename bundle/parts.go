@@ -0,0 +1,247 @@
+package bundle
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	base58 "github.com/jbenet/go-base58"
+	mh "github.com/jbenet/go-multihash"
+)
+
+// Suffix of the file listing the hash of each part and of the whole bundle
+const SumsSuffix = ".sums"
+
+// Name of the n-th part (starting at 1) of a split bundle
+func PartName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// Return the list of files making up the bundle name. name can be the bundle
+// itself, or its first part.
+func Parts(name string) ([]string, error) {
+	if strings.HasSuffix(name, ".001") {
+		name = name[:len(name)-4]
+	}
+
+	if _, err := os.Lstat(PartName(name, 1)); os.IsNotExist(err) {
+		_, err = os.Lstat(name)
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+
+	var parts []string
+	for i := 1; true; i++ {
+		part := PartName(name, i)
+		if _, err := os.Lstat(part); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func encodeHash(h hash.Hash) string {
+	digest, err := mh.Encode(h.Sum(nil), mh.SHA1)
+	if err != nil {
+		panic(err)
+	}
+	return base58.Encode(digest)
+}
+
+// Writer splitting the bundle in parts of at most size bytes. If size is 0,
+// the bundle is written to a single file. Each part is hashed as well as the
+// whole bundle, and the hashes are written next to the bundle on Close.
+type partWriter struct {
+	name  string
+	size  int64
+	f     *os.File
+	n     int64
+	parts []string
+	sums  []string
+	part  hash.Hash
+	whole hash.Hash
+}
+
+func newPartWriter(name string, size int64) *partWriter {
+	return &partWriter{name: name, size: size, whole: sha1.New()}
+}
+
+func (w *partWriter) closePart() error {
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	w.sums = append(w.sums, encodeHash(w.part))
+	return err
+}
+
+func (w *partWriter) openPart() error {
+	name := w.name
+	if w.size > 0 {
+		name = PartName(w.name, len(w.parts)+1)
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	w.f = f
+	w.n = 0
+	w.part = sha1.New()
+	w.parts = append(w.parts, name)
+	return nil
+}
+
+func (w *partWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		if w.f != nil && w.size > 0 && w.n >= w.size {
+			if err := w.closePart(); err != nil {
+				return written, err
+			}
+		}
+		if w.f == nil {
+			if err := w.openPart(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := data
+		if w.size > 0 && int64(len(chunk)) > w.size-w.n {
+			chunk = chunk[:w.size-w.n]
+		}
+
+		n, err := w.f.Write(chunk)
+		w.part.Write(chunk[:n])
+		w.whole.Write(chunk[:n])
+		w.n += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		data = data[n:]
+	}
+	return written, nil
+}
+
+// Close the last part and write the sums file
+func (w *partWriter) Close() error {
+	if w.f == nil && len(w.parts) == 0 {
+		if err := w.openPart(); err != nil {
+			return err
+		}
+	}
+	err := w.closePart()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(w.name + SumsSuffix)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for i, part := range w.parts {
+		_, err = fmt.Fprintf(f, "%s\t%s\n", w.sums[i], filepath.Base(part))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(f, "%s\t%s\n", encodeHash(w.whole), filepath.Base(w.name))
+	return err
+}
+
+// Open the bundle for reading, concatenating all the parts
+func openParts(parts []string) (io.ReadCloser, error) {
+	var files []*os.File
+	var readers []io.Reader
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	return &partReader{io.MultiReader(readers...), files}, nil
+}
+
+type partReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (r *partReader) Close() error {
+	var err error
+	for _, f := range r.files {
+		if e := f.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Check each part of the bundle, and the whole bundle against the hashes
+// stored in the sums file. Return the list of parts that failed the check.
+func Verify(name string) ([]string, error) {
+	parts, err := Parts(name)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, ".001") {
+		name = name[:len(name)-4]
+	}
+
+	sums := map[string]string{}
+	f, err := os.Open(name + SumsSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		elems := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(elems) == 2 {
+			sums[elems[1]] = elems[0]
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	whole := sha1.New()
+	for _, part := range parts {
+		h := sha1.New()
+		pf, err := os.Open(part)
+		if err != nil {
+			return failed, err
+		}
+		_, err = io.Copy(io.MultiWriter(h, whole), pf)
+		pf.Close()
+		if err != nil {
+			return failed, err
+		}
+		if sums[filepath.Base(part)] != encodeHash(h) {
+			failed = append(failed, part)
+		}
+	}
+	if len(parts) > 1 && sums[filepath.Base(name)] != encodeHash(whole) {
+		failed = append(failed, name)
+	}
+	return failed, nil
+}
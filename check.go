@@ -1,15 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
-	"time"
 
 	base58 "github.com/jbenet/go-base58"
-	attrs "github.com/mildred/doc/attrs"
+	api "github.com/mildred/doc/api"
 	repo "github.com/mildred/doc/repo"
 )
 
@@ -31,6 +28,8 @@ Options:
 func mainCheck(args []string) int {
 	f := flag.NewFlagSet("status", flag.ExitOnError)
 	opt_all := f.Bool("a", false, "Check all files, including modified")
+	opt_follow := f.Bool("L", false, "Follow symbolic links")
+	opt_one_fs := f.Bool("x", false, "Don't cross filesystem boundaries")
 	f.Usage = func() {
 		fmt.Print(checkUsage)
 		f.PrintDefaults()
@@ -41,58 +40,37 @@ func mainCheck(args []string) int {
 		dir = "."
 	}
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		// Skip .dirstore/ at root
-		if filepath.Base(path) == attrs.DirStoreName && filepath.Dir(path) == dir && info.IsDir() {
-			return filepath.SkipDir
-		} else if info.IsDir() {
-			return nil
-		}
-
-		hashTimeStr, err := attrs.Get(path, repo.XattrHashTime)
-		if err != nil {
-			return nil
-		}
-
-		hashTime, err := time.Parse(time.RFC3339Nano, string(hashTimeStr))
-		if err != nil {
-			return err
-		}
-
-		timeEqual := hashTime == info.ModTime()
-		if *opt_all || timeEqual {
-
-			hash, err := attrs.Get(path, repo.XattrHash)
-			if err != nil {
-				return err
-			}
-
-			digest, err := repo.HashFile(path, info)
-			if err != nil {
-				return err
-			}
-
-			hashEqual := bytes.Equal(hash, digest)
+	opts := api.CheckOptions{
+		All: *opt_all,
+		Walk: repo.WalkOptions{
+			FollowSymlinks: *opt_follow,
+			OneFileSystem:  *opt_one_fs,
+		},
+	}
 
-			if !timeEqual && !hashEqual {
-				fmt.Printf("+\t%s\t%s\n", base58.Encode(digest), path)
-			} else if !hashEqual {
-				fmt.Printf("!\t%s\t%s\n", base58.Encode(digest), path)
-			} else if !timeEqual {
-				fmt.Printf("=\t%s\t%s", base58.Encode(digest), path)
-			}
+	opts.Checked = func(f api.FileCheck) {
+		if f.TimeChanged && f.HashChanged {
+			fmt.Printf("+\t%s\t%s\n", base58.Encode(f.Hash), f.Path)
+		} else if f.HashChanged {
+			fmt.Printf("!\t%s\t%s\n", base58.Encode(f.Hash), f.Path)
+		} else {
+			fmt.Printf("=\t%s\t%s\n", base58.Encode(f.Hash), f.Path)
 		}
+	}
 
-		return nil
-	})
+	_, err, errs := api.Check(interrupt, dir, opts)
 
-	if err != nil {
+	status := 0
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", e.Error())
+		status = 1
+	}
+	if isInterrupt(err) {
+		fmt.Fprintf(os.Stderr, "interrupted, the check is incomplete\n")
+		return 1
+	} else if err != nil {
 		fmt.Fprintf(os.Stderr, "%v", err)
 		return 1
 	}
-	return 0
+	return status
 }
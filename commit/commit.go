@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -51,12 +52,25 @@ type Entry struct {
 	Device uint64
 	Inode  uint64
 	Drop   bool
+
+	// Path of the file in the repository it was copied from, when Path was
+	// rewritten for the filesystem
+	Original string
 }
 
 func (e *Entry) DropEntry() {
 	e.Drop = true
 }
 
+// Return the path of the file as it is named in other repositories: its
+// original path, or its path if it was not rewritten
+func (e *Entry) Name() string {
+	if e.Original != "" {
+		return e.Original
+	}
+	return e.Path
+}
+
 func (e *Entry) HashText() string {
 	return base58.Encode(e.Hash)
 }
@@ -67,6 +81,7 @@ type Commit struct {
 	Entries        []Entry
 	ByHash         map[string][]int
 	ByPath         map[string]int
+	ByName         map[string]int
 	ByUuid         map[string]int
 	Attrs          map[string]map[string]string
 	UuidByDevInode map[string]string
@@ -103,6 +118,11 @@ func (c *Commit) DropTree(path string) {
 	}
 }
 
+// Return the directory the entry paths are relative to
+func (c *Commit) Dir() string {
+	return filepath.Join(filepath.Dir(c.fname), c.prefix)
+}
+
 func (c *Commit) Write() error {
 	return writeDoccommitFile(c.fname, c.prefix, c.Entries)
 }
@@ -163,6 +183,7 @@ func ReadCommit(dirPath string) (*Commit, error) {
 			map[string][]int{},
 			map[string]int{},
 			map[string]int{},
+			map[string]int{},
 			map[string]map[string]string{},
 			map[string]string{},
 		}, nil
@@ -188,11 +209,15 @@ func readEntryAttr(ent *Entry, key, val string) {
 		ent.Path = val
 		break
 	case "h":
-		ent.Hash = base58.Decode(val)
+		// Decoded by readEntry along with old style entries
+		ent.Hash = []byte(val)
 		break
 	case "u":
 		ent.Uuid = val
 		break
+	case "o":
+		ent.Original = val
+		break
 	case "I":
 		ent.Device = StringDevice(val)
 		ent.Inode = StringInode(val)
@@ -256,6 +281,7 @@ func readCommitFile(path, prefix string) (*Commit, []string, error) {
 		map[string][]int{},
 		map[string]int{},
 		map[string]int{},
+		map[string]int{},
 		map[string]map[string]string{},
 		map[string]string{},
 	}
@@ -276,9 +302,16 @@ func readCommitFile(path, prefix string) (*Commit, []string, error) {
 		if err != nil {
 			panic(err)
 		}
+		if ent.Original != "" {
+			ent.Original, err = filepath.Rel(prefix, ent.Original)
+			if err != nil {
+				panic(err)
+			}
+		}
 		files = append(files, ent.Path)
 		c.Entries = append(c.Entries, ent)
 		c.ByPath[ent.Path] = idx
+		c.ByName[ent.Name()] = idx
 		c.ByHash[ent_hash] = append(c.ByHash[ent_hash], idx)
 		if ent.Uuid != "" {
 			c.ByUuid[ent.Uuid] = idx
@@ -290,6 +323,18 @@ func readCommitFile(path, prefix string) (*Commit, []string, error) {
 	return &c, files, scanner.Err()
 }
 
+// Read a .doccommit file without looking for the enclosing repository. Paths
+// are relative to the directory containing the file. Attributes from .docattr
+// files are not available.
+func ReadCommitFile(path string) (*Commit, error) {
+	c, _, err := readCommitFile(path, "")
+	if err == nil && c.Entries == nil {
+		// readCommitFile returns an empty commit for missing files
+		_, err = os.Lstat(path)
+	}
+	return c, err
+}
+
 type CommitAppender struct {
 	f      *os.File
 	prefix string
@@ -332,6 +377,11 @@ func (c *CommitAppender) Add(e Entry) error {
 	return err
 }
 
+// Flush the entries added to disk
+func (c *CommitAppender) Sync() error {
+	return c.f.Sync()
+}
+
 func (c *CommitAppender) Close() error {
 	return c.f.Close()
 }
@@ -378,6 +428,9 @@ func WriteDirAppend(dirPath string, entries []Entry) error {
 	// Prefix the new entries
 	for _, ent := range newEntries {
 		ent.Path = prefix + ent.Path
+		if ent.Original != "" {
+			ent.Original = prefix + ent.Original
+		}
 		entries = append(entries, ent)
 	}
 
@@ -398,19 +451,24 @@ func entryToLine(prefix string, e Entry) string {
 	}
 
 	path := e.Path
+	original := e.Original
 	if prefix != "" {
 		path = filepath.Join(prefix, path)
 		if strings.HasSuffix(e.Path, "/") {
 			path = path + "/"
 		}
+		if original != "" {
+			original = filepath.Join(prefix, original)
+		}
 	}
 
-	if e.Uuid != "" || e.Device != 0 || e.Inode != 0 {
+	if e.Uuid != "" || e.Device != 0 || e.Inode != 0 || original != "" {
 		return "-\n" +
 			formatKeyVal("p", path) +
 			formatKeyVal("h", base58.Encode(e.Hash)) +
 			formatKeyVal("u", e.Uuid) +
 			formatKeyVal("I", DeviceInodeString(e.Device, e.Inode)) +
+			formatKeyVal("o", original) +
 			"\n"
 	} else {
 		return fmt.Sprintf("%s\t%s\n", base58.Encode(e.Hash), EncodePath(path))
@@ -502,6 +560,22 @@ func Init(dir string) error {
 	return commitDircommit(newpath, digest)
 }
 
+// Write entries to w in the .doccommit format
+func WriteEntries(w io.Writer, entries []Entry) error {
+	for _, e := range entries {
+		_, err := io.WriteString(w, entryToLine("", e))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read entries in the .doccommit format from r
+func ReadEntries(r io.Reader) ([]Entry, error) {
+	return scanEntries(r, "", false)
+}
+
 func readEntries(path, prefix string, reverse bool) ([]Entry, error) {
 	f, err := os.Open(path)
 	if err != nil {
@@ -509,12 +583,19 @@ func readEntries(path, prefix string, reverse bool) ([]Entry, error) {
 	}
 	defer f.Close()
 
+	return scanEntries(f, prefix, reverse)
+}
+
+func scanEntries(r io.Reader, prefix string, reverse bool) ([]Entry, error) {
 	var res []Entry
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		ent, _ := readEntry(scanner)
 		ent.Path = FilterPrefix(ent.Path, prefix, reverse)
+		if ent.Original != "" {
+			ent.Original = FilterPrefix(ent.Original, prefix, reverse)
+		}
 		if ent.Path != "" {
 			res = append(res, ent)
 		}
@@ -540,11 +621,30 @@ func FilterPrefix(path, prefix string, reverse bool) string {
 	}
 }
 
+// Decode the escapes written by EncodePath. A backslash followed by an actual
+// tab or newline is decoded as well.
 func DecodePath(path string) string {
-	path = strings.Replace(path, "\\\t", "\t", -1)
-	path = strings.Replace(path, "\\\n", "\n", -1)
-	path = strings.Replace(path, "\\\\", "\\", -1)
-	return path
+	if strings.IndexByte(path, '\\') < 0 {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if c == '\\' && i+1 < len(path) {
+			switch path[i+1] {
+			case 't', '\t':
+				c = '\t'
+				i++
+			case 'n', '\n':
+				c = '\n'
+				i++
+			case '\\':
+				i++
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
 }
 
 func EncodePath(path string) string {
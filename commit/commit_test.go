@@ -0,0 +1,91 @@
+package commit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testEntries = []Entry{
+	{Hash: []byte{0x11, 0x14, 1}, Path: "plain.txt"},
+	{Hash: []byte{0x11, 0x14, 2}, Path: "dir/with\ttab and\nnewline"},
+	{Hash: []byte{0x11, 0x14, 3}, Path: "dir/a\uf022b", Original: "dir/a:b"},
+	{Hash: []byte{0x11, 0x14, 4}, Path: "new\nline\uf029", Original: "new\nline.", Uuid: "1234-5678", Device: 12, Inode: 34},
+	{Hash: []byte{0x11, 0x14, 5}, Path: "uuid", Uuid: "abcd", Device: 56, Inode: 78},
+}
+
+func TestWriteReadEntries(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteEntries(&buf, testEntries); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ReadEntries(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, testEntries) {
+		t.Errorf("read %#v, want %#v", entries, testEntries)
+	}
+}
+
+func TestReadCommitPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	if err := WriteEntries(&buf, testEntries); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, Doccommit)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// Paths and original paths are relative to the directory read
+	c, _, err := readCommitFile(path, "dir/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, ok := c.ByName["a:b"]
+	if !ok {
+		t.Fatalf("a:b not found by its original name in %#v", c.ByName)
+	}
+	if e := c.Entries[i]; e.Path != "a\uf022b" || e.Original != "a:b" || c.ByPath[e.Path] != i {
+		t.Errorf("read %#v", e)
+	}
+	if i, ok := c.ByPath["with\ttab and\nnewline"]; !ok || c.Entries[i].Original != "" {
+		t.Errorf("with\\ttab and\\nnewline not found in %#v", c.ByPath)
+	}
+
+	i = c.ByUuid["1234-5678"]
+	if e := c.Entries[i]; e.Name() != "../new\nline." || c.UuidByDevInode[DeviceInodeString(12, 34)] != e.Uuid {
+		t.Errorf("read %#v", e)
+	}
+}
+
+func TestDecodePath(t *testing.T) {
+	tests := []string{
+		"plain",
+		"tab\there",
+		"new\nline",
+		"back\\slash",
+		"back\\tslash",
+		"\\\\t\\n\t\n",
+	}
+	for _, path := range tests {
+		if decoded := DecodePath(EncodePath(path)); decoded != path {
+			t.Errorf("%q encoded as %q, decoded as %q", path, EncodePath(path), decoded)
+		}
+	}
+
+	// Older escapes of an actual tab or newline
+	if decoded := DecodePath("a\\\tb\\\nc"); decoded != "a\tb\nc" {
+		t.Errorf("decoded %q", decoded)
+	}
+}
@@ -2,25 +2,47 @@ package commit
 
 import (
 	"bytes"
-	"fmt"
+	"os"
 	"path/filepath"
+
+	repo "github.com/mildred/doc/repo"
 )
 
-// Return a conflict filename to use. Return the empty string if the conflict
-// file already exists for the same hash.
-func FindConflictFileName(entry Entry, dest_commit *Commit) string {
-	hashext := "." + entry.HashText()
-	ext := filepath.Ext(entry.Path)
-	dstname := fmt.Sprintf("%s%s%s", entry.Path, hashext, ext)
-	i := 0
-	for {
+// Return a conflict filename to use, named by n. Return the empty string if a
+// conflict file already exists for the same hash, whatever its name, or existed
+// and was dismissed. Conflict files not committed yet, as created by doc sync,
+// are also looked for.
+func FindConflictFileName(entry Entry, dest_commit *Commit, n repo.ConflictNamer) string {
+	dir := dest_commit.Dir()
+	path := filepath.Join(dir, entry.Path)
+	for _, name := range repo.ConflictNames(path, entry.Hash) {
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			continue
+		}
+		idx, exists := dest_commit.ByPath[rel]
+		if exists && bytes.Equal(dest_commit.Entries[idx].Hash, entry.Hash) {
+			return ""
+		}
+	}
+	if repo.HasConflict(path, entry.Hash) || repo.ConflictRecorded(path, entry.Hash) {
+		return ""
+	}
+
+	for i := 0; true; i++ {
+		name := n.Name(path, entry.Hash, i)
+		dstname, err := filepath.Rel(dir, name)
+		if err != nil {
+			return ""
+		}
 		idx, exists := dest_commit.ByPath[dstname]
 		if exists && bytes.Equal(dest_commit.Entries[idx].Hash, entry.Hash) {
 			return ""
 		} else if !exists {
-			return dstname
+			if _, err := os.Lstat(name); os.IsNotExist(err) {
+				return dstname
+			}
 		}
-		dstname = fmt.Sprintf("%s%s.%d%s", entry.Path, hashext, i, ext)
-		i++
 	}
+	return ""
 }
@@ -0,0 +1,225 @@
+package copy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	base58 "github.com/jbenet/go-base58"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/journal"
+	"github.com/mildred/doc/repo"
+)
+
+// Move aside, under a conflict name, the destination files and symlinks that
+// are in the way of the parent directories of the jobs. The directory from the
+// source is created in their place, and they are marked as its conflict
+// alternatives. Their entries are renamed in dst, which is written. Each move
+// is journaled in ops until dst is written. First error is fatal.
+func moveAside(srcdir, dstdir string, jobs []job, dst *commit.Commit, ops *Operations, opts Options) (error, []error) {
+	var errs []error
+	var ids, dirs []string
+	namer := conflictNamer(srcdir, dstdir, opts)
+	checked := map[string]bool{}
+	renamed := false
+
+	for _, j := range jobs {
+		for _, dir := range parentDirs(j.d.Path, checked) {
+			checked[dir] = true
+			path := filepath.Join(dstdir, dir)
+			info, err := os.Lstat(path)
+			if err != nil || info.IsDir() {
+				continue
+			}
+
+			i, committed := dst.ByPath[dir]
+			var hash []byte
+			if committed {
+				hash = dst.Entries[i].Hash
+			} else if hash, err = repo.GetHash(path, info, true); err != nil {
+				return err, errs
+			}
+
+			aside := repo.FreeConflictFileName(path, hash, namer)
+			src := filepath.Join(srcdir, sourceDir(j.s.Path, dir))
+			commitDir := ""
+			if committed {
+				commitDir = dstdir
+			}
+			if ops != nil {
+				id, err := ops.j.Begin("aside", asideArgs(path, aside, src, hash, commitDir))
+				if err != nil {
+					return err, errs
+				}
+				ids = append(ids, id)
+			}
+
+			if err := os.Rename(path, aside); err != nil {
+				return err, errs
+			}
+			err, ers := MkdirFrom(src, path, nil)
+			errs = append(errs, ers...)
+			if err != nil {
+				return err, errs
+			}
+			errs = append(errs, markAside(path, aside, hash)...)
+			dirs = append(dirs, filepath.Dir(path))
+			events.Emit(events.Event{Type: events.ConflictCreated, Path: aside, Original: path})
+
+			if committed {
+				rel := filepath.Join(filepath.Dir(dir), filepath.Base(aside))
+				delete(dst.ByName, dst.Entries[i].Name())
+				delete(dst.ByPath, dir)
+				dst.Entries[i].Path, dst.Entries[i].Original = rel, ""
+				dst.ByPath[rel] = i
+				dst.ByName[rel] = i
+				renamed = true
+			}
+		}
+	}
+
+	if renamed {
+		if err := dst.Write(); err != nil {
+			return err, errs
+		}
+	}
+
+	// The moves must be on disk before the journal forgets about them
+	for _, dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return err, errs
+		}
+	}
+	for _, id := range ids {
+		if err := ops.j.Done(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return nil, errs
+}
+
+func asideArgs(path, aside, src string, hash []byte, commitDir string) map[string]string {
+	args := map[string]string{
+		"path":  absPath(path),
+		"aside": absPath(aside),
+		"src":   absPath(src),
+		"hash":  base58.Encode(hash),
+	}
+	if commitDir != "" {
+		args["commit"] = absPath(commitDir)
+	}
+	return args
+}
+
+// Record the move aside to aside of the file or symlink at path, with hash,
+// for the directory created from src in its place. Return the record id.
+// Nothing is recorded if aside already exists: the move will fail and the
+// existing file must not be taken for the file moved.
+func (o *Operations) BeginAside(path, aside, src string, hash []byte) (string, error) {
+	if o == nil {
+		return "", nil
+	} else if _, err := os.Lstat(aside); err == nil {
+		return "", nil
+	}
+	args := asideArgs(path, aside, src, hash, "")
+	id, err := o.j.Begin("aside", args)
+	if err == nil {
+		o.mu.Lock()
+		o.asides[id] = journal.Record{Id: id, Op: "aside", Args: args}
+		o.mu.Unlock()
+	}
+	return id, err
+}
+
+// Record the end of the move aside id, ok is false if it failed. A move done
+// is flushed to disk before it is marked done in the journal, a move that
+// failed is completed at once if the file was moved: return true if it was.
+func (o *Operations) FinishAside(id string, ok bool) (bool, []error) {
+	if o == nil || id == "" {
+		return ok, nil
+	}
+	o.mu.Lock()
+	rec := o.asides[id]
+	delete(o.asides, id)
+	o.mu.Unlock()
+
+	if !ok {
+		r, errs := recoverAside(o.j, rec, false)
+		return r.Forward && len(errs) == 0, errs
+	}
+
+	path := rec.Args["path"]
+	for _, p := range []string{path, filepath.Dir(path)} {
+		if err := syncPath(p); err != nil {
+			return true, []error{err}
+		}
+	}
+	if err := o.j.Done(id); err != nil {
+		return true, []error{err}
+	}
+	return true, nil
+}
+
+// Mark aside, the file moved aside for the directory path, as its conflict
+// alternative and record the conflict
+func markAside(path, aside string, hash []byte) []error {
+	errs := repo.MarkConflict(path, aside, hash)
+	if err := repo.RecordConflict(path, hash); err != nil {
+		errs = append(errs, fmt.Errorf("%s: could not record conflict: %s", aside, err.Error()))
+	}
+	return errs
+}
+
+// Complete the move aside of a file once it is renamed: the directory is
+// created in its place, marked and the commit entry renamed. Nothing was done
+// if the file was not renamed yet.
+func recoverAside(j *journal.Journal, rec journal.Record, dry bool) (Recovery, []error) {
+	path, aside, dir := rec.Args["path"], rec.Args["aside"], rec.Args["commit"]
+	hash := base58.Decode(rec.Args["hash"])
+	r := Recovery{Path: path}
+	_, err := os.Lstat(aside)
+	r.Forward = err == nil
+	if dry {
+		return r, nil
+	}
+
+	var errs []error
+	if r.Forward {
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			err, ers := MkdirFrom(rec.Args["src"], path, nil)
+			errs = append(errs, ers...)
+			if err != nil && os.IsNotExist(err) {
+				// The source is gone, create the directory anyway
+				err = os.Mkdir(path, 0777)
+			}
+			if err != nil {
+				return r, append(errs, err)
+			}
+		}
+		errs = append(errs, markAside(path, aside, hash)...)
+
+		if dir != "" {
+			c, err := commit.ReadCommit(dir)
+			if err != nil {
+				return r, append(errs, err)
+			}
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return r, append(errs, err)
+			}
+			if i, ok := c.ByPath[rel]; ok && bytes.Equal(c.Entries[i].Hash, hash) {
+				c.Entries[i].Path = filepath.Join(filepath.Dir(rel), filepath.Base(aside))
+				c.Entries[i].Original = ""
+				if err := c.Write(); err != nil {
+					return r, append(errs, err)
+				}
+			}
+		}
+	}
+	if err := j.Done(rec.Id); err != nil {
+		errs = append(errs, err)
+	}
+	return r, errs
+}
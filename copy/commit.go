@@ -2,26 +2,114 @@ package copy
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
+	gosync "sync"
+	"syscall"
+	"time"
 
+	base58 "github.com/jbenet/go-base58"
+	"github.com/mildred/doc/attrs"
 	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/fastcopy"
+	"github.com/mildred/doc/fold"
+	"github.com/mildred/doc/ignore"
+	"github.com/mildred/doc/journal"
+	"github.com/mildred/doc/meta"
+	"github.com/mildred/doc/plan"
+	"github.com/mildred/doc/pool"
 	"github.com/mildred/doc/repo"
+	"github.com/mildred/doc/throttle"
 )
 
 type Progress interface {
 	SetProgress(cur, max int, message string)
 }
 
-func Copy(srcdir, dstdir string, p Progress, rename bool) (error, []error) {
+// Returned when the context of the options is done before all the files are
+// copied. The files already copied are committed.
+type Interrupted struct {
+	Copied    int
+	NotCopied int
+}
+
+func (e *Interrupted) Error() string {
+	return fmt.Sprintf("interrupted, %d files copied, %d files not copied", e.Copied, e.NotCopied)
+}
+
+// Return true if err is an Interrupted error
+func IsInterrupted(err error) bool {
+	_, ok := err.(*Interrupted)
+	return ok
+}
+
+type Options struct {
+	// Number of files to copy concurrently, 0 or 1 to copy one file at a time
+	Jobs int
+
+	// Maximum number of concurrent copies from the same device, 0 for no limit
+	PerSource int
+
+	// Maximum number of concurrent copies to the same device, 0 for no limit
+	PerDest int
+
+	// Make the destination identical to the source: the destination files
+	// that are not committed, not in the source, or that differ, are moved to
+	// the trash before copying
+	Mirror bool
+
+	// Copy the files ignored by the .docignore files as well
+	NoDocIgnore bool
+
+	// Rewrite the names that FAT, exFAT and NTFS do not accept. The original
+	// names are kept in the destination commit, and restored when copying back.
+	SafeNames bool
+
+	// Stop copying files once the context is done, nil to copy all files
+	Context context.Context
+}
+
+func Copy(srcdir, dstdir string, p Progress, opts Options) (error, []error) {
+	_, err, errs := CopyEntries(srcdir, dstdir, p, opts)
+	return err, errs
+}
+
+// Like Copy, also return the destination entries of the files copied
+func CopyEntries(srcdir, dstdir string, p Progress, opts Options) ([]commit.Entry, error, []error) {
+	events.Emit(events.Event{Type: events.ScanStarted, Src: srcdir, Dst: dstdir})
+	copied, err, errs := copyDirs(srcdir, dstdir, p, opts)
+	emitFinished(srcdir, dstdir, len(copied), err, errs)
+	return copied, err, errs
+}
+
+// Emit the events at the end of a copy, the warnings were not emitted yet.
+// The error that stopped the copy is part of the Finished event.
+func emitFinished(srcdir, dstdir string, copied int, err error, errs []error) {
+	events.EmitWarnings(errs)
+	e := events.Event{
+		Type:  events.Finished,
+		Src:   srcdir,
+		Dst:   dstdir,
+		Files: uint64(copied),
+	}
+	if err != nil {
+		e.Errors = 1
+		e.Error = err.Error()
+	}
+	events.Emit(e)
+}
+
+func copyDirs(srcdir, dstdir string, p Progress, opts Options) ([]commit.Entry, error, []error) {
 	if p != nil {
 		p.SetProgress(0, 4, "Read commit "+srcdir)
 	}
 
 	src, err := commit.ReadCommit(srcdir)
 	if err != nil {
-		return err, nil
+		return nil, err, nil
 	}
 
 	if p != nil {
@@ -30,36 +118,64 @@ func Copy(srcdir, dstdir string, p Progress, rename bool) (error, []error) {
 
 	os.MkdirAll(dstdir, 0777)
 
+	// Each file is journaled until it is copied, marked and committed.
+	// Operations interrupted last time are completed or undone first.
+	ops, errs := OpenOperations(dstdir)
+	defer ops.Close()
+
 	dst, err := commit.ReadCommit(dstdir)
 	if err != nil {
-		return err, nil
+		return nil, err, errs
+	}
+
+	if opts.Mirror {
+		if p != nil {
+			p.SetProgress(1, 4, "Move to trash the files not in "+srcdir)
+		}
+		err, ers := mirrorTrash(dstdir, src, dst, opts)
+		errs = append(errs, ers...)
+		if err == nil {
+			dst, err = commit.ReadCommit(dstdir)
+		}
+		if err != nil {
+			return nil, err, errs
+		}
 	}
 
 	if p != nil {
 		p.SetProgress(2, 4, "Prepare copy")
 	}
 
-	successes, err, errs := copyTree(srcdir, dstdir, src, dst, p)
-	if err != nil {
-		return err, errs
+	successes, err, ers := copyTree(srcdir, dstdir, src, dst, ops, p, opts)
+	errs = append(errs, ers...)
+	if err != nil && !IsInterrupted(err) {
+		return successes, err, errs
 	}
+	return commitCopies(dstdir, successes, err, errs, p)
+}
 
+// Add the copied files to the destination commit. interrupted is the
+// Interrupted error, if any, returned unless the commit fails.
+func commitCopies(dstdir string, successes []commit.Entry, interrupted error, errs []error, p Progress) ([]commit.Entry, error, []error) {
 	if p != nil {
 		p.SetProgress(len(successes)+3, len(successes)+4, fmt.Sprintf("Commit %d new files to %#v", len(successes), dstdir))
 	}
 
-	err = commit.WriteDirAppend(dstdir, successes)
+	err := commit.WriteDirAppend(dstdir, successes)
 
 	if p != nil && err == nil {
 		p.SetProgress(len(successes)+4, len(successes)+4,
 			fmt.Sprintf("%d files copied with %d errors", len(successes), len(errs)))
 	}
-	return err, errs
+	if err == nil {
+		err = interrupted
+	}
+	return successes, err, errs
 }
 
 func wantCopy(s commit.Entry, src, dst *commit.Commit) bool {
 	// Already there, skip
-	di, conflict := dst.ByPath[s.Path]
+	di, conflict := dst.ByName[s.Name()]
 	if conflict && bytes.Equal(dst.Entries[di].Hash, s.Hash) {
 		return false
 	}
@@ -83,10 +199,132 @@ func canCopy(s commit.Entry, src, dst *commit.Commit) bool {
 	return true
 }
 
-func copyTree(srcdir, dstdir string, src, dst *commit.Commit, p Progress) ([]commit.Entry, error, []error) {
+// A file to copy: the source entry s is copied to the destination entry d.
+// When conflict is true, d is a conflict file name for the destination path o,
+// which is the name of s unless the destination spells it differently.
+type job struct {
+	s, d     commit.Entry
+	o        string
+	conflict bool
+}
+
+// Return the namer for the conflicts created in dstdir, their names are
+// rewritten like the other names with SafeNames
+func conflictNamer(srcdir, dstdir string, opts Options) repo.ConflictNamer {
+	namer := repo.NewConflictNamer(srcdir, dstdir)
+	if opts.SafeNames {
+		namer.Rewrite = fold.SafeName
+	}
+	return namer
+}
+
+// Return the files to copy from src to dst. Unless opts.NoDocIgnore is true,
+// the files ignored by the .docignore files of srcdir or dstdir are not copied.
+//
+// Files are matched by name, the path they had before it was rewritten if it
+// was. Source names are matched to the destination names that are the same
+// file there: in another Unicode normalisation form or, on a case-insensitive
+// destination, in another case. Source names colliding that way with a
+// destination name or with each other are copied as conflicts. fs tells how
+// the destination compares names.
+func planTree(srcdir, dstdir string, src, dst *commit.Commit, fs fold.FS, opts Options) []job {
+	var jobs []job
+	namer := conflictNamer(srcdir, dstdir, opts)
+	names := fs.Names()
+	for _, e := range dst.Entries {
+		names.Add(e.Name(), e.Path)
+	}
+	planned := map[string][]byte{}
+	ignores := ignore.New()
+	for _, s := range src.Entries {
+		// Cannot copy, skip
+		if !wantCopy(s, src, dst) {
+			continue
+		}
+
+		// Ignored, skip
+		name := s.Name()
+		if !opts.NoDocIgnore && (ignores.Match(filepath.Join(srcdir, s.Path), false) || ignores.Match(filepath.Join(dstdir, name), false)) {
+			continue
+		}
+
+		// Find the destination path, as spelled in the destination
+		o := name
+		if i, ok := dst.ByName[name]; ok {
+			o = dst.Entries[i].Path
+		} else if p, ok := names.Get(name); ok {
+			o = p
+		} else if o = names.Spell(name); opts.SafeNames {
+			o = fold.SafePath(o)
+		}
+
+		// Already there under another name, skip
+		di, conflict := dst.ByPath[o]
+		hash, copied := planned[o]
+		if conflict && bytes.Equal(dst.Entries[di].Hash, s.Hash) || copied && bytes.Equal(hash, s.Hash) {
+			continue
+		}
+
+		// Find destination file name, a directory in the destination is kept and
+		// the file copied next to it
+		var d commit.Entry = commit.Entry(s)
+		d.Path, d.Original = o, ""
+		if o != name {
+			d.Original = name
+		}
+		conflict = conflict || copied
+		if info, err := os.Lstat(filepath.Join(dstdir, o)); err == nil && info.IsDir() {
+			conflict = true
+		}
+		if conflict {
+			orig := s
+			orig.Path = o
+			d.Path, d.Original = commit.FindConflictFileName(orig, dst, namer), ""
+			if d.Path == "" {
+				continue
+			}
+		} else {
+			names.Add(name, o)
+			planned[o] = s.Hash
+		}
+
+		jobs = append(jobs, job{s, d, o, conflict})
+	}
+	return jobs
+}
+
+func copyTree(srcdir, dstdir string, src, dst *commit.Commit, ops *Operations, p Progress, opts Options) ([]commit.Entry, error, []error) {
+	if p != nil {
+		p.SetProgress(2, 4, "Prepare copy: compute how many files to copy")
+	}
+	var errs []error
+	fs, err := fold.Probe(dstdir, false)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	jobs := planTree(srcdir, dstdir, src, dst, fs, opts)
+	err, ers := moveAside(srcdir, dstdir, jobs, dst, ops, opts)
+	errs = append(errs, ers...)
+	if err != nil {
+		return nil, err, errs
+	}
+	success, err, ers := copyJobs(srcdir, dstdir, jobs, dst, ops, p, opts)
+	return success, err, append(errs, ers...)
+}
+
+// Number of files copied whose commit entries and directories are flushed to
+// disk together
+const syncBatch = 64
+
+// Copy the files of jobs from srcdir to dstdir, dst is the destination commit.
+// Each file is journaled in ops until it is copied, marked and committed.
+func copyJobs(srcdir, dstdir string, jobs []job, dst *commit.Commit, ops *Operations, p Progress, opts Options) ([]commit.Entry, error, []error) {
 	var errs []error
 	var success []commit.Entry
+	var fatal error
 	okdirs := map[string]bool{}
+	dirtimes := &meta.DirTimes{}
+	links := &Links{}
 
 	if p != nil {
 		p.SetProgress(2, 4, "Prepare copy: open "+dstdir)
@@ -98,73 +336,351 @@ func copyTree(srcdir, dstdir string, src, dst *commit.Commit, p Progress) ([]com
 	}
 	defer c.Close()
 
-	if p != nil {
-		p.SetProgress(2, 4, "Prepare copy: compute how many files to copy")
+	srcstore := repo.GetObjectStore(srcdir)
+	dststore := repo.GetObjectStore(dstdir)
+
+	// Leftover temporary files are removed from the directories copied to,
+	// unless they belong to a transfer that can be resumed or other processes
+	// may be writing them. Files named as the temporary files of older
+	// versions are left to doc fsck.
+	var covered map[string]bool
+	var stale func(os.FileInfo) bool
+	if ops != nil {
+		stale = ops.transfers.stale
+		covered, err = pendingTemp(journal.ForDir(dstdir, TransferJournal))
+		if err != nil {
+			errs = append(errs, err)
+		}
 	}
-
-	numfiles := len(src.Entries)
-	if p != nil {
-		numfiles = 0
-		for _, s := range src.Entries {
-			if wantCopy(s, src, dst) {
-				numfiles = numfiles + 1
+	cleaned := map[string]bool{}
+
+	// Bytes are counted as they are copied, the files linked instead of being
+	// copied count once done
+	numfiles := len(jobs)
+	var sizes []int64
+	var totalBytes, linkedBytes uint64
+	startBytes := fastcopy.Copied()
+	copiedBytes := func() uint64 {
+		if n := fastcopy.Copied() - startBytes + linkedBytes; n < totalBytes {
+			return n
+		}
+		return totalBytes
+	}
+	if events.Enabled() {
+		sizes = make([]int64, len(jobs))
+		for i, j := range jobs {
+			e := events.Event{
+				Type: events.ActionPlanned,
+				Src:  filepath.Join(srcdir, j.s.Path),
+				Dst:  filepath.Join(dstdir, j.d.Path),
+				Kind: string(plan.File),
+				Hash: base58.Encode(j.s.Hash),
+			}
+			if info, err := os.Lstat(e.Src); err == nil {
+				e.Size = info.Size()
+				if info.Mode().IsRegular() {
+					sizes[i] = info.Size()
+					totalBytes += uint64(sizes[i])
+				}
 			}
+			if j.conflict {
+				e.Original = filepath.Join(dstdir, j.o)
+			}
+			events.Emit(e)
 		}
 	}
-
 	if p != nil {
 		p.SetProgress(2, numfiles+4, fmt.Sprintf("Prepare copy: starting copy for %d files...", numfiles))
 	}
 
-	for _, s := range src.Entries {
-		// Cannot copy, skip
-		if !wantCopy(s, src, dst) {
-			continue
+	// Directories are created and cleaned up before files are copied in them,
+	// the copies themselves run in the pool when there are several jobs. mu
+	// protects errs, success, fatal, finished, the progress and the commit file.
+	var workers *pool.Pool
+	var mu gosync.Mutex
+	if opts.Jobs > 1 {
+		workers = pool.New(opts.Jobs, opts.PerSource, opts.PerDest)
+	}
+
+	// Conflicts are marked once the file they are a conflict of is copied, when
+	// it is copied as well
+	copying := map[string]chan struct{}{}
+
+	interrupted := false
+	copied := make([]bool, len(jobs))
+	dests := make([]commit.Entry, len(jobs))
+
+	// The placements of the files added to the commit are marked done in
+	// batches, once the commit file and their directories are flushed to disk
+	var finished []string
+	flush := func(ids []string) {
+		var ers []error
+		if err := c.Sync(); err != nil {
+			ers = []error{err}
+		} else {
+			ers = ops.Done(ids)
 		}
+		mu.Lock()
+		errs = append(errs, ers...)
+		mu.Unlock()
+	}
 
-		// Find destination file name
-		var d commit.Entry = commit.Entry(s)
-		_, conflict := dst.ByPath[s.Path]
-		if conflict {
-			d.Path = commit.FindConflictFileName(s, dst)
-			if d.Path == "" {
-				continue
+	// The bytes copied so far are reported while files are copied, along with
+	// the last file started
+	current := events.Event{Type: events.CopyProgress, TotalFiles: uint64(numfiles), TotalBytes: totalBytes}
+	stopProgress := make(chan struct{})
+	if sizes != nil {
+		go emitProgress(&mu, stopProgress, func() events.Event {
+			e := current
+			e.Files, e.Bytes = uint64(len(success)), copiedBytes()
+			return e
+		})
+	}
+
+	for i, j := range jobs {
+		s, d, o, conflict := j.s, j.d, j.o, j.conflict
+		dstpath := filepath.Join(dstdir, d.Path)
+
+		// Files linked to a file already copied are linked to its copy. Conflict
+		// files are not linked, they are marked as such.
+		var link *Link
+		first := false
+		if !conflict {
+			if info, err := os.Lstat(filepath.Join(srcdir, s.Path)); err == nil {
+				link, first = links.Register(info, dstpath)
 			}
 		}
 
-		srcpath := filepath.Join(srcdir, s.Path)
-		dstpath := filepath.Join(dstdir, d.Path)
+		if opts.Context != nil && opts.Context.Err() != nil {
+			interrupted = true
+			break
+		}
 
+		mu.Lock()
+		if fatal != nil {
+			mu.Unlock()
+			break
+		}
 		if p != nil {
 			p.SetProgress(len(success)+3, numfiles+4, "Copy "+d.Path)
 		}
+		current = events.Event{
+			Type:       events.CopyProgress,
+			Src:        filepath.Join(srcdir, s.Path),
+			Dst:        dstpath,
+			TotalFiles: uint64(numfiles),
+			TotalBytes: totalBytes,
+		}
+		mu.Unlock()
 
 		// Create parent dirs
-		err, ers := makeParentDirs(srcdir, dstdir, s.Path, okdirs)
+		err, ers := makeParentDirs(srcdir, dstdir, s.Path, d.Path, okdirs, dirtimes)
+		mu.Lock()
 		errs = append(errs, ers...)
+		if err != nil && fatal == nil {
+			fatal = err
+		}
+		mu.Unlock()
 		if err != nil {
-			return success, err, errs
+			break
 		}
 
-		// Copy file
-		err, ers = CopyFileNoReplace(srcpath, dstpath)
-		errs = append(errs, ers...)
-		if err != nil {
-			return success, err, errs
+		if dir := filepath.Dir(dstpath); stale != nil && !cleaned[dir] {
+			cleaned[dir] = true
+			_, err = cleanTempDir(dir, covered, stale, nil, false)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
 		}
 
-		// In case of conflicts, mark the file as a conflict
-		if conflict {
-			errs = append(errs, repo.MarkConflict(filepath.Join(dstdir, s.Path), dstpath)...)
+		run := func(i int, s, d commit.Entry, o string, conflict bool, link *Link, first bool) {
+			pl := Placement{Dst: filepath.Join(dstdir, d.Path), Src: filepath.Join(srcdir, s.Path), Hash: s.Hash, CommitDir: dstdir, Name: d.Original}
+			if conflict {
+				pl.Original = filepath.Join(dstdir, o)
+			}
+			id, err := ops.Begin(pl)
+			var ers []error
+			linked := err == nil && link != nil && !first && link.Link(pl.Dst)
+			if err == nil && !linked {
+				err, ers = copyFile(srcdir, dstdir, s, d, o, conflict, srcstore, dststore)
+			}
+			if first {
+				link.Done(err == nil)
+			}
+
+			// A failed copy may have placed the complete file, it is then rolled
+			// forward and committed by the recovery. Files copied are flushed to
+			// disk here, their directories and the commit file with the batch.
+			recovered := false
+			if err != nil && id != "" {
+				placed, rers := ops.Finish(id, false)
+				ers = append(ers, rers...)
+				if placed {
+					ers = append(ers, err)
+					err, recovered = nil, true
+				}
+				id = ""
+			} else if err == nil {
+				if e := ops.Sync(id); e != nil {
+					ers = append(ers, e)
+					id = ""
+				}
+			}
+			if err == nil {
+				d.Device, d.Inode = devIno(pl.Dst)
+			}
+
+			mu.Lock()
+			errs = append(errs, ers...)
+			if err != nil {
+				events.EmitError(pl.Dst, err)
+				if fatal == nil {
+					fatal = err
+				}
+				mu.Unlock()
+				return
+			}
+
+			// Add to commit file, the placement is marked done once it is flushed
+			if !recovered {
+				if err := c.Add(d); err != nil {
+					errs = append(errs, err)
+					id = ""
+				}
+			}
+			var batch []string
+			if id != "" {
+				if finished = append(finished, id); len(finished) >= syncBatch {
+					batch, finished = finished, nil
+				}
+			}
+
+			success = append(success, d)
+			copied[i] = true
+			dests[i] = d
+
+			if sizes != nil {
+				if linked {
+					linkedBytes += uint64(sizes[i])
+				}
+				events.Emit(events.Event{
+					Type:       events.CopyProgress,
+					Src:        filepath.Join(srcdir, s.Path),
+					Dst:        pl.Dst,
+					Files:      uint64(len(success)),
+					TotalFiles: uint64(numfiles),
+					Bytes:      copiedBytes(),
+					TotalBytes: totalBytes,
+				})
+			}
+			mu.Unlock()
+
+			if batch != nil {
+				flush(batch)
+			}
 		}
 
-		// Add to commit file
-		err = c.Add(d)
-		if err != nil {
-			errs = append(errs, err)
+		if workers != nil {
+			var wait <-chan struct{}
+			if link != nil && !first {
+				wait = link.Wait()
+			}
+			var done chan struct{}
+			if conflict {
+				wait = pool.Both(wait, copying[o])
+			} else {
+				done = make(chan struct{})
+				copying[d.Path] = done
+			}
+			i, s, d, o, conflict, link, first := i, s, d, o, conflict, link, first
+			workers.Go(filepath.Join(srcdir, s.Path), dstpath, wait, func() {
+				run(i, s, d, o, conflict, link, first)
+				if done != nil {
+					close(done)
+				}
+			})
+		} else {
+			run(i, s, d, o, conflict, link, first)
+		}
+	}
+
+	if workers != nil {
+		workers.Wait()
+	}
+	close(stopProgress)
+	flush(finished)
+	if interrupted && fatal == nil {
+		fatal = &Interrupted{len(success), numfiles - len(success)}
+	}
+
+	// Directory times are set once their content is written
+	errs = append(errs, dirtimes.Apply()...)
+
+	if workers != nil {
+		// Keep the source order, whatever the order the copies completed in
+		success = success[:0]
+		for i, ok := range copied {
+			if ok {
+				success = append(success, dests[i])
+			}
+		}
+	}
+	return success, fatal, errs
+}
+
+// Emit the event returned by progress every events.ProgressInterval until stop
+// is closed. progress is called with mu locked.
+func emitProgress(mu *gosync.Mutex, stop <-chan struct{}, progress func() events.Event) {
+	ticker := time.NewTicker(events.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			mu.Lock()
+			e := progress()
+			mu.Unlock()
+			events.Emit(e)
 		}
+	}
+}
 
-		success = append(success, d)
+// Tell when err comes from a name the destination filesystem does not accept
+// and SafeNames would rewrite
+func nameError(path string, err error) error {
+	name := filepath.Base(path)
+	if fold.SafeName(name) != name && (attrs.IsErrno(err, syscall.EINVAL) || attrs.IsErrno(err, syscall.ENAMETOOLONG)) {
+		return fmt.Errorf("%s: the destination does not accept this name, safe names would rewrite it: %s", path, err.Error())
 	}
-	return success, nil, errs
+	return err
+}
+
+// Copy the source entry s to the destination entry d. When conflict is true, d
+// is a conflict file name for the destination path o and is marked as such.
+// First error is fatal.
+func copyFile(srcdir, dstdir string, s, d commit.Entry, o string, conflict bool, srcstore, dststore *repo.ObjectStore) (error, []error) {
+	var errs []error
+	srcpath := filepath.Join(srcdir, s.Path)
+	dstpath := filepath.Join(dstdir, d.Path)
+
+	throttle.File()
+
+	// Copy file
+	err, ers := copyEntry(srcpath, dstpath, s.Hash, srcstore, dststore)
+	errs = append(errs, ers...)
+	if err != nil {
+		return nameError(dstpath, err), errs
+	}
+
+	// In case of conflicts, mark the file as a conflict
+	if conflict {
+		orig := filepath.Join(dstdir, o)
+		errs = append(errs, repo.MarkConflict(orig, dstpath, s.Hash)...)
+		events.Emit(events.Event{Type: events.ConflictCreated, Path: dstpath, Original: orig})
+	}
+
+	return nil, errs
 }
@@ -3,17 +3,16 @@ package copy
 import (
 	"os"
 	"path/filepath"
-	"syscall"
-	"time"
+	"strings"
 
-	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/meta"
 )
 
-// Creates a directory dst from the information found in src
+// Creates a directory dst from the information found in src. If times is not
+// nil, the directory timestamps are added to it to be set once the directory
+// content is written.
 // First error is fatal, other errors are issues replicating attributes
-func MkdirFrom(src, dst string) (error, []error) {
-	var errs []error
-
+func MkdirFrom(src, dst string, times *meta.DirTimes) (error, []error) {
 	src_st, err := os.Stat(src)
 	if err != nil {
 		return err, nil
@@ -24,38 +23,22 @@ func MkdirFrom(src, dst string) (error, []error) {
 		return err, nil
 	}
 
-	if stat, ok := src_st.Sys().(*syscall.Stat_t); ok {
-		err = os.Lchown(dst, int(stat.Uid), int(stat.Gid))
-		if err != nil {
-			errs = append(errs, err)
-		}
-
-		atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
-		err = os.Chtimes(dst, atime, src_st.ModTime())
-		if err != nil {
-			errs = append(errs, err)
-		}
-	}
-
-	xattr, values, err := attrs.GetList(src)
-	if err != nil {
-		errs = append(errs, err)
-	}
-
-	for i, attrname := range xattr {
-		err = attrs.Set(src, attrname, values[i])
-		if err != nil {
-			errs = append(errs, err)
-		}
+	if times == nil {
+		return nil, meta.Copy(src, src_st, dst)
 	}
 
-	return nil, errs
+	atime, mtime := meta.Times(src_st)
+	times.Add(dst, atime, mtime)
+	return nil, meta.CopyNoTimes(src, src_st, dst)
 }
 
-func makeParentDirs(srcdir, dstdir, path string, okdirs map[string]bool) (error, []error) {
+// Create the parent directories of the destination path dstpath from those of
+// the source path srcpath. They have as many components, but the destination
+// may spell them differently.
+func makeParentDirs(srcdir, dstdir, srcpath, dstpath string, okdirs map[string]bool, times *meta.DirTimes) (error, []error) {
 	var errs []error
-	for _, dir := range parentDirs(path, okdirs) {
-		err, ers := MkdirFrom(filepath.Join(srcdir, dir), filepath.Join(dstdir, dir))
+	for _, dir := range parentDirs(dstpath, okdirs) {
+		err, ers := MkdirFrom(filepath.Join(srcdir, sourceDir(srcpath, dir)), filepath.Join(dstdir, dir), times)
 		errs = append(errs, ers...)
 		if err != nil {
 			return err, errs
@@ -65,6 +48,18 @@ func makeParentDirs(srcdir, dstdir, path string, okdirs map[string]bool) (error,
 	return nil, errs
 }
 
+// Return the parent directory of the source path srcpath at the depth of the
+// destination directory dir
+func sourceDir(srcpath, dir string) string {
+	sep := string(filepath.Separator)
+	parts := strings.Split(srcpath, sep)
+	n := strings.Count(dir, sep) + 1
+	if n >= len(parts) {
+		return filepath.Dir(srcpath)
+	}
+	return strings.Join(parts[:n], sep)
+}
+
 func parentDirs(path string, ok map[string]bool) []string {
 	var res []string
 	var breadcrumb []string
@@ -2,14 +2,11 @@ package copy
 
 import (
 	"errors"
-	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
-	"syscall"
-	"time"
 
-	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/fastcopy"
+	"github.com/mildred/doc/meta"
 )
 
 var ErrorExists = errors.New("File already exists")
@@ -20,6 +17,15 @@ func CopyFileNoReplace(src, dst string) (error, []error) {
 		return err, errs
 	}
 
+	err, ers := RenameNoReplace(fname, dst)
+	return err, append(errs, ers...)
+}
+
+// Rename the temporary file fname to dst unless dst already exists. In any
+// case of failure, the temporary file is removed.
+func RenameNoReplace(fname, dst string) (error, []error) {
+	var errs []error
+
 	if _, err := os.Lstat(dst); err == nil || !os.IsNotExist(err) {
 		if e := os.Remove(fname); e != nil {
 			errs = append(errs, e)
@@ -30,7 +36,7 @@ func CopyFileNoReplace(src, dst string) (error, []error) {
 		return err, errs
 	}
 
-	err = os.Rename(fname, dst)
+	err := os.Rename(fname, dst)
 	if err != nil {
 		if e := os.Remove(fname); e != nil {
 			errs = append(errs, e)
@@ -41,7 +47,7 @@ func CopyFileNoReplace(src, dst string) (error, []error) {
 }
 
 func CopyFileTemp(src, dst string) (string, error, []error) {
-	var errs []error
+	var fname string
 
 	src_st, err := os.Lstat(src)
 	if err != nil {
@@ -49,18 +55,12 @@ func CopyFileTemp(src, dst string) (string, error, []error) {
 	}
 	symlink := src_st.Mode()&os.ModeSymlink != 0
 
-	src_f, err := os.Open(src)
-	if err != nil {
-		return "", err, nil
-	}
-
-	f, err := ioutil.TempFile(filepath.Dir(dst), "temp")
-	if err != nil {
-		return "", err, nil
-	}
-	fname := f.Name()
-
 	if symlink {
+		f, err := tempFile(filepath.Dir(dst))
+		if err != nil {
+			return "", err, nil
+		}
+		fname = f.Name()
 		f.Close()
 		err = os.Remove(fname)
 		if err != nil {
@@ -77,55 +77,22 @@ func CopyFileTemp(src, dst string) (string, error, []error) {
 			return "", err, nil
 		}
 	} else {
-		defer f.Close()
-		_, err = io.Copy(f, src_f)
+		fname, err = copyRegularTemp(src, src_st, dst)
 		if err != nil {
-			if e := os.Remove(fname); e != nil {
-				errs = append(errs, e)
-			}
-			return "", err, errs
-		}
-	}
-
-	if stat, ok := src_st.Sys().(*syscall.Stat_t); ok {
-
-		err = os.Lchown(fname, int(stat.Uid), int(stat.Gid))
-		if err != nil {
-			errs = append(errs, err)
-		}
-
-		if !symlink {
-
-			atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
-			err = os.Chtimes(fname, atime, src_st.ModTime())
-			if err != nil {
-				errs = append(errs, err)
-			}
+			return "", err, nil
 		}
 	}
 
-	if !symlink {
-
-		err = os.Chmod(fname, src_st.Mode())
-		if err != nil {
-			errs = append(errs, err)
-		}
-
-		// FIXME: extended attributes for symlinks
-		// golang is missing some syscalls
+	return fname, nil, meta.ForPath(meta.Copy(src, src_st, fname), dst)
+}
 
-		xattr, values, err := attrs.GetList(src)
-		if err != nil {
-			errs = append(errs, err)
-		} else {
-			for i, attrname := range xattr {
-				err = attrs.Set(fname, attrname, values[i])
-				if err != nil {
-					errs = append(errs, err)
-				}
-			}
-		}
+func copyContent(f *os.File, src string, off int64) error {
+	src_f, err := os.Open(src)
+	if err != nil {
+		return err
 	}
+	defer src_f.Close()
 
-	return fname, err, errs
+	_, err = fastcopy.Copy(f, src_f, off)
+	return err
 }
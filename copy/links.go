@@ -0,0 +1,80 @@
+package copy
+
+import (
+	"os"
+	gosync "sync"
+	"syscall"
+
+	"github.com/mildred/doc/commit"
+)
+
+// Links tracks the hard link groups of the source files being copied, so they
+// can be recreated at the destination instead of copying each link.
+type Links struct {
+	mu     gosync.Mutex
+	groups map[string]*Link
+}
+
+// First copy of a hard link group
+type Link struct {
+	// Destination of the first copy
+	Dst  string
+	done chan struct{}
+	ok   bool
+}
+
+// Register dst as the copy of the source file described by info. If a file of
+// the same group was registered before, its Link is returned with false and dst
+// should be linked to it. Otherwise, if the source has several links, a new Link
+// is returned with true and Done must be called once dst is copied.
+func (l *Links) Register(info os.FileInfo, dst string) (*Link, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || !info.Mode().IsRegular() || st.Nlink <= 1 {
+		return nil, false
+	}
+	key := commit.DeviceInodeString(uint64(st.Dev), uint64(st.Ino))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.groups == nil {
+		l.groups = map[string]*Link{}
+	}
+	if first, ok := l.groups[key]; ok {
+		return first, false
+	}
+	first := &Link{Dst: dst, done: make(chan struct{})}
+	l.groups[key] = first
+	return first, true
+}
+
+// Record the result of the first copy and release the links waiting for it
+func (k *Link) Done(ok bool) {
+	k.ok = ok
+	close(k.done)
+}
+
+// Closed once the first copy is done
+func (k *Link) Wait() <-chan struct{} {
+	return k.done
+}
+
+// Wait for the first copy and create dst as a hard link to it. Return false if
+// the first copy failed or the link cannot be created (across devices, or with
+// too many links), dst must then be copied instead.
+func (k *Link) Link(dst string) bool {
+	<-k.done
+	return k.ok && os.Link(k.Dst, dst) == nil
+}
+
+// Return the device and inode of path, recorded in .doccommit to keep track of
+// hard links
+func devIno(path string) (uint64, uint64) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0, 0
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino)
+	}
+	return 0, 0
+}
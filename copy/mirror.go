@@ -0,0 +1,226 @@
+package copy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/ignore"
+	"github.com/mildred/doc/journal"
+	"github.com/mildred/doc/repo"
+)
+
+// Move to the trash the committed files of dstdir that are not in the source
+// commit, or that differ from it and would be copied as conflicts. Their
+// entries are dropped from dst, which is written. The files not committed are
+// moved to the trash as well, unless they are ignored by the .docignore files
+// and opts.NoDocIgnore is false. First error is fatal.
+func mirrorTrash(dstdir string, src, dst *commit.Commit, opts Options) (error, []error) {
+	t := repo.GetTrash(dstdir)
+	if t == nil {
+		return fmt.Errorf("%s: no %s to keep the trash in, run doc init", dstdir, attrs.DirStoreName), nil
+	}
+	j := operationJournal(dstdir)
+	batch := t.NewBatch(time.Now())
+
+	var errs []error
+	var ids []string
+	var dirs []string
+	dropped := false
+
+	// Move path to the trash, return false if it failed
+	move := func(path string) (bool, error) {
+		id, err := j.Begin("trash", map[string]string{
+			"src":    absPath(path),
+			"trash":  t.File(batch, mustRel(t.Root(), path)),
+			"commit": absPath(dstdir),
+		})
+		if err != nil {
+			return false, err
+		}
+
+		trashed, err := t.Move(batch, path)
+		if err != nil {
+			errs = append(errs, err)
+			j.Done(id)
+			return false, nil
+		}
+		errs = append(errs, unmarkTrashed(path, trashed)...)
+		ids = append(ids, id)
+		dirs = append(dirs, filepath.Dir(path))
+		return true, nil
+	}
+
+	uncommitted, ers := uncommittedFiles(dstdir, dst, opts)
+	errs = append(errs, ers...)
+	for _, path := range uncommitted {
+		if _, err := move(path); err != nil {
+			return err, errs
+		}
+	}
+
+	for i, d := range dst.Entries {
+		if d.Drop || strings.HasPrefix(d.Path, "../") {
+			continue
+		}
+
+		si, inSource := src.ByName[d.Name()]
+		if strings.HasSuffix(d.Path, "/") {
+			if !inSource {
+				dst.Entries[i].DropEntry()
+				dropped = true
+			}
+			continue
+		} else if inSource && (bytes.Equal(src.Entries[si].Hash, d.Hash) || !canCopy(src.Entries[si], src, dst)) {
+			continue
+		}
+
+		path := filepath.Join(dstdir, d.Path)
+		if _, err := os.Lstat(path); os.IsNotExist(err) {
+			// Already removed, only the entry is dropped
+			dst.Entries[i].DropEntry()
+			dropped = true
+			continue
+		}
+
+		if moved, err := move(path); err != nil {
+			return err, errs
+		} else if moved {
+			dst.Entries[i].DropEntry()
+			dropped = true
+		}
+	}
+
+	if dropped {
+		if err := dst.Write(); err != nil {
+			return err, errs
+		}
+	}
+	for _, id := range ids {
+		if err := j.Done(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	// Remove the directories left empty, the copy creates those it needs
+	root := absPath(dstdir)
+	for _, dir := range dirs {
+		for dir = absPath(dir); dir != root && strings.HasPrefix(dir, root+"/"); dir = filepath.Dir(dir) {
+			if os.Remove(dir) != nil {
+				break
+			}
+		}
+	}
+	return nil, errs
+}
+
+// Return the regular files of dstdir that are not in its commit dst, except
+// the temporary files and, unless opts.NoDocIgnore is true, the files ignored
+// by the .docignore files
+func uncommittedFiles(dstdir string, dst *commit.Commit, opts Options) ([]string, []error) {
+	var res []string
+	var errs []error
+	ignores := ignore.New()
+	dstdir = filepath.Clean(dstdir)
+	filepath.Walk(dstdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+
+		if !opts.NoDocIgnore && ignores.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// Skip .dirstore/ at root, other repositories, .doccommit and the files
+		// being copied
+		if info.IsDir() && info.Name() == attrs.DirStoreName && filepath.Dir(path) == dstdir {
+			return filepath.SkipDir
+		} else if info.IsDir() && path != dstdir {
+			if _, err := os.Lstat(filepath.Join(path, attrs.DirStoreName)); err == nil {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if !info.Mode().IsRegular() || info.Name() == commit.Doccommit || isTempName(info.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dstdir, path)
+		if err != nil {
+			errs = append(errs, err)
+		} else if i, ok := dst.ByPath[rel]; !ok || dst.Entries[i].Drop {
+			res = append(res, path)
+		}
+		return nil
+	})
+	return res, errs
+}
+
+// Return path relative to root, path itself if it is not possible
+func mustRel(root, path string) string {
+	if rel, err := filepath.Rel(root, absPath(path)); err == nil {
+		return rel
+	}
+	return path
+}
+
+// Remove the trashed file, now at trashed, from the alternatives of the file it
+// was in conflict with
+func unmarkTrashed(path, trashed string) []error {
+	conflict := repo.ConflictFile(trashed)
+	if conflict == "" {
+		return nil
+	}
+	original := filepath.Join(filepath.Dir(path), conflict)
+	if info, err := os.Lstat(original); err != nil || info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	err := repo.RemoveConflictAlternative(original, filepath.Base(path))
+	if err != nil {
+		return []error{fmt.Errorf("%s: could not remove conflict alternative: %s", original, err.Error())}
+	}
+	return nil
+}
+
+// Complete the move of a file to the trash: once it is in the trash, its
+// commit entry is dropped. The move itself is atomic.
+func recoverTrash(j *journal.Journal, rec journal.Record, dry bool) (Recovery, []error) {
+	src, trashed, dir := rec.Args["src"], rec.Args["trash"], rec.Args["commit"]
+	r := Recovery{Path: src}
+	_, err := os.Lstat(trashed)
+	r.Forward = err == nil
+	if dry {
+		return r, nil
+	}
+
+	var errs []error
+	if r.Forward {
+		errs = unmarkTrashed(src, trashed)
+		c, err := commit.ReadCommit(dir)
+		if err != nil {
+			return r, append(errs, err)
+		}
+		rel, err := filepath.Rel(dir, src)
+		if err != nil {
+			return r, append(errs, err)
+		}
+		if i, ok := c.ByPath[rel]; ok {
+			c.Entries[i].DropEntry()
+			if err := c.Write(); err != nil {
+				return r, append(errs, err)
+			}
+		}
+	}
+	if err := j.Done(rec.Id); err != nil {
+		errs = append(errs, err)
+	}
+	return r, errs
+}
@@ -0,0 +1,33 @@
+package copy
+
+import (
+	"os"
+
+	"github.com/mildred/doc/meta"
+	"github.com/mildred/doc/repo"
+)
+
+// Copy the file srcpath with the given digest to dstpath. The content is taken
+// from the destination object store if it is already there, with the metadata
+// of the source file if it exists, or from the source object store if the
+// source file is not checked out.
+func copyEntry(srcpath, dstpath string, digest []byte, srcstore, dststore *repo.ObjectStore) (error, []error) {
+	info, srcerr := os.Lstat(srcpath)
+
+	if dststore != nil && dststore.Has(digest) && (srcerr != nil || info.Mode().IsRegular()) {
+		if fname, err := dststore.CheckoutTemp(digest, dstpath); err == nil {
+			var errs []error
+			if srcerr == nil {
+				errs = meta.ForPath(meta.Copy(srcpath, info, fname), dstpath)
+			}
+			err, ers := RenameNoReplace(fname, dstpath)
+			return err, append(errs, ers...)
+		}
+	}
+
+	if os.IsNotExist(srcerr) && srcstore != nil && srcstore.Has(digest) {
+		return srcstore.Checkout(digest, dstpath, false), nil
+	}
+
+	return CopyFileNoReplace(srcpath, dstpath)
+}
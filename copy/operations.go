@@ -0,0 +1,430 @@
+package copy
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	gosync "sync"
+
+	base58 "github.com/jbenet/go-base58"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/journal"
+	"github.com/mildred/doc/repo"
+)
+
+// Name of the journal in .dirstore recording the files being placed in the
+// tree, with their conflict marks and commit entries, and the files being
+// moved to the trash or aside
+const OperationJournal = "operations"
+
+// A file placed in the tree: Dst is created from Src with Hash, as a conflict
+// alternative of Original when it is not empty. When CommitDir is not empty,
+// Dst is added to its commit, under the name Name when Dst was rewritten for
+// the filesystem. Hash can be empty if the source was not hashed.
+type Placement struct {
+	Dst       string
+	Src       string
+	Hash      []byte
+	Original  string
+	CommitDir string
+	Name      string
+}
+
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func (pl Placement) args() map[string]string {
+	args := map[string]string{
+		"dst":  absPath(pl.Dst),
+		"hash": base58.Encode(pl.Hash),
+	}
+	if pl.Src != "" {
+		args["src"] = absPath(pl.Src)
+	}
+	if pl.Original != "" {
+		args["original"] = absPath(pl.Original)
+	}
+	if pl.CommitDir != "" {
+		args["commit"] = absPath(pl.CommitDir)
+	}
+	if pl.Name != "" {
+		args["name"] = pl.Name
+	}
+	return args
+}
+
+func placementOf(rec journal.Record) Placement {
+	return Placement{
+		Dst:       rec.Args["dst"],
+		Src:       rec.Args["src"],
+		Hash:      base58.Decode(rec.Args["hash"]),
+		Original:  rec.Args["original"],
+		CommitDir: rec.Args["commit"],
+		Name:      rec.Args["name"],
+	}
+}
+
+// Operations records in the journal the files placed in a tree. A nil
+// *Operations records nothing.
+type Operations struct {
+	j          *journal.Journal
+	mu         gosync.Mutex
+	placements map[string]Placement
+	asides     map[string]journal.Record
+
+	// Lock on the transfers journal, held as long as the operations
+	transfers *Transfers
+}
+
+// Return the journal of the repository containing dir or, if dir does not
+// exist yet, its closest existing parent
+func operationJournal(dir string) *journal.Journal {
+	dir = absPath(dir)
+	for {
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			return journal.ForDir(dir, OperationJournal)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Return the operations journal of the repository containing dir, nil if there
+// is no dirstore. The journal and the transfers journal are locked until
+// Close. The operations left incomplete by processes that stopped are completed
+// or undone first, as Recover does, unless another process is placing files in
+// the repository.
+func OpenOperations(dir string) (*Operations, []error) {
+	j := operationJournal(dir)
+	if j == nil {
+		return nil, nil
+	}
+	recover, err := j.Lock()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errs []error
+	if recover {
+		_, errs = recoverPending(j, false)
+		if err := j.Share(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	transfers, err := LockTransfers(dir)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return &Operations{j: j, placements: map[string]Placement{}, asides: map[string]journal.Record{}, transfers: transfers}, errs
+}
+
+// Record the placement before it starts and return the record id. Nothing is
+// recorded if the destination already exists: the placement will fail and the
+// existing file must not be removed when rolling back.
+func (o *Operations) Begin(pl Placement) (string, error) {
+	if o == nil {
+		return "", nil
+	} else if _, err := os.Lstat(pl.Dst); err == nil {
+		return "", nil
+	}
+	id, err := o.j.Begin("place", pl.args())
+	if err == nil {
+		o.mu.Lock()
+		o.placements[id] = pl
+		o.mu.Unlock()
+	}
+	return id, err
+}
+
+// Record the end of the placement id, ok is false if it failed. A placement
+// done is flushed to disk before it is marked done in the journal. A placement
+// that failed is rolled forward or back at once: return true if the file is in
+// place, either because ok is true or because it was complete after all.
+func (o *Operations) Finish(id string, ok bool) (bool, []error) {
+	if o == nil || id == "" {
+		return ok, nil
+	}
+
+	if !ok {
+		o.mu.Lock()
+		pl := o.placements[id]
+		delete(o.placements, id)
+		o.mu.Unlock()
+		r, errs := recoverPlacement(o.j, id, pl, false)
+		return r.Forward && len(errs) == 0, errs
+	}
+
+	if err := o.Sync(id); err != nil {
+		return true, []error{err}
+	}
+	return true, o.Done([]string{id})
+}
+
+// Flush to disk the file placed by id and the original file it is a conflict
+// of. Its directory is flushed by Done, once for all the files placed there.
+func (o *Operations) Sync(id string) error {
+	if o == nil || id == "" {
+		return nil
+	}
+	o.mu.Lock()
+	pl := o.placements[id]
+	o.mu.Unlock()
+
+	paths := []string{pl.Dst}
+	if pl.Original != "" {
+		paths = append(paths, pl.Original)
+	}
+	for _, path := range paths {
+		if err := syncPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Mark done the placements ids, flushed by Sync. Their directories are flushed
+// to disk first, along with the conflict records, so that the journal does not
+// forget about them too early. The commit they are added to must be flushed
+// before.
+func (o *Operations) Done(ids []string) []error {
+	if o == nil || len(ids) == 0 {
+		return nil
+	}
+	o.mu.Lock()
+	pls := make([]Placement, len(ids))
+	for i, id := range ids {
+		pls[i] = o.placements[id]
+		delete(o.placements, id)
+	}
+	o.mu.Unlock()
+
+	var errs []error
+	failed := map[string]bool{}
+	synced := map[string]bool{}
+	for _, pl := range pls {
+		dir := filepath.Dir(pl.Dst)
+		if synced[dir] {
+			continue
+		}
+		synced[dir] = true
+		if err := syncPath(dir); err != nil {
+			errs = append(errs, err)
+			failed[dir] = true
+		}
+	}
+
+	for i, pl := range pls {
+		if failed[filepath.Dir(pl.Dst)] {
+			continue
+		}
+		if err := recordConflict(pl); err != nil {
+			errs = append(errs, err)
+		} else if err := o.j.Done(ids[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Flush to disk the file or directory path, symlinks are skipped
+func syncPath(path string) error {
+	if info, err := os.Lstat(path); err != nil {
+		return err
+	} else if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Release the lock on the journal
+func (o *Operations) Close() {
+	if o != nil {
+		o.transfers.Unlock()
+		o.j.Unlock()
+	}
+}
+
+// An incomplete operation found in the journal
+type Recovery struct {
+	Path string
+
+	// True if the operation was completed, false if it was undone
+	Forward bool
+}
+
+// Complete or undo the operations left incomplete in the journal of the
+// repository containing dir. Complete files are kept, marked as conflicts and
+// committed as planned, others are removed and their conflict marks are
+// removed. Files moved to the trash are dropped from the commit. If dry is
+// true, nothing is changed. Nothing is done while another process is placing
+// files in the repository.
+func Recover(dir string, dry bool) ([]Recovery, []error) {
+	j := operationJournal(dir)
+	if j == nil {
+		return nil, nil
+	}
+	recover, err := j.Lock()
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer j.Unlock()
+	if !recover {
+		return nil, []error{fmt.Errorf("%s: files are being placed by another process, try again once it is done", dir)}
+	}
+	return recoverPending(j, dry)
+}
+
+// Complete or undo the operations pending in j, locked exclusively
+func recoverPending(j *journal.Journal, dry bool) ([]Recovery, []error) {
+	recs, err := j.Pending()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var res []Recovery
+	var errs []error
+	for _, rec := range recs {
+		var r Recovery
+		var ers []error
+		switch rec.Op {
+		case "place":
+			r, ers = recoverPlacement(j, rec.Id, placementOf(rec), dry)
+		case "trash":
+			r, ers = recoverTrash(j, rec, dry)
+		case "aside":
+			r, ers = recoverAside(j, rec, dry)
+		default:
+			continue
+		}
+		res = append(res, r)
+		errs = append(errs, ers...)
+	}
+	return res, errs
+}
+
+// Roll forward the placement id if its file is complete, roll it back
+// otherwise. Without a hash, the file is complete if it has the content of its
+// source.
+func recoverPlacement(j *journal.Journal, id string, pl Placement, dry bool) (Recovery, []error) {
+	r := Recovery{Path: pl.Dst}
+
+	info, err := os.Lstat(pl.Dst)
+	if err == nil && len(pl.Hash) == 0 && pl.Src != "" {
+		if srcinfo, err := os.Lstat(pl.Src); err == nil && srcinfo.Size() == info.Size() {
+			pl.Hash, err = repo.HashFile(pl.Src, srcinfo)
+			if err != nil {
+				return r, []error{err}
+			}
+		}
+	}
+	if err == nil && len(pl.Hash) > 0 {
+		hash, err := repo.HashFile(pl.Dst, info)
+		if err != nil {
+			return r, []error{err}
+		}
+		r.Forward = bytes.Equal(hash, pl.Hash)
+	}
+	if dry {
+		return r, nil
+	}
+
+	var errs []error
+	if r.Forward {
+		errs = rollForward(pl, info)
+	} else {
+		errs = rollBack(pl)
+	}
+	if len(errs) == 0 {
+		if err := j.Done(id); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return r, errs
+}
+
+// Record the conflict created by pl, so that it is not created again once it is
+// dismissed
+func recordConflict(pl Placement) error {
+	if pl.Original == "" {
+		return nil
+	}
+	err := repo.RecordConflict(pl.Original, pl.Hash)
+	if err != nil {
+		return fmt.Errorf("%s: could not record conflict: %s", pl.Dst, err.Error())
+	}
+	return nil
+}
+
+// Mark and record the conflict, the hash and commit the complete file described
+// by pl
+func rollForward(pl Placement, info os.FileInfo) []error {
+	var errs []error
+	symlink := info.Mode()&os.ModeSymlink != 0
+
+	if _, err := os.Lstat(pl.Original); pl.Original != "" && err == nil {
+		errs = append(errs, repo.MarkConflict(pl.Original, pl.Dst, pl.Hash)...)
+		if err := recordConflict(pl); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if !symlink {
+		if _, err := repo.CommitFileHash(pl.Dst, info, pl.Hash, false); err != nil {
+			errs = append(errs, fmt.Errorf("%s: could not commit: %s", pl.Dst, err.Error()))
+		}
+	}
+
+	if pl.CommitDir != "" {
+		c, err := commit.ReadCommit(pl.CommitDir)
+		if err != nil {
+			return append(errs, err)
+		}
+		rel, err := filepath.Rel(pl.CommitDir, pl.Dst)
+		if err != nil {
+			return append(errs, err)
+		}
+		if i, ok := c.ByPath[rel]; !ok || !bytes.Equal(c.Entries[i].Hash, pl.Hash) {
+			e := commit.Entry{Hash: pl.Hash, Path: rel, Original: pl.Name}
+			e.Device, e.Inode = devIno(pl.Dst)
+			if err := commit.WriteDirAppend(pl.CommitDir, []commit.Entry{e}); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// Remove the incomplete file described by pl, its conflict mark and record
+func rollBack(pl Placement) []error {
+	var errs []error
+	if err := os.Remove(pl.Dst); err != nil && !os.IsNotExist(err) {
+		errs = append(errs, err)
+	}
+
+	if pl.Original != "" {
+		info, err := os.Lstat(pl.Original)
+		if err == nil && info.Mode()&os.ModeSymlink == 0 {
+			err = repo.RemoveConflictAlternative(pl.Original, filepath.Base(pl.Dst))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: could not remove conflict alternative: %s", pl.Original, err.Error()))
+			}
+		}
+		if err := repo.ForgetConflict(pl.Original, pl.Hash); err != nil {
+			errs = append(errs, fmt.Errorf("%s: could not remove conflict record: %s", pl.Original, err.Error()))
+		}
+	}
+	return errs
+}
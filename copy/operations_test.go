@@ -0,0 +1,116 @@
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mildred/doc/attrs"
+)
+
+func TestOperationsDone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, attrs.DirStoreName), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, errs := OpenOperations(dir)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	defer ops.Close()
+
+	var ids []string
+	for _, name := range []string{"a", "sub/b", "sub/c", "missing"} {
+		id, err := ops.Begin(Placement{Dst: filepath.Join(dir, name)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, name := range []string{"a", "sub/b", "sub/c"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flushed one by one, marked done together
+	for _, id := range ids[:3] {
+		if err := ops.Sync(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if errs := ops.Done(ids[:3]); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if recs, err := ops.j.Pending(); err != nil || len(recs) != 1 || recs[0].Id != ids[3] {
+		t.Errorf("pending %v, %v, want %s", recs, err, ids[3])
+	}
+
+	// Without a hash, a file that is not there is not complete
+	if placed, errs := ops.Finish(ids[3], false); placed || len(errs) > 0 {
+		t.Errorf("finish %v, %v", placed, errs)
+	}
+	if recs, err := ops.j.Pending(); err != nil || len(recs) != 0 {
+		t.Errorf("pending %v, %v", recs, err)
+	}
+}
+
+func TestFinishAside(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, attrs.DirStoreName), 0777); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "d")
+	if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	ops, errs := OpenOperations(dir)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	defer ops.Close()
+
+	// The file is not moved, there is nothing to complete
+	id, err := ops.BeginAside(path, path+".1", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved, errs := ops.FinishAside(id, false); moved || len(errs) > 0 {
+		t.Errorf("failed move finished %v, %v", moved, errs)
+	}
+
+	// Moved and replaced by a directory
+	if id, err = ops.BeginAside(path, path+".1", dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	} else if err := os.Mkdir(path, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if moved, errs := ops.FinishAside(id, true); !moved || len(errs) > 0 {
+		t.Errorf("move finished %v, %v", moved, errs)
+	}
+	if recs, err := ops.j.Pending(); err != nil || len(recs) != 0 {
+		t.Errorf("pending %v, %v", recs, err)
+	}
+
+	// Nothing is recorded when the name is taken
+	if id, err := ops.BeginAside(path, path+".1", dir, nil); id != "" || err != nil {
+		t.Errorf("recorded %q, %v", id, err)
+	}
+}
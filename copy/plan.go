@@ -0,0 +1,205 @@
+package copy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/fold"
+	"github.com/mildred/doc/plan"
+	"github.com/mildred/doc/repo"
+)
+
+// Return the plan of the files Copy would copy from srcdir to dstdir. command
+// is the command that can apply the plan. Other errors are warnings.
+func PlanCopy(command, srcdir, dstdir string, opts Options) (*plan.Plan, error, []error) {
+	src, err := commit.ReadCommit(srcdir)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	dst, err := commit.ReadCommit(dstdir)
+	if err != nil {
+		return nil, err, nil
+	}
+
+	// Nothing is written to the destination until the plan is applied
+	var errs []error
+	fs, err := fold.Probe(dstdir, true)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	pl := &plan.Plan{Command: command, Source: plan.Abs(srcdir), Dest: plan.Abs(dstdir)}
+	for _, j := range planTree(srcdir, dstdir, src, dst, fs, opts) {
+		a := plan.Action{
+			Kind:     plan.File,
+			Conflict: j.conflict,
+			Hash:     j.s.Hash,
+			Src:      filepath.Join(pl.Source, j.s.Path),
+			Dst:      filepath.Join(pl.Dest, j.d.Path),
+		}
+		if info, err := os.Lstat(a.Src); err == nil {
+			a.Size = info.Size()
+		}
+		if j.conflict {
+			a.Original = filepath.Join(pl.Dest, j.o)
+			if i, ok := dst.ByPath[j.o]; ok {
+				a.OriginalHash = dst.Entries[i].Hash
+			}
+		}
+		pl.Actions = append(pl.Actions, a)
+	}
+	return pl, nil, errs
+}
+
+// Copy the files of a plan made by PlanCopy. Nothing is copied if a source or
+// a destination changed since the plan was made, the changes are returned as
+// the other errors.
+func ApplyPlan(pl *plan.Plan, p Progress, opts Options) (error, []error) {
+	events.Emit(events.Event{Type: events.ScanStarted, Src: pl.Source, Dst: pl.Dest})
+	copied, err, errs := applyPlan(pl, p, opts)
+	emitFinished(pl.Source, pl.Dest, copied, err, errs)
+	return err, errs
+}
+
+// Apply the plan, return the number of files copied
+func applyPlan(pl *plan.Plan, p Progress, opts Options) (int, error, []error) {
+	srcdir, dstdir := pl.Source, pl.Dest
+
+	src, err := commit.ReadCommit(srcdir)
+	if err != nil {
+		return 0, err, nil
+	}
+
+	os.MkdirAll(dstdir, 0777)
+
+	// Each file is journaled until it is copied, marked and committed.
+	// Operations interrupted last time are completed or undone first.
+	ops, warnings := OpenOperations(dstdir)
+	defer ops.Close()
+
+	dst, err := commit.ReadCommit(dstdir)
+	if err != nil {
+		return 0, err, warnings
+	}
+
+	if p != nil {
+		p.SetProgress(2, 4, "Check plan")
+	}
+
+	var jobs []job
+	var errs []error
+	srcstore := repo.GetObjectStore(srcdir)
+	fs, err := fold.Probe(dstdir, false)
+	if err != nil {
+		warnings = append(warnings, err)
+	}
+	for _, a := range pl.Actions {
+		j, err := plannedJob(a, srcdir, dstdir, src, srcstore, fs)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	if len(errs) > 0 {
+		return 0, fmt.Errorf("the plan is out of date, nothing was copied"), append(warnings, errs...)
+	}
+
+	err, ers := moveAside(srcdir, dstdir, jobs, dst, ops, opts)
+	warnings = append(warnings, ers...)
+	if err != nil {
+		return 0, err, warnings
+	}
+
+	successes, err, errs := copyJobs(srcdir, dstdir, jobs, dst, ops, p, opts)
+	errs = append(warnings, errs...)
+	if err != nil && !IsInterrupted(err) {
+		return len(successes), err, errs
+	}
+	successes, err, errs = commitCopies(dstdir, successes, err, errs, p)
+	return len(successes), err, errs
+}
+
+// Return path relative to dir, or an error if it is outside of dir
+func relPath(dir, path string) (string, error) {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return "", err
+	} else if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: not a file in %s", path, dir)
+	}
+	return rel, nil
+}
+
+// Return the copy of the plan action a, if it can still be applied. The
+// destination paths are compared to the source paths as in fs.
+func plannedJob(a plan.Action, srcdir, dstdir string, src *commit.Commit, srcstore *repo.ObjectStore, fs fold.FS) (job, error) {
+	if a.Kind != plan.File {
+		return job{}, fmt.Errorf("%s: only files can be copied, not %s", a.Src, a.Kind)
+	}
+
+	srcrel, err := relPath(srcdir, a.Src)
+	if err != nil {
+		return job{}, err
+	}
+	dstrel, err := relPath(dstdir, a.Dst)
+	if err != nil {
+		return job{}, err
+	}
+
+	origrel := dstrel
+	if a.Conflict {
+		origrel, err = relPath(dstdir, a.Original)
+		if err != nil {
+			return job{}, err
+		}
+	}
+
+	s := commit.Entry{Path: srcrel}
+	if i, ok := src.ByPath[srcrel]; ok {
+		s = src.Entries[i]
+	}
+	name := s.Name()
+
+	// Directories are created after the source ones, the destination may spell
+	// the names differently or have rewritten them
+	if !sameName(fs, filepath.Dir(name), filepath.Dir(dstrel)) || filepath.Dir(origrel) != filepath.Dir(dstrel) {
+		return job{}, fmt.Errorf("%s: cannot be copied to %s", a.Src, a.Dst)
+	} else if !sameName(fs, name, origrel) {
+		if a.Conflict {
+			return job{}, fmt.Errorf("%s: cannot be in conflict with %s", a.Src, a.Original)
+		}
+		return job{}, fmt.Errorf("%s: cannot be copied to %s", a.Src, a.Dst)
+	}
+
+	_, err = a.CheckSource()
+	if os.IsNotExist(err) && srcstore != nil && srcstore.Has(a.Hash) {
+		// Not checked out, copied from the object store
+		err = nil
+	}
+	if err == nil {
+		err = a.CheckDest()
+	}
+	if err != nil {
+		return job{}, err
+	}
+
+	s.Hash = a.Hash
+	d := s
+	d.Path, d.Original = dstrel, ""
+	if !a.Conflict && dstrel != name {
+		d.Original = name
+	}
+	return job{s, d, origrel, a.Conflict}, nil
+}
+
+// Return true if the destination path is the source name, spelled as in fs or
+// rewritten by fold.SafePath
+func sameName(fs fold.FS, name, path string) bool {
+	return fs.Key(name) == fs.Key(path) || fs.Key(fold.SafePath(name)) == fs.Key(path)
+}
@@ -0,0 +1,400 @@
+package copy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/journal"
+	"github.com/mildred/doc/repo"
+)
+
+// Name of the journal in .dirstore recording the transfers in progress
+const TransferJournal = "transfers"
+
+// Prefix of the temporary files created next to the copied files
+const TempPrefix = ".doctemp"
+
+const resumeBlockSize = 1024 * 1024
+
+// Transfers holds the lock of the transfers journal of a repository while
+// temporary files are created in it. A nil *Transfers holds nothing.
+type Transfers struct {
+	j     *journal.Journal
+	start time.Time
+
+	// No other process was copying when the lock was taken
+	alone bool
+}
+
+// Lock the transfers journal of the repository containing dir, or its closest
+// existing parent, until Unlock is called. Return nil if there is no dirstore.
+// Other processes do not remove the temporary files created meanwhile.
+func LockTransfers(dir string) (*Transfers, error) {
+	dir = absPath(dir)
+	for {
+		if _, err := os.Lstat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	j := journal.ForDir(dir, TransferJournal)
+	if j == nil {
+		return nil, nil
+	}
+	start := time.Now()
+	alone, err := j.Lock()
+	if err != nil {
+		return nil, err
+	}
+	if alone {
+		if err := j.Share(); err != nil {
+			j.Unlock()
+			return nil, err
+		}
+	}
+	return &Transfers{j, start, alone}, nil
+}
+
+// Return true if the leftover temporary file can be removed: no other process
+// was copying when the lock was taken and it was not written since. Some
+// filesystems store times with a 2 seconds precision, rounded down.
+func (t *Transfers) stale(info os.FileInfo) bool {
+	return t != nil && t.alone && info.ModTime().Before(t.start.Add(-2*time.Second))
+}
+
+// Release the lock
+func (t *Transfers) Unlock() {
+	if t != nil {
+		t.j.Unlock()
+	}
+}
+
+func tempFile(dir string) (*os.File, error) {
+	return ioutil.TempFile(dir, TempPrefix)
+}
+
+func transferArgs(src string, src_st os.FileInfo, dst string) map[string]string {
+	if abs, err := filepath.Abs(src); err == nil {
+		src = abs
+	}
+	if abs, err := filepath.Abs(dst); err == nil {
+		dst = abs
+	}
+	return map[string]string{
+		"src":   src,
+		"dst":   dst,
+		"size":  strconv.FormatInt(src_st.Size(), 10),
+		"mtime": src_st.ModTime().Format(time.RFC3339Nano),
+	}
+}
+
+// Open the temporary file to copy src to dst and record it in the journal. If
+// an interrupted transfer of the same source is found in the journal, the part
+// already written is checked and the transfer resumes from there. Return the
+// temporary file positionned where the copy should continue, and the journal
+// record id.
+func openTransfer(j *journal.Journal, src string, src_st os.FileInfo, dst string) (*os.File, int64, string, error) {
+	args := transferArgs(src, src_st, dst)
+
+	recs, err := j.Find("copy", map[string]string{"src": args["src"], "dst": args["dst"]})
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	for i, rec := range recs {
+		tmp := rec.Args["tmp"]
+		unchanged := rec.Args["size"] == args["size"] && rec.Args["mtime"] == args["mtime"]
+		if i == len(recs)-1 && unchanged {
+			f, err := os.OpenFile(tmp, os.O_RDWR, 0)
+			if err == nil {
+				off, err := checkPartial(f, src)
+				if err == nil {
+					err = f.Truncate(off)
+				}
+				if err == nil {
+					_, err = f.Seek(off, io.SeekStart)
+				}
+				if err == nil {
+					return f, off, rec.Id, nil
+				}
+				f.Close()
+			}
+		}
+		// Source changed or the partial file is not usable
+		os.Remove(tmp)
+		j.Done(rec.Id)
+	}
+
+	f, err := tempFile(filepath.Dir(dst))
+	if err != nil {
+		return nil, 0, "", err
+	}
+	args["tmp"] = f.Name()
+	if abs, err := filepath.Abs(f.Name()); err == nil {
+		args["tmp"] = abs
+	}
+
+	id, err := j.Begin("copy", args)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, 0, "", err
+	}
+	return f, 0, id, nil
+}
+
+// Compare the partial file f with the beginning of src and return the length
+// of the identical prefix
+func checkPartial(f *os.File, src string) (int64, error) {
+	src_f, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer src_f.Close()
+
+	var off int64
+	buf1 := make([]byte, resumeBlockSize)
+	buf2 := make([]byte, resumeBlockSize)
+	for {
+		n, err := io.ReadFull(f, buf1)
+		if n == 0 {
+			return off, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		m, err := io.ReadFull(src_f, buf2[:n])
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if m == n && bytes.Equal(buf1[:n], buf2[:n]) {
+			off += int64(n)
+			continue
+		}
+		for i := 0; i < m; i++ {
+			if buf1[i] != buf2[i] {
+				return off + int64(i), nil
+			}
+		}
+		return off + int64(m), nil
+	}
+}
+
+// Copy the content of src starting at off to a temporary file next to dst.
+// When the destination has a dirstore, the transfer is recorded in the journal
+// and the temporary file is kept on error so the transfer can resume.
+func copyRegularTemp(src string, src_st os.FileInfo, dst string) (string, error) {
+	var f *os.File
+	var off int64
+	var id string
+	var err error
+
+	j := journal.ForDir(filepath.Dir(dst), TransferJournal)
+	if j != nil {
+		f, off, id, err = openTransfer(j, src, src_st, dst)
+	} else {
+		f, err = tempFile(filepath.Dir(dst))
+	}
+	if err != nil {
+		return "", err
+	}
+	fname := f.Name()
+
+	err = copyContent(f, src, off)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		if id == "" {
+			os.Remove(fname)
+		}
+		return "", err
+	}
+
+	if id != "" {
+		err = j.Done(id)
+	}
+	return fname, err
+}
+
+func isTempName(name string) bool {
+	if len(name) > len(TempPrefix) && name[:len(TempPrefix)] == TempPrefix {
+		return true
+	}
+	return false
+}
+
+// Return true for temporary files created by older versions of doc
+func isLegacyTempName(name string) bool {
+	if len(name) <= 4 || name[:4] != "temp" {
+		return false
+	}
+	_, err := strconv.ParseUint(name[4:], 10, 32)
+	return err == nil
+}
+
+// Return the temporary files of the pending transfers in the journal
+func pendingTemp(j *journal.Journal) (map[string]bool, error) {
+	covered := map[string]bool{}
+	if j == nil {
+		return covered, nil
+	}
+	recs, err := j.Find("copy", nil)
+	for _, rec := range recs {
+		covered[rec.Args["tmp"]] = true
+	}
+	return covered, err
+}
+
+// Remove from dir the temporary files that are not covered by the journal and
+// that stale returns true for. Older style temporary files are only removed if
+// committed is not nil and returns false for them.
+func cleanTempDir(dir string, covered map[string]bool, stale func(os.FileInfo) bool, committed func(path string) bool, dry bool) ([]string, error) {
+	var removed []string
+
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if !isTempName(name) && !(committed != nil && isLegacyTempName(name) && !committed(path)) {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil && covered[abs] {
+			continue
+		}
+		if st, err := os.Lstat(path); err != nil || st.IsDir() || !stale(st) {
+			continue
+		}
+		if !dry {
+			if err := os.Remove(path); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// Remove the temporary files left in the tree by interrupted copies, except
+// those of transfers that can be resumed. Pending transfers whose source
+// changed or whose temporary file is missing are dropped from the journal.
+// Return the removed files. If dry is true, nothing is removed. Nothing is done
+// while other processes are copying files in the repository.
+func CleanTemp(root string, dry bool) ([]string, []error) {
+	var removed []string
+	var errs []error
+
+	j := journal.ForDir(root, TransferJournal)
+	if j != nil {
+		alone, err := j.Lock()
+		if err != nil {
+			return nil, []error{err}
+		}
+		defer j.Unlock()
+		if !alone {
+			return nil, []error{fmt.Errorf("%s: files are being copied by another process, try again once it is done", root)}
+		}
+
+		recs, err := j.Find("copy", nil)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, rec := range recs {
+			tmp := rec.Args["tmp"]
+			_, tmperr := os.Lstat(tmp)
+			src_st, err := os.Lstat(rec.Args["src"])
+			if tmperr == nil && err == nil && transferArgs(rec.Args["src"], src_st, rec.Args["dst"])["mtime"] == rec.Args["mtime"] {
+				continue
+			}
+			if tmperr == nil {
+				removed = append(removed, tmp)
+			}
+			if dry {
+				continue
+			}
+			if tmperr == nil {
+				if err := os.Remove(tmp); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			if err := j.Done(rec.Id); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	covered, err := pendingTemp(j)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	c, err := commit.ReadCommit(root)
+	if err != nil {
+		return removed, append(errs, err)
+	}
+	committed := func(path string) bool {
+		rel, err := filepath.Rel(root, path)
+		_, ok := c.ByPath[rel]
+		return err != nil || ok
+	}
+	never := func(path string) bool {
+		return false
+	}
+	always := func(info os.FileInfo) bool {
+		return true
+	}
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// Removed along with its directory's temporary files
+			return nil
+		} else if err != nil {
+			errs = append(errs, err)
+			return nil
+		} else if !info.IsDir() {
+			return nil
+		}
+
+		var files []string
+		if info.Name() == attrs.DirStoreName {
+			objects := filepath.Join(path, repo.ObjectsDirName)
+			if _, err := os.Lstat(objects); err == nil {
+				files, err = cleanTempDir(objects, covered, always, never, dry)
+			}
+		} else {
+			files, err = cleanTempDir(path, covered, always, committed, dry)
+		}
+		removed = append(removed, files...)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		if info.Name() == attrs.DirStoreName {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	if j != nil && !dry {
+		if err := j.Compact(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return removed, errs
+}
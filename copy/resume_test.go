@@ -0,0 +1,102 @@
+package copy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestIsLegacyTempName(t *testing.T) {
+	tests := []struct {
+		name   string
+		legacy bool
+	}{
+		{"temp123", true},
+		{"temp0", true},
+		{"temp", false},
+		{"temp12a", false},
+		{"temperature", false},
+		{"temp99999999999", false},
+		{"mytemp123", false},
+	}
+	for _, tt := range tests {
+		if legacy := isLegacyTempName(tt.name); legacy != tt.legacy {
+			t.Errorf("isLegacyTempName(%q) = %v, want %v", tt.name, legacy, tt.legacy)
+		}
+	}
+}
+
+func TestCleanTempDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.Abs(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files written before the copy started, and one written since
+	start := time.Now()
+	files := []string{".doctemp1", ".doctemp2", "temp1", "temp2", "temperature", "file", ".doctemp3"}
+	for _, name := range files {
+		path := filepath.Join(dir, name)
+		mtime := start.Add(-time.Hour)
+		if name == ".doctemp3" {
+			mtime = start.Add(time.Second)
+		}
+		if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		} else if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, ".doctempdir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	covered := map[string]bool{filepath.Join(dir, ".doctemp2"): true}
+	committed := func(path string) bool {
+		return filepath.Base(path) == "temp2"
+	}
+
+	always := func(os.FileInfo) bool {
+		return true
+	}
+	alone := &Transfers{start: start, alone: true}
+	shared := &Transfers{start: start}
+
+	tests := []struct {
+		name      string
+		stale     func(os.FileInfo) bool
+		committed func(string) bool
+		dry       bool
+		removed   []string
+	}{
+		{"dry run", always, committed, true, []string{".doctemp1", ".doctemp3", "temp1"}},
+		{"other process copying", shared.stale, nil, false, nil},
+		{"copy", alone.stale, nil, false, []string{".doctemp1"}},
+		{"fsck", always, committed, false, []string{".doctemp3", "temp1"}},
+		{"again", always, committed, false, nil},
+	}
+	for _, tt := range tests {
+		paths, err := cleanTempDir(dir, covered, tt.stale, tt.committed, tt.dry)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var removed []string
+		for _, path := range paths {
+			removed = append(removed, filepath.Base(path))
+			if _, err := os.Lstat(path); tt.dry == os.IsNotExist(err) {
+				t.Errorf("%s: %s exists: %v", tt.name, path, tt.dry)
+			}
+		}
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, tt.removed) {
+			t.Errorf("%s: removed %q, want %q", tt.name, removed, tt.removed)
+		}
+	}
+}
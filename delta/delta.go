@@ -0,0 +1,403 @@
+// Package delta implements rsync-style delta encoding. The receiver computes
+// the Signature of its old version of a file (the basis) and sends it to the
+// sender. The sender computes with Diff a delta stream made of references to
+// basis blocks and literal data. The receiver rebuilds the new file with Patch.
+//
+// Signatures and deltas are byte streams that can be sent over any transport.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const (
+	MinBlockSize = 700
+	MaxBlockSize = 128 * 1024
+
+	// Literal data is flushed when it reaches this size
+	maxLiteral = 64 * 1024
+)
+
+var (
+	signatureMagic = []byte("DOCS\x01")
+	deltaMagic     = []byte("DOCD\x01")
+
+	ErrFormat = errors.New("Invalid delta format")
+)
+
+const (
+	opCopy    = 'C'
+	opLiteral = 'L'
+	opEnd     = 'E'
+)
+
+type block struct {
+	weak   uint32
+	strong [sha1.Size]byte
+}
+
+// Block checksums of the basis file
+type Signature struct {
+	BlockSize int
+	Size      int64
+	blocks    []block
+	weak      map[uint32][]int
+}
+
+// Block size used for a basis file of the given size, the square root of the
+// size like rsync does.
+func BlockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 7
+	if bs < MinBlockSize {
+		return MinBlockSize
+	} else if bs > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return bs
+}
+
+func weakSum(data []byte) (a, b uint32) {
+	n := uint32(len(data))
+	for i, c := range data {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return
+}
+
+func weakKey(a, b uint32) uint32 {
+	return a&0xffff | b<<16
+}
+
+func (s *Signature) index() {
+	s.weak = map[uint32][]int{}
+	for i, blk := range s.blocks {
+		s.weak[blk.weak] = append(s.weak[blk.weak], i)
+	}
+}
+
+func (s *Signature) blockLen(i int) int {
+	off := int64(i) * int64(s.BlockSize)
+	if s.Size-off < int64(s.BlockSize) {
+		return int(s.Size - off)
+	}
+	return s.BlockSize
+}
+
+// Return the index of the basis block with the given content, or -1
+func (s *Signature) find(key uint32, data []byte) int {
+	candidates := s.weak[key]
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := sha1.Sum(data)
+	for _, i := range candidates {
+		if s.blockLen(i) == len(data) && s.blocks[i].strong == strong {
+			return i
+		}
+	}
+	return -1
+}
+
+// Compute the signature of the basis read from r
+func ComputeSignature(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			a, b := weakSum(buf[:n])
+			sig.blocks = append(sig.blocks, block{weakKey(a, b), sha1.Sum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	sig.index()
+	return sig, nil
+}
+
+func (s *Signature) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	var num [binary.MaxVarintLen64]byte
+	buf.Write(signatureMagic)
+	buf.Write(num[:binary.PutUvarint(num[:], uint64(s.BlockSize))])
+	buf.Write(num[:binary.PutUvarint(num[:], uint64(s.Size))])
+	for _, blk := range s.blocks {
+		binary.Write(&buf, binary.BigEndian, blk.weak)
+		buf.Write(blk.strong[:])
+	}
+	return buf.WriteTo(w)
+}
+
+func ReadSignature(r io.Reader) (*Signature, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(signatureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, err
+	} else if !bytes.Equal(magic, signatureMagic) {
+		return nil, ErrFormat
+	}
+	blockSize, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	size, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize == 0 || blockSize > MaxBlockSize {
+		return nil, ErrFormat
+	}
+	sig := &Signature{BlockSize: int(blockSize), Size: int64(size)}
+	num := (size + blockSize - 1) / blockSize
+	sig.blocks = make([]block, 0, num)
+	for i := uint64(0); i < num; i++ {
+		var blk block
+		if err := binary.Read(br, binary.BigEndian, &blk.weak); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(br, blk.strong[:]); err != nil {
+			return nil, err
+		}
+		sig.blocks = append(sig.blocks, blk)
+	}
+	sig.index()
+	return sig, nil
+}
+
+// Amount of data transmitted by a delta
+type Stats struct {
+	// Bytes sent as literal data
+	Literal int64
+
+	// Bytes reused from the basis
+	Matched int64
+}
+
+type encoder struct {
+	w          *bufio.Writer
+	copyStart  int
+	copyCount  int
+	num        [binary.MaxVarintLen64]byte
+	stats      Stats
+	blockSizes func(int) int
+}
+
+func (e *encoder) uvarint(n uint64) error {
+	_, err := e.w.Write(e.num[:binary.PutUvarint(e.num[:], n)])
+	return err
+}
+
+func (e *encoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	err := e.w.WriteByte(opCopy)
+	if err == nil {
+		err = e.uvarint(uint64(e.copyStart))
+	}
+	if err == nil {
+		err = e.uvarint(uint64(e.copyCount))
+	}
+	e.copyCount = 0
+	return err
+}
+
+func (e *encoder) copyBlock(i int) error {
+	e.stats.Matched += int64(e.blockSizes(i))
+	if e.copyCount > 0 && e.copyStart+e.copyCount == i {
+		e.copyCount++
+		return nil
+	}
+	err := e.flushCopy()
+	e.copyStart = i
+	e.copyCount = 1
+	return err
+}
+
+func (e *encoder) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	e.stats.Literal += int64(len(data))
+	err := e.flushCopy()
+	if err == nil {
+		err = e.w.WriteByte(opLiteral)
+	}
+	if err == nil {
+		err = e.uvarint(uint64(len(data)))
+	}
+	if err == nil {
+		_, err = e.w.Write(data)
+	}
+	return err
+}
+
+// Write to w the delta that transforms the basis described by sig into the
+// content read from src.
+func Diff(sig *Signature, src io.Reader, w io.Writer) (Stats, error) {
+	enc := &encoder{w: bufio.NewWriter(w), blockSizes: sig.blockLen}
+	br := bufio.NewReader(src)
+	L := sig.BlockSize
+
+	if _, err := enc.w.Write(deltaMagic); err != nil {
+		return enc.stats, err
+	}
+	if err := enc.uvarint(uint64(L)); err != nil {
+		return enc.stats, err
+	}
+
+	// data[lit:pos] is pending literal data, data[pos:] is the window
+	var data []byte
+	lit, pos := 0, 0
+	eof := false
+	valid := false
+	var a, b uint32
+
+	readByte := func() (byte, bool, error) {
+		if eof {
+			return 0, false, nil
+		}
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			eof = true
+			return 0, false, nil
+		}
+		return c, err == nil, err
+	}
+
+	for {
+		// Fill the window
+		for len(data)-pos < L {
+			c, ok, err := readByte()
+			if err != nil {
+				return enc.stats, err
+			} else if !ok {
+				break
+			}
+			data = append(data, c)
+			valid = false
+		}
+
+		n := len(data) - pos
+		if n == 0 {
+			break
+		}
+		if !valid {
+			a, b = weakSum(data[pos:])
+			valid = true
+		}
+
+		if i := sig.find(weakKey(a, b), data[pos:]); i >= 0 {
+			if err := enc.literal(data[lit:pos]); err != nil {
+				return enc.stats, err
+			}
+			if err := enc.copyBlock(i); err != nil {
+				return enc.stats, err
+			}
+			pos += n
+			lit = pos
+			valid = false
+		} else {
+			// Roll the window by one byte
+			out := uint32(data[pos])
+			a -= out
+			b -= uint32(n) * out
+			pos++
+			c, ok, err := readByte()
+			if err != nil {
+				return enc.stats, err
+			} else if ok {
+				data = append(data, c)
+				a += uint32(c)
+				b += a
+			}
+			if pos-lit >= maxLiteral {
+				if err := enc.literal(data[lit:pos]); err != nil {
+					return enc.stats, err
+				}
+				lit = pos
+			}
+		}
+
+		// Compact the buffer
+		if lit > 4*maxLiteral {
+			data = data[:copy(data, data[lit:])]
+			pos -= lit
+			lit = 0
+		}
+	}
+
+	if err := enc.literal(data[lit:]); err != nil {
+		return enc.stats, err
+	}
+	if err := enc.flushCopy(); err != nil {
+		return enc.stats, err
+	}
+	if err := enc.w.WriteByte(opEnd); err != nil {
+		return enc.stats, err
+	}
+	return enc.stats, enc.w.Flush()
+}
+
+// Rebuild in w the new content from the basis and the delta stream
+func Patch(basis io.ReaderAt, delta io.Reader, w io.Writer) error {
+	br := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return err
+	} else if !bytes.Equal(magic, deltaMagic) {
+		return ErrFormat
+	}
+	blockSize, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	} else if blockSize == 0 || blockSize > MaxBlockSize {
+		return ErrFormat
+	}
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case opCopy:
+			start, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			count, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			off := int64(start * blockSize)
+			sr := io.NewSectionReader(basis, off, int64(count*blockSize))
+			if _, err := io.Copy(w, sr); err != nil {
+				return err
+			}
+		case opLiteral:
+			n, err := binary.ReadUvarint(br)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, br, int64(n)); err != nil {
+				return err
+			}
+		case opEnd:
+			return nil
+		default:
+			return ErrFormat
+		}
+	}
+}
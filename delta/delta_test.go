@@ -0,0 +1,129 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// Compute the delta from basis to target through serialized signatures and
+// deltas, and return the patched result with the stats
+func roundTrip(t *testing.T, basis, target []byte, blockSize int) ([]byte, Stats) {
+	sig, err := ComputeSignature(bytes.NewReader(basis), blockSize)
+	if err != nil {
+		t.Fatalf("ComputeSignature: %v", err)
+	}
+	var sigbuf bytes.Buffer
+	if _, err := sig.WriteTo(&sigbuf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	sig, err = ReadSignature(&sigbuf)
+	if err != nil {
+		t.Fatalf("ReadSignature: %v", err)
+	}
+
+	var delta bytes.Buffer
+	stats, err := Diff(sig, bytes.NewReader(target), &delta)
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := Patch(bytes.NewReader(basis), &delta, &out); err != nil {
+		t.Fatalf("Patch: %v", err)
+	}
+	return out.Bytes(), stats
+}
+
+// The short last block of the basis can only be matched at the end of the
+// target, where the window shrinks
+func TestRoundTrip(t *testing.T) {
+	const bs = 16
+	basis := randomBytes(1, 10*bs+5)
+	other := randomBytes(2, 3*bs)
+
+	tests := []struct {
+		name    string
+		basis   []byte
+		target  []byte
+		matched int64
+	}{
+		{"empty", nil, nil, 0},
+		{"empty basis", nil, basis, 0},
+		{"empty target", basis, nil, 0},
+		{"identical", basis, basis, int64(len(basis))},
+		{"unrelated", basis, other, 0},
+		{"appended", basis, concat(basis, other), 10 * bs},
+		{"prepended", basis, concat(other[:7], basis), int64(len(basis))},
+		{"inserted", basis, concat(basis[:4*bs], other[:3], basis[4*bs:]), int64(len(basis))},
+		{"removed block", basis, concat(basis[:2*bs], basis[3*bs:]), int64(len(basis) - bs)},
+		{"truncated to blocks", basis, basis[:6*bs], 6 * bs},
+		{"truncated mid block", basis, basis[:6*bs+3], 6 * bs},
+		{"shorter than a block", basis, basis[:bs-1], 0},
+		{"short last block at end", basis, concat(other[:5], basis[8*bs:]), int64(2*bs + 5)},
+		{"short last block in the middle", basis, concat(basis[10*bs:], other), 0},
+	}
+	for _, tt := range tests {
+		out, stats := roundTrip(t, tt.basis, tt.target, bs)
+		if !bytes.Equal(out, tt.target) {
+			t.Errorf("%s: patched %d bytes, want %d bytes", tt.name, len(out), len(tt.target))
+			continue
+		}
+		if stats.Matched != tt.matched {
+			t.Errorf("%s: matched %d bytes, want %d", tt.name, stats.Matched, tt.matched)
+		}
+		if stats.Matched+stats.Literal != int64(len(tt.target)) {
+			t.Errorf("%s: %d bytes matched and %d literal, want %d in all", tt.name, stats.Matched, stats.Literal, len(tt.target))
+		}
+	}
+}
+
+func TestRoundTripLarge(t *testing.T) {
+	// Literals longer than maxLiteral are flushed and the buffer compacted
+	basis := randomBytes(3, 5*maxLiteral)
+	target := concat(randomBytes(4, 6*maxLiteral), basis[maxLiteral:], randomBytes(5, 10))
+	bs := BlockSizeFor(int64(len(basis)))
+	out, stats := roundTrip(t, basis, target, bs)
+	if !bytes.Equal(out, target) {
+		t.Fatalf("patched %d bytes, want %d bytes", len(out), len(target))
+	}
+	if stats.Matched < int64(4*maxLiteral-bs) {
+		t.Errorf("matched %d bytes, want at least %d", stats.Matched, 4*maxLiteral-bs)
+	}
+}
+
+func TestBlockSizeFor(t *testing.T) {
+	tests := []struct {
+		size int64
+		bs   int
+	}{
+		{0, MinBlockSize},
+		{1000, MinBlockSize},
+		{1 << 20, 1024},
+		{1 << 40, MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if bs := BlockSizeFor(tt.size); bs != tt.bs {
+			t.Errorf("BlockSizeFor(%d) = %d, want %d", tt.size, bs, tt.bs)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	if _, err := ReadSignature(bytes.NewReader([]byte("DOCX\x01"))); err != ErrFormat {
+		t.Errorf("ReadSignature with a bad magic: %v, want ErrFormat", err)
+	}
+	if err := Patch(bytes.NewReader(nil), bytes.NewReader([]byte("DOCD\x01\x10X")), &bytes.Buffer{}); err != ErrFormat {
+		t.Errorf("Patch with an unknown op: %v, want ErrFormat", err)
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"os"
-	"sort"
 
+	api "github.com/mildred/doc/api"
 	commit "github.com/mildred/doc/commit"
 )
 
@@ -14,7 +13,8 @@ const usageDiff string = `doc diff [OPTIONS...] [SRC] DEST
 doc missing [OPTIONS...] -from SRC [DEST]
 doc missing [OPTIONS...] -to DEST [SRC]
 
-Shif differences between STD and DST committed files.
+Shif differences between STD and DST committed files. Files that are hard links
+in only one of them are shown with "link" instead of the hash.
 
 Options:
 `
@@ -30,44 +30,29 @@ func mainDiff(args []string) int {
 	f.Parse(args)
 	src, dst := findSourceDest(*opt_from, *opt_to, f.Args())
 
-	srcfiles, err := commit.ReadCommit(src)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %s", src, err.Error())
+	changes, err := api.Diff(interrupt, src, dst)
+	if isInterrupt(err) {
+		fmt.Fprintf(os.Stderr, "interrupted\n")
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
 	}
 
-	dstfiles, err := commit.ReadCommit(dst)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%s: %s", dst, err.Error())
-	}
-
-	var filelist []string
-	for file := range srcfiles.ByPath {
-		filelist = append(filelist, file)
-	}
-	for file := range dstfiles.ByPath {
-		if _, ok := srcfiles.ByPath[file]; !ok {
-			filelist = append(filelist, file)
-		}
-	}
-	sort.Strings(filelist)
-
-	for _, file := range filelist {
-		var s, d commit.Entry
-		sid, hassrc := srcfiles.ByPath[file]
-		did, hasdst := dstfiles.ByPath[file]
-		if hassrc {
-			s = srcfiles.Entries[sid]
-		}
-		if hasdst {
-			d = dstfiles.Entries[did]
-		}
-		if hassrc && !hasdst {
-			fmt.Printf("- %s\t%s\n", s.HashText(), commit.EncodePath(file))
-		} else if !hassrc && hasdst {
-			fmt.Printf("+ %s\t%s\n", d.HashText(), commit.EncodePath(file))
-		} else if !bytes.Equal(s.Hash, d.Hash) {
-			fmt.Printf("- %s\t%s\n", s.HashText(), commit.EncodePath(file))
-			fmt.Printf("+ %s\t%s\n", d.HashText(), commit.EncodePath(file))
+	for _, c := range changes {
+		file := commit.EncodePath(c.Path)
+		switch c.Kind {
+		case api.Removed:
+			fmt.Printf("- %s\t%s\n", c.A.HashText(), file)
+		case api.Added:
+			fmt.Printf("+ %s\t%s\n", c.B.HashText(), file)
+		case api.Modified:
+			fmt.Printf("- %s\t%s\n", c.A.HashText(), file)
+			fmt.Printf("+ %s\t%s\n", c.B.HashText(), file)
+		case api.LinkRemoved:
+			fmt.Printf("- link\t%s\t%s\n", file, commit.EncodePath(c.Link))
+		case api.LinkAdded:
+			fmt.Printf("+ link\t%s\t%s\n", file, commit.EncodePath(c.Link))
 		}
 	}
 
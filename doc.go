@@ -5,28 +5,36 @@ import (
 	"fmt"
 	"os"
 	"sort"
+
+	events "github.com/mildred/doc/events"
+	throttle "github.com/mildred/doc/throttle"
 )
 
 var commands map[string]func([]string) int
 
 func init() {
 	commands = map[string]func([]string) int{
-		"help":    mainHelp,
-		"init":    mainInit,
-		"status":  mainStatus,
-		"info":    mainInfo,
-		"check":   mainCheck,
-		"commit":  mainCommit,
-		"cp":      mainCopy,
-		"sync":    mainSync,
-		"pull":    mainPull,
-		"push":    mainPush,
-		"save":    mainSave,
-		"dupes":   mainDupes,
-		"missing": mainMissing,
-		"unannex": mainUnannex,
-		"diff":    mainDiff,
-		"attr":    mainAttr,
+		"help":     mainHelp,
+		"init":     mainInit,
+		"status":   mainStatus,
+		"info":     mainInfo,
+		"check":    mainCheck,
+		"commit":   mainCommit,
+		"cp":       mainCopy,
+		"sync":     mainSync,
+		"pull":     mainPull,
+		"push":     mainPush,
+		"save":     mainSave,
+		"dupes":    mainDupes,
+		"missing":  mainMissing,
+		"unannex":  mainUnannex,
+		"diff":     mainDiff,
+		"attr":     mainAttr,
+		"bundle":   mainBundle,
+		"object":   mainObject,
+		"fsck":     mainFsck,
+		"trash":    mainTrash,
+		"versions": mainVersions,
 	}
 }
 
@@ -36,8 +44,28 @@ func main() {
 		mainHelp([]string{})
 	}
 
+	opt_read := flag.String("read-limit", "", "Maximum bytes read per second (with K, M or G suffix)")
+	opt_write := flag.String("write-limit", "", "Maximum bytes written per second (with K, M or G suffix)")
+	opt_files := flag.String("files-limit", "", "Maximum files read, copied or hashed per second")
+	opt_limits := flag.String("limits", "", "Read the limits from this file, reloaded when modified or on SIGUSR1")
+	opt_events := flag.String("events", "", "Stream the events of the operations in this format (jsonl)")
+	opt_events_fd := flag.Int("events-fd", 1, "File descriptor to write the events to")
 	flag.Parse()
 
+	if err := setLimits(*opt_read, *opt_write, *opt_files, *opt_limits); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if err := setEvents(*opt_events, *opt_events_fd); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if interruptible[flag.Arg(0)] {
+		handleInterrupt()
+	}
+
 	f := commands[flag.Arg(0)]
 	if f == nil {
 		mainHelp(nil)
@@ -50,6 +78,54 @@ func main() {
 	}
 }
 
+// Set the throttle limits from the command line, the control file limits take
+// precedence
+func setLimits(read, write, files, control string) error {
+	limits := []struct {
+		value   string
+		limiter *throttle.Limiter
+	}{
+		{read, throttle.Read},
+		{write, throttle.Write},
+		{files, throttle.Files},
+	}
+	for _, l := range limits {
+		if l.value == "" {
+			continue
+		}
+		rate, err := throttle.ParseRate(l.value)
+		if err != nil {
+			return err
+		}
+		l.limiter.SetRate(rate)
+	}
+
+	if control != "" {
+		return throttle.Watch(control)
+	}
+	return nil
+}
+
+// Stream the events to the file descriptor fd. When it is the standard output,
+// the messages usually printed there go to the standard error instead.
+func setEvents(format string, fd int) error {
+	if format == "" {
+		return nil
+	} else if format != "jsonl" {
+		return fmt.Errorf("unknown events format %#v", format)
+	}
+
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+	if _, err := f.Stat(); err != nil {
+		return fmt.Errorf("-events-fd %d: %s", fd, err.Error())
+	}
+	if fd == 1 {
+		os.Stdout = os.Stderr
+	}
+	events.Handle(events.JSONLines(f))
+	return nil
+}
+
 const helpText string = `doc COMMAND ...
 
 doc is a tool to save the status of your files. It record for each file a hash
@@ -74,6 +150,10 @@ Repository commands:
         init        Initialize a repository (defines a root)
         commit      Save current version of files
         save        Save PAR2 redundency information
+        object      Manage the content addressed object store
+        fsck        Clean up after interrupted operations
+        trash       Restore or delete the files moved to the trash
+        versions    List and restore the saved versions of a file
 
 Synchronisation commands:
 
@@ -81,6 +161,7 @@ Synchronisation commands:
         push        Push files that are missing in the other repository
         cp          [OLD] scan and copy files one way
         sync        [OLD] scan and copy files two ways
+        bundle      Transfer missing files using an offline archive
 
 Other commands:
 
@@ -91,8 +172,8 @@ Other commands:
 
 var described_commands []string = []string{
 	"check", "info", "status", "missing", "diff", "attr",
-	"init", "commit", "save", "help",
-	"cp", "sync", "pull", "push", "unannex", "dupes",
+	"init", "commit", "save", "object", "fsck", "trash", "versions", "help",
+	"cp", "sync", "pull", "push", "bundle", "unannex", "dupes",
 }
 
 const helpText2 string = `
@@ -102,6 +183,16 @@ help command:
         doc COMMAND -h
         doc help COMMAND
 
+Reads, writes and files per second can be limited for all commands with the
+global options below, as in doc -read-limit 10M pull SRC. With -limits FILE, the
+limits are read from FILE with read=RATE, write=RATE and files=RATE lines, and
+can be changed while doc is running.
+
+With -events jsonl, cp, sync, push, pull and the hashing of files report what
+they do as JSON objects, one per line, on the standard output or on the file
+descriptor given by -events-fd. When the events are on the standard output, the
+other messages are printed on the standard error.
+
 `
 
 func mainHelp(args []string) int {
@@ -6,6 +6,9 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	gosync "sync"
+
+	"github.com/mildred/doc/attrs"
 )
 
 const DocAttrFile = ".docattr"
@@ -113,3 +116,53 @@ func ReadTree(rootDir, prefix string, files []string) (attrs map[string]map[stri
 	}
 	return
 }
+
+// The .docattr files are read once per process by Get
+var (
+	mu       gosync.Mutex
+	dirItems = map[string][]DocAttrItem{}
+)
+
+// Return the items of the .docattr file of dir, nil if there is none
+func itemsOf(dir string) []DocAttrItem {
+	if items, ok := dirItems[dir]; ok {
+		return items
+	}
+	// Unreadable files are skipped
+	items, _ := ReadAttrFile(filepath.Join(dir, DocAttrFile))
+	dirItems[dir] = items
+	return items
+}
+
+// Return the attribute name of path from the .docattr files of its parents, up
+// to the repository root. Unlike ReadTree, the files do not need to be
+// committed. The deepest .docattr file wins, and within a file the last
+// matching item.
+func Get(path, name string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			break
+		}
+		val, found := "", false
+		for _, itm := range itemsOf(dir) {
+			match := itm.Name == rel || itm.Name == "" ||
+				strings.HasSuffix(itm.Name, "/") && strings.HasPrefix(rel, itm.Name)
+			if v, ok := itm.Attrs[name]; ok && match {
+				val, found = v, true
+			}
+		}
+		if found {
+			return val
+		} else if attrs.IsRoot(dir) {
+			break
+		}
+	}
+	return ""
+}
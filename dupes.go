@@ -4,10 +4,15 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
 	"syscall"
 
 	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	fastcopy "github.com/mildred/doc/fastcopy"
+	meta "github.com/mildred/doc/meta"
 	repo "github.com/mildred/doc/repo"
+	versions "github.com/mildred/doc/versions"
 )
 
 const dupesUsage string = `doc dupes [DIR...]
@@ -19,7 +24,10 @@ of detected links is shown in front of each file. Modified files are not listed.
 WARNING: deduplication of identical files do not currently check that the files
 are exactly the same. it just checks that the recorded hash are identical. The
 file might have been modified since. You should run doc check on the duplicate
-files before you try to deduplicate them.
+files before you try to deduplicate them. The files replaced by links are saved
+first in .dirstore/versions and can be restored with doc versions. A full copy
+of each is kept there, so -d does not free space. Without a .dirstore, the
+files are replaced without being saved.
 
 Options:
 `
@@ -54,9 +62,9 @@ func mainDupes(args []string) int {
 	errors := 0
 
 	for _, src := range srcs {
-		e := repo.Walk(src, func(path string, info os.FileInfo) error {
-			// Skip symlinks
-			if info.Mode()&os.ModeSymlink != 0 {
+		e := repo.Walk(src, repo.WalkOptions{}, func(path string, info os.FileInfo) error {
+			// Skip symlinks, and the remaining files once interrupted
+			if info.Mode()&os.ModeSymlink != 0 || interrupt.Err() != nil {
 				return nil
 			}
 
@@ -93,7 +101,19 @@ func mainDupes(args []string) int {
 		errors = errors + len(e)
 	}
 
+	if interrupt.Err() != nil {
+		fmt.Fprintf(os.Stderr, "interrupted after scanning %d files, nothing was deduplicated\n", num)
+		return 1
+	}
+
+	deduplicated := 0
+	warned := false
 	for _, f := range dupes {
+		if *opt_dedup && interrupt.Err() != nil {
+			fmt.Fprintf(os.Stderr, "interrupted after deduplicating %d groups of files\n", deduplicated)
+			return 1
+		}
+
 		if len(f.paths) <= 1 {
 			continue
 		}
@@ -112,10 +132,12 @@ func mainDupes(args []string) int {
 			}
 		}
 		if len(files) > 1 && *opt_dedup {
-			err := deduplicate(f)
+			err := deduplicate(f, &warned)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "%s", err.Error())
 				errors = errors + 1
+			} else {
+				deduplicated++
 			}
 		}
 	}
@@ -126,7 +148,9 @@ func mainDupes(args []string) int {
 	return 0
 }
 
-func deduplicate(f sameFile) error {
+// Replace the duplicates of f by links. warned tells if the files were
+// already reported to be replaced without being saved.
+func deduplicate(f sameFile, warned *bool) error {
 	by_dev := map[uint64][]int{}
 	for i, dev := range f.devices {
 		by_dev[dev] = append(by_dev[dev], i)
@@ -140,11 +164,26 @@ func deduplicate(f sameFile) error {
 			if f.inodes[first_file] == f.inodes[cur_file] {
 				continue
 			}
+			// The content is assumed identical but it may have changed since
+			// it was hashed. Without a dirstore, duplicates are replaced as
+			// they always were, like doc cp -dd removes them.
+			if versions.Get(filepath.Dir(f.paths[cur_file])) == nil {
+				if !*warned {
+					fmt.Fprintf(os.Stderr, "W: %s: no %s, duplicates are replaced without saving them\n", f.paths[cur_file], attrs.DirStoreName)
+					*warned = true
+				}
+			} else if _, err := versions.Save(f.paths[cur_file], "dupes"); err != nil {
+				return err
+			}
 			err := os.Remove(f.paths[cur_file])
 			if err != nil {
 				return err
 			}
 			err = os.Link(f.paths[first_file], f.paths[cur_file])
+			if err != nil && attrs.IsErrno(err, syscall.EMLINK) {
+				// Too many links, a reflink still shares the data
+				err = copyDuplicate(f.paths[first_file], f.paths[cur_file])
+			}
 			if err != nil {
 				panic(fmt.Errorf("Could not link identical file '%s' to '%s': %s", f.paths[first_file], f.paths[cur_file], err.Error()))
 			}
@@ -152,3 +191,18 @@ func deduplicate(f sameFile) error {
 	}
 	return nil
 }
+
+func copyDuplicate(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	_, err = fastcopy.CopyFile(src, dst, 0600)
+	if err != nil {
+		return err
+	}
+	for _, e := range meta.Copy(src, info, dst) {
+		fmt.Fprintf(os.Stderr, "W: %s\n", e.Error())
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+// Package events reports what long-running operations are doing, for the
+// scripts and interfaces that wrap doc. The copy and sync engines and the
+// hashing functions emit typed events, which are delivered to the handlers
+// registered with Handle. Nothing is done when there are no handlers.
+package events
+
+import (
+	"encoding/json"
+	"io"
+	gosync "sync"
+	"time"
+)
+
+type Type string
+
+const (
+	// Source and destination are being compared: Src, Dst
+	ScanStarted Type = "scan-started"
+
+	// A file content was hashed: Path, Hash, Size
+	FileHashed Type = "file-hashed"
+
+	// A file is to be copied: Src, Dst, Kind, Hash, Size, and Original for
+	// conflicts
+	ActionPlanned Type = "action-planned"
+
+	// A file was copied: Src, Dst, Files, TotalFiles, Bytes, TotalBytes. Also
+	// emitted every ProgressInterval while files are copied, with the bytes
+	// copied so far.
+	CopyProgress Type = "copy-progress"
+
+	// A conflict file was created next to its original: Path, Original
+	ConflictCreated Type = "conflict-created"
+
+	// An operation failed: Path, Error
+	Error Type = "error"
+
+	// Metadata could not be preserved, or an operation could be completed
+	// only partially: Error
+	Warning Type = "warning"
+
+	// The operation is over: Src, Dst, Files, Errors
+	Finished Type = "finished"
+)
+
+// Time between two copy-progress events while files are copied
+const ProgressInterval = time.Second
+
+type Event struct {
+	Time       time.Time `json:"time"`
+	Type       Type      `json:"event"`
+	Path       string    `json:"path,omitempty"`
+	Src        string    `json:"src,omitempty"`
+	Dst        string    `json:"dst,omitempty"`
+	Original   string    `json:"original,omitempty"`
+	Kind       string    `json:"kind,omitempty"`
+	Hash       string    `json:"hash,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Files      uint64    `json:"files,omitempty"`
+	TotalFiles uint64    `json:"total_files,omitempty"`
+	Bytes      uint64    `json:"bytes,omitempty"`
+	TotalBytes uint64    `json:"total_bytes,omitempty"`
+	Errors     int       `json:"errors,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type Handler func(e *Event)
+
+var (
+	mu       gosync.Mutex
+	handlers []Handler
+)
+
+// Register a handler for all the events. Handlers are called one at a time,
+// from the goroutine emitting the event.
+func Handle(h Handler) {
+	mu.Lock()
+	defer mu.Unlock()
+	handlers = append(handlers, h)
+}
+
+// Return true if events are handled, to avoid computing their fields otherwise
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(handlers) > 0
+}
+
+// Deliver e to the handlers, its time is set if missing
+func Emit(e Event) {
+	mu.Lock()
+	defer mu.Unlock()
+	if len(handlers) == 0 {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for _, h := range handlers {
+		h(&e)
+	}
+}
+
+// Emit an Error event for err, if it is not nil
+func EmitError(path string, err error) {
+	if err != nil {
+		Emit(Event{Type: Error, Path: path, Error: err.Error()})
+	}
+}
+
+// Emit a Warning event for each error
+func EmitWarnings(errs []error) {
+	for _, err := range errs {
+		Emit(Event{Type: Warning, Error: err.Error()})
+	}
+}
+
+// Return a handler writing the events to w as JSON, one per line
+func JSONLines(w io.Writer) Handler {
+	enc := json.NewEncoder(w)
+	return func(e *Event) {
+		enc.Encode(e)
+	}
+}
@@ -0,0 +1,185 @@
+// Package fastcopy copies file contents with the fastest method available: a
+// reflink that shares the data blocks (FICLONE, on Btrfs or XFS for instance),
+// copy_file_range that copies within the kernel, or a buffered copy. Sparse
+// files are copied segment by segment to keep their holes.
+package fastcopy
+
+import (
+	"io"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/mildred/doc/sparse"
+	"github.com/mildred/doc/throttle"
+)
+
+type Method int
+
+const (
+	Buffered Method = iota
+	Range
+	Clone
+)
+
+func (m Method) String() string {
+	switch m {
+	case Clone:
+		return "reflink"
+	case Range:
+		return "copy_file_range"
+	default:
+		return "buffered"
+	}
+}
+
+// Maximum size of a copy_file_range call, small enough to notice quickly
+// that limits were set
+const rangeChunk = 1 << 26
+
+// Bytes of file content placed by the copies of the process
+var copied uint64
+
+// Return the number of bytes placed so far by the copies of the process, all
+// files together. It grows as the copies go, for progress reports. The data
+// shared by a reflink, kept from an interrupted copy or left as a hole counts
+// as placed.
+func Copied() uint64 {
+	return atomic.LoadUint64(&copied)
+}
+
+func count(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&copied, uint64(n))
+	}
+}
+
+// Writer counting the bytes written to Copied
+type countingWriter struct {
+	w io.Writer
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	count(int64(n))
+	return n, err
+}
+
+// Errors for which copy_file_range is not usable and the copy must be done in
+// user space
+func rangeUnsupported(err error) bool {
+	return err == syscall.ENOSYS || err == syscall.EXDEV || err == syscall.EINVAL ||
+		err == syscall.EOPNOTSUPP || err == syscall.EPERM || err == syscall.EBADF
+}
+
+// Copy the content of src into dst, starting at offset off in both files. The
+// data before off is assumed to be identical already. Holes in src are kept as
+// holes in dst. Return the method used.
+func Copy(dst, src *os.File, off int64) (Method, error) {
+	info, err := src.Stat()
+	if err != nil {
+		return Buffered, err
+	}
+
+	// A reflink replaces the whole content, which is correct whatever off is
+	if err := clone(dst, src); err == nil {
+		count(info.Size())
+		return Clone, nil
+	}
+	count(off)
+
+	// Copies in the kernel cannot be paced
+	method := Range
+	if throttle.Enabled() {
+		method = Buffered
+	}
+
+	pos := off
+	for {
+		start, end, err := sparse.NextData(src, pos)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return method, err
+		}
+		count(start - pos)
+		pos, err = copySegment(dst, src, start, end, &method)
+		if err != nil {
+			return method, err
+		}
+	}
+	count(info.Size() - pos)
+
+	// Extend dst with the trailing hole, if any
+	dinfo, err := dst.Stat()
+	if err == nil && dinfo.Size() < info.Size() {
+		err = dst.Truncate(info.Size())
+	}
+	return method, err
+}
+
+// Copy the segment [start, end) of src at the same offset in dst. method is
+// downgraded to Buffered when copy_file_range cannot be used. Return the
+// position reached, which can be past end if the file grows.
+func copySegment(dst, src *os.File, start, end int64, method *Method) (int64, error) {
+	pos := start
+	for *method == Range && pos < end {
+		if throttle.Enabled() {
+			// The limits were set while copying
+			*method = Buffered
+			break
+		}
+		n, err := copyFileRange(dst, src, &pos, chunk(end-pos))
+		count(int64(n))
+		if err != nil {
+			if rangeUnsupported(err) {
+				*method = Buffered
+				break
+			}
+			return pos, &os.PathError{Op: "copy_file_range", Path: dst.Name(), Err: err}
+		} else if n == 0 {
+			return pos, nil
+		}
+	}
+	if pos >= end {
+		return pos, nil
+	}
+
+	// Continue with a buffered copy where copy_file_range stopped
+	if _, err := dst.Seek(pos, io.SeekStart); err != nil {
+		return pos, err
+	}
+	n, err := io.Copy(countingWriter{throttle.Writer(dst)}, throttle.Reader(io.NewSectionReader(src, pos, end-pos)))
+	return pos + n, err
+}
+
+func chunk(n int64) int {
+	if n > rangeChunk {
+		return rangeChunk
+	}
+	return int(n)
+}
+
+// Copy the file src to dst, created with permissions perm. dst must not exist.
+// dst is removed if the copy fails.
+func CopyFile(src, dst string, perm os.FileMode) (Method, error) {
+	s, err := os.Open(src)
+	if err != nil {
+		return Buffered, err
+	}
+	defer s.Close()
+
+	d, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return Buffered, err
+	}
+
+	m, err := Copy(d, s, 0)
+	if e := d.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return m, err
+}
@@ -0,0 +1,6 @@
+package fastcopy
+
+const (
+	sysCopyFileRange = 377
+	ficlone          = 0x40049409
+)
@@ -0,0 +1,6 @@
+package fastcopy
+
+const (
+	sysCopyFileRange = 326
+	ficlone          = 0x40049409
+)
@@ -0,0 +1,20 @@
+//go:build !386 && !amd64 && !arm && !arm64
+// +build !386,!amd64,!arm,!arm64
+
+package fastcopy
+
+import (
+	"os"
+	"syscall"
+)
+
+// The system call numbers are not known on this architecture: the copies are
+// done in user space
+
+func clone(dst, src *os.File) error {
+	return syscall.ENOSYS
+}
+
+func copyFileRange(dst, src *os.File, off *int64, n int) (int, error) {
+	return 0, syscall.ENOSYS
+}
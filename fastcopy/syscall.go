@@ -0,0 +1,30 @@
+//go:build 386 || amd64 || arm || arm64
+// +build 386 amd64 arm arm64
+
+package fastcopy
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func clone(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func copyFileRange(dst, src *os.File, off *int64, n int) (int, error) {
+	doff := *off
+	r, _, errno := syscall.Syscall6(sysCopyFileRange,
+		src.Fd(), uintptr(unsafe.Pointer(off)),
+		dst.Fd(), uintptr(unsafe.Pointer(&doff)),
+		uintptr(n), 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
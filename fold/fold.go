@@ -0,0 +1,220 @@
+// Package fold compares file names the way destination filesystems do.
+//
+// Names are compared in their Unicode NFC form: macOS creates names in NFD
+// form, and the same name typed elsewhere is usually in NFC form. On
+// case-insensitive filesystems, such as FAT32, exFAT or most SMB shares, names
+// that only differ by case are the same file as well.
+package fold
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	gosync "sync"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// How a filesystem compares names
+type FS struct {
+	// Names differing by case are the same file
+	IgnoreCase bool
+
+	// Names differing by Unicode normalisation are the same file
+	Normalizing bool
+}
+
+// Prefix of the file created to probe a filesystem. It contains an accented
+// letter to find out whether its NFD form names the same file.
+const probePrefix = ".docprobeé"
+
+// A filesystem probed, written is false if it was probed without writing
+type probed struct {
+	fs      FS
+	err     error
+	written bool
+}
+
+// Filesystems probed, by directory: they are probed once per process
+var (
+	probesMu gosync.Mutex
+	probes   = map[string]probed{}
+)
+
+// Return how the filesystem of dir, or of its closest existing parent,
+// compares names. A temporary file is created and removed to find out. If dry
+// is true or if the file cannot be created, the names already there are looked
+// up in another case and normalisation form instead. An error tells that the
+// filesystem could not be probed: all names are then assumed distinct.
+func Probe(dir string, dry bool) (FS, error) {
+	for {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			break
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return FS{}, fmt.Errorf("%s: no directory to probe how names are compared", dir)
+		}
+		dir = parent
+	}
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	if p, ok := probes[dir]; ok && (p.written || dry) {
+		return p.fs, p.err
+	}
+
+	var p probed
+	if !dry {
+		p.fs, p.err = probeFile(dir)
+		p.written = true
+	}
+	if dry || p.err != nil {
+		fs, ok := probeNames(dir)
+		if ok {
+			p.fs, p.err = fs, nil
+		} else if p.err != nil {
+			p.err = fmt.Errorf("%s: could not probe how names are compared, assuming names differing by case are distinct: %s", dir, p.err.Error())
+		} else {
+			p.err = fmt.Errorf("%s: no name to probe how names are compared without writing, assuming names differing by case are distinct", dir)
+		}
+	}
+	probes[dir] = p
+	return p.fs, p.err
+}
+
+// Probe the filesystem of dir with a temporary file
+func probeFile(dir string) (FS, error) {
+	f, err := ioutil.TempFile(dir, probePrefix)
+	if err != nil {
+		return FS{}, err
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	name := filepath.Base(path)
+	var fs FS
+	if _, err := os.Lstat(filepath.Join(dir, strings.ToUpper(name))); err == nil {
+		fs.IgnoreCase = true
+	}
+	if _, err := os.Lstat(filepath.Join(dir, norm.NFD.String(name))); err == nil {
+		fs.Normalizing = true
+	}
+	return fs, nil
+}
+
+// Probe the filesystem of dir with the names of its entries. Return false if
+// none of them has letters to tell whether case is ignored.
+func probeNames(dir string) (FS, bool) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return FS{}, false
+	}
+	names, _ := f.Readdirnames(-1)
+	f.Close()
+
+	var fs FS
+	caseKnown, normKnown := false, false
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if !caseKnown {
+			if other := swapCase(name); other != name {
+				fs.IgnoreCase, caseKnown = sameFile(path, filepath.Join(dir, other)), true
+			}
+		}
+		if !normKnown {
+			other := norm.NFD.String(name)
+			if other == name {
+				other = norm.NFC.String(name)
+			}
+			if other != name {
+				fs.Normalizing, normKnown = sameFile(path, filepath.Join(dir, other)), true
+			}
+		}
+		if caseKnown && normKnown {
+			break
+		}
+	}
+	return fs, caseKnown
+}
+
+// Return name with its lower case letters in upper case, or the other way round
+// if it has none
+func swapCase(name string) string {
+	if upper := strings.ToUpper(name); upper != name {
+		return upper
+	}
+	return strings.ToLower(name)
+}
+
+// Return true if the paths a and b are the same file
+func sameFile(a, b string) bool {
+	ai, err := os.Lstat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Lstat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// Return the key of a name or a path: paths with the same key are the same
+// file in fs
+func (fs FS) Key(path string) string {
+	key := norm.NFC.String(path)
+	if fs.IgnoreCase {
+		key = strings.ToLower(key)
+	}
+	return key
+}
+
+// Paths of a tree, by key of the name they have in other trees
+type Names struct {
+	fs    FS
+	paths map[string]string
+}
+
+// Return an empty set of paths compared as in fs
+func (fs FS) Names() *Names {
+	return &Names{fs, map[string]string{}}
+}
+
+// Add path and its parent directories, named name in other trees, unless a
+// path with the same key is already there. name and path have as many
+// components.
+func (n *Names) Add(name, path string) {
+	for name != "." && name != "/" {
+		key := n.fs.Key(name)
+		if _, ok := n.paths[key]; ok {
+			return
+		}
+		n.paths[key] = path
+		name, path = filepath.Dir(name), filepath.Dir(path)
+	}
+}
+
+// Return the path of the file named name, if any
+func (n *Names) Get(name string) (string, bool) {
+	p, ok := n.paths[n.fs.Key(name)]
+	return p, ok
+}
+
+// Return name with its parent directories spelled as their paths in the tree,
+// when they are there
+func (n *Names) Spell(name string) string {
+	dir := filepath.Dir(name)
+	if dir == "." || dir == "/" {
+		return name
+	}
+	if p, ok := n.Get(dir); ok {
+		dir = p
+	} else {
+		dir = n.Spell(dir)
+	}
+	return filepath.Join(dir, filepath.Base(name))
+}
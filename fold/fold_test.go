@@ -0,0 +1,113 @@
+package fold
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	nfc = "caf\u00e9"
+	nfd = "cafe\u0301"
+)
+
+func TestKey(t *testing.T) {
+	tests := []struct {
+		fs   FS
+		a, b string
+		same bool
+	}{
+		{FS{}, nfc, nfd, true},
+		{FS{}, "dir/" + nfd + "/a", "dir/" + nfc + "/a", true},
+		{FS{}, "Readme", "README", false},
+		{FS{IgnoreCase: true}, "Readme", "README", true},
+		{FS{IgnoreCase: true}, "CAFÉ", nfc, true},
+		{FS{IgnoreCase: true}, "a/B", "A/b", true},
+		{FS{IgnoreCase: true}, "a", "b", false},
+		{FS{IgnoreCase: true}, nfc, "cafe", false},
+	}
+	for _, tt := range tests {
+		if same := tt.fs.Key(tt.a) == tt.fs.Key(tt.b); same != tt.same {
+			t.Errorf("%+v: %q and %q same key %v, want %v", tt.fs, tt.a, tt.b, same, tt.same)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	names := FS{IgnoreCase: true}.Names()
+	names.Add("Docs/"+nfd+"/a.txt", "docs/"+nfd+"/a.txt")
+	names.Add("DOCS/b.txt", "DOCS/b.txt")
+
+	tests := []struct {
+		name string
+		path string
+		ok   bool
+	}{
+		{"docs", "docs", true},
+		{"DOCS/" + nfc, "docs/" + nfd, true},
+		{"docs/" + nfc + "/A.TXT", "docs/" + nfd + "/a.txt", true},
+		{"docs/b.txt", "DOCS/b.txt", true},
+		{"docs/c.txt", "", false},
+	}
+	for _, tt := range tests {
+		if path, ok := names.Get(tt.name); path != tt.path || ok != tt.ok {
+			t.Errorf("Get(%q) = %q, %v, want %q, %v", tt.name, path, ok, tt.path, tt.ok)
+		}
+	}
+
+	spell := []struct {
+		name string
+		path string
+	}{
+		{"new", "new"},
+		{"Docs/new", "docs/new"},
+		{"DOCS/" + nfc + "/new/x", "docs/" + nfd + "/new/x"},
+		{"other/new", "other/new"},
+	}
+	for _, tt := range spell {
+		if path := names.Spell(tt.name); path != tt.path {
+			t.Errorf("Spell(%q) = %q, want %q", tt.name, path, tt.path)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Nothing to look up without writing
+	if _, err := Probe(dir, true); err == nil {
+		t.Errorf("dry probe of an empty directory did not fail")
+	}
+
+	// Probed with a file that is removed, then cached
+	fs, err := Probe(filepath.Join(dir, "missing", "sub"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Errorf("probe left %d files", len(names))
+	}
+	if cached, err := Probe(dir, true); err != nil || cached != fs {
+		t.Errorf("cached probe %+v, %v, want %+v", cached, err, fs)
+	}
+
+	// The names there tell the same without writing
+	sub := filepath.Join(dir, "sub")
+	if err := os.Mkdir(sub, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sub, nfc), nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if dry, err := Probe(sub, true); err != nil || dry != fs {
+		t.Errorf("dry probe %+v, %v, want %+v", dry, err, fs)
+	}
+}
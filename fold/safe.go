@@ -0,0 +1,111 @@
+package fold
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Longest name FAT, exFAT and NTFS accept, in UTF-16 code units
+const MaxSafeName = 255
+
+// Characters FAT, exFAT and NTFS do not accept in names and the private use
+// characters they are written as, the mapping macOS and Samba use on SMB
+// shares. Control characters are mapped to U+F001 to U+F01F.
+var safeChars = map[rune]rune{
+	'"':  0xF020,
+	'*':  0xF021,
+	':':  0xF022,
+	'<':  0xF023,
+	'>':  0xF024,
+	'?':  0xF025,
+	'\\': 0xF026,
+	'|':  0xF027,
+}
+
+// Characters a trailing space or dot is written as, these filesystems would
+// drop it
+const (
+	safeSpace = 0xF028
+	safeDot   = 0xF029
+)
+
+// Character appended to the device names Windows reserves, CON, PRN, AUX, NUL,
+// COM1 to COM9 and LPT1 to LPT9, whatever their case and extension
+const safeReserved = 0xF02A
+
+// Return name rewritten so that FAT, exFAT and NTFS accept it, or name itself.
+// Characters they do not accept and a trailing space or dot are replaced by
+// private use characters, as is the end of reserved device names. Names too
+// long are shortened, keeping their extension, with a hash of the whole name so
+// they stay distinct.
+func SafeName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		last := i+utf8.RuneLen(r) == len(name)
+		if s, ok := safeChars[r]; ok {
+			r = s
+		} else if r > 0 && r < 0x20 {
+			r = 0xF000 + r
+		} else if last && r == ' ' {
+			r = safeSpace
+		} else if last && r == '.' {
+			r = safeDot
+		}
+		b.WriteRune(r)
+	}
+	safe := b.String()
+	if stem := reservedStem(safe); stem != "" {
+		safe = stem + string(rune(safeReserved)) + safe[len(stem):]
+	}
+	if utf16Len(safe) <= MaxSafeName {
+		return safe
+	}
+
+	sum := sha1.Sum([]byte(name))
+	ext := filepath.Ext(safe)
+	if utf16Len(ext) > MaxSafeName/4 {
+		ext = ""
+	}
+	suffix := "~" + hex.EncodeToString(sum[:4]) + ext
+	prefix := []rune(strings.TrimSuffix(safe, ext))
+	for utf16Len(string(prefix))+utf16Len(suffix) > MaxSafeName {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return string(prefix) + suffix
+}
+
+// Return path with each of its names rewritten by SafeName
+func SafePath(path string) string {
+	names := strings.Split(path, string(filepath.Separator))
+	for i, name := range names {
+		if name != "" && name != "." && name != ".." {
+			names[i] = SafeName(name)
+		}
+	}
+	return strings.Join(names, string(filepath.Separator))
+}
+
+// Return the start of name that makes it a reserved device name, or the empty
+// string. Windows ignores the extension and the spaces before it.
+func reservedStem(name string) string {
+	stem := name
+	if i := strings.IndexByte(stem, '.'); i >= 0 {
+		stem = stem[:i]
+	}
+	stem = strings.TrimRight(stem, " ")
+	switch upper := strings.ToUpper(stem); {
+	case upper == "CON" || upper == "PRN" || upper == "AUX" || upper == "NUL":
+		return stem
+	case len(upper) == 4 && (upper[:3] == "COM" || upper[:3] == "LPT") && upper[3] >= '1' && upper[3] <= '9':
+		return stem
+	}
+	return ""
+}
+
+func utf16Len(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
@@ -0,0 +1,81 @@
+package fold
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSafeName(t *testing.T) {
+	tests := []struct {
+		name string
+		safe string
+	}{
+		{"plain.txt", "plain.txt"},
+		{"a:b", "a\uf022b"},
+		{`"*:<>?\|`, "\uf020\uf021\uf022\uf023\uf024\uf025\uf026\uf027"},
+		{"tab\there", "tab\uf009here"},
+		{"trailing.", "trailing\uf029"},
+		{"trailing ", "trailing\uf028"},
+		{"inner. dot", "inner. dot"},
+		{".hidden", ".hidden"},
+
+		// Reserved device names, whatever their case and extension
+		{"CON", "CON\uf02a"},
+		{"nul", "nul\uf02a"},
+		{"aux.txt", "aux\uf02a.txt"},
+		{"Com1.tar.gz", "Com1\uf02a.tar.gz"},
+		{"lpt9", "lpt9\uf02a"},
+		{"con .txt", "con\uf02a .txt"},
+		{"prn.", "prn\uf029"},
+		{"com0", "com0"},
+		{"console", "console"},
+		{"auxiliary.txt", "auxiliary.txt"},
+	}
+	for _, tt := range tests {
+		if safe := SafeName(tt.name); safe != tt.safe {
+			t.Errorf("SafeName(%q) = %q, want %q", tt.name, safe, tt.safe)
+		}
+	}
+}
+
+func TestSafeNameLength(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+	}{
+		{strings.Repeat("a", MaxSafeName), ""},
+		{strings.Repeat("a", MaxSafeName+1), ""},
+		{strings.Repeat("a", 300) + ".txt", ".txt"},
+		// Characters outside the BMP take two UTF-16 units
+		{strings.Repeat("\U0001F600", 130) + ".jpg", ".jpg"},
+		{strings.Repeat("é", 200) + ".x" + strings.Repeat("y", 100), ""},
+		{strings.Repeat("a", 300) + "?", ""},
+	}
+	seen := map[string]string{}
+	for _, tt := range tests {
+		safe := SafeName(tt.name)
+		if n := utf16Len(safe); n > MaxSafeName {
+			t.Errorf("SafeName(%d units) has %d units", utf16Len(tt.name), n)
+		}
+		if !strings.HasSuffix(safe, tt.ext) {
+			t.Errorf("SafeName(%d units) = %q lost extension %q", utf16Len(tt.name), safe, tt.ext)
+		}
+		if other, ok := seen[safe]; ok {
+			t.Errorf("%q and %q have the same safe name", other, tt.name)
+		}
+		seen[safe] = tt.name
+	}
+
+	if name := strings.Repeat("a", MaxSafeName); SafeName(name) != name {
+		t.Errorf("name of %d units rewritten", MaxSafeName)
+	}
+	if SafeName(strings.Repeat("a", 300)+"b") == SafeName(strings.Repeat("a", 300)+"c") {
+		t.Errorf("long names ending differently have the same safe name")
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	if safe := SafePath("dir:1/../aux/b?"); safe != "dir\uf0221/../aux\uf02a/b\uf025" {
+		t.Errorf("SafePath = %q", safe)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mildred/doc/copy"
+)
+
+const fsckUsage string = `doc fsck [OPTIONS...] [DIR]
+
+Look in DIR or the current directory for leftovers of interrupted operations.
+
+Files being placed by doc sync, doc push or doc pull are recorded in a journal
+in the .dirstore until they are copied, marked as conflicts and committed. The
+operations that did not complete are rolled forward if the file was completely
+copied: its conflict marks and commit entry are written. Otherwise they are
+rolled back: the partial file is removed and its conflict mark removed from the
+original file. This is also done at the start of these commands, unless
+another process is placing files in the same repository.
+
+Temporary files left by interrupted copies are removed, unless the transfer can
+be resumed: a copy interrupted during doc push or doc pull is recorded in the
+.dirstore and resumes where it stopped the next time the same file is copied.
+Such transfers are abandoned if their source file has changed. Nothing is
+removed while another process is copying files in the repository.
+
+Files named temp followed by digits, the temporary files of older versions of
+doc, are removed as well when they are not committed. doc push and doc pull
+only remove their own temporary files, run doc fsck -n first to see which
+files would be removed.
+
+Options:
+`
+
+func mainFsck(args []string) int {
+	f := flag.NewFlagSet("fsck", flag.ExitOnError)
+	opt_dry_run := f.Bool("n", false, "Dry run, only show what would be done")
+	f.Usage = func() {
+		fmt.Print(fsckUsage)
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+	dir := f.Arg(0)
+	if dir == "" {
+		dir = "."
+	}
+
+	status := 0
+
+	recovered, errs := copy.Recover(dir, *opt_dry_run)
+	for _, r := range recovered {
+		if r.Forward {
+			fmt.Printf("roll forward %s\n", r.Path)
+		} else {
+			fmt.Printf("roll back %s\n", r.Path)
+		}
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		status = 1
+	}
+
+	// Recovered operations are complete, the temporary files can wait
+	if interrupt.Err() != nil {
+		fmt.Fprintf(os.Stderr, "interrupted, temporary files were not removed\n")
+		return 1
+	}
+
+	removed, errs := copy.CleanTemp(dir, *opt_dry_run)
+	for _, path := range removed {
+		fmt.Printf("rm %s\n", path)
+	}
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		status = 1
+	}
+
+	return status
+}
@@ -1,17 +1,166 @@
+// Package ignore applies the .docignore files. An empty .docignore file
+// ignores the directory containing it. Otherwise, it contains gitignore-style
+// patterns that apply to the files and directories under its directory: "*",
+// "?", "[...]" and "**" globs, "!" to negate a pattern, a leading or middle "/"
+// to anchor it to the .docignore directory and a trailing "/" to only match
+// directories. The last matching pattern wins, and patterns in deeper
+// directories take precedence. Files in an ignored directory cannot be included
+// again.
 package ignore
 
 import (
 	"os"
 	"path/filepath"
+	gosync "sync"
+
+	"github.com/mildred/doc/attrs"
 )
 
-func IsIgnored(path string) bool {
-	if filepath.Base(path) == ".dirstore" {
-		return true
+const FileName = ".docignore"
+
+// Patterns of the .docignore file of a directory
+type rules struct {
+	// The .docignore file is empty, the directory is ignored
+	empty    bool
+	patterns []pattern
+}
+
+// Matcher applies the .docignore files, reading each of them once. Use a
+// Matcher per walk of a tree: .docignore files changed afterwards are not seen.
+// A Matcher can be used concurrently.
+type Matcher struct {
+	mu      gosync.Mutex
+	rules   map[string]*rules
+	ignored map[string]bool
+	roots   map[string]bool
+}
+
+// Return a Matcher that has not read any .docignore file yet
+func New() *Matcher {
+	return &Matcher{
+		rules:   map[string]*rules{},
+		ignored: map[string]bool{},
+		roots:   map[string]bool{},
+	}
+}
+
+// Return the rules of dir, nil if it has no .docignore file
+func (m *Matcher) rulesOf(dir string) *rules {
+	if r, ok := m.rules[dir]; ok {
+		return r
+	}
+
+	var r *rules
+	f, err := os.Open(filepath.Join(dir, FileName))
+	if err == nil {
+		r = &rules{}
+		if st, err := f.Stat(); err == nil && st.Size() == 0 {
+			r.empty = true
+		} else {
+			// Unreadable patterns are skipped
+			r.patterns, _ = parsePatterns(f)
+		}
+		f.Close()
+	}
+	m.rules[dir] = r
+	return r
+}
+
+// Return true if dir is the root of a repository: patterns above it do not
+// apply
+func (m *Matcher) isRoot(dir string) bool {
+	if root, ok := m.roots[dir]; ok {
+		return root
+	}
+	root := attrs.IsRoot(dir)
+	m.roots[dir] = root
+	return root
+}
+
+// Return true if the directory dir, or one of its parents, is ignored
+func (m *Matcher) dirIgnored(dir string) bool {
+	if ignored, ok := m.ignored[dir]; ok {
+		return ignored
+	}
+	ignored := m.match(dir, true)
+	if !ignored && !m.isRoot(dir) {
+		ignored = m.dirIgnored(filepath.Dir(dir))
 	}
-	st, err := os.Lstat(filepath.Join(path, ".docignore"))
-	if err == nil && st.Size() == 0 {
+	m.ignored[dir] = ignored
+	return ignored
+}
+
+// Apply the .docignore files of the parents of path, up to the repository root
+func (m *Matcher) match(path string, isDir bool) bool {
+	if filepath.Base(path) == attrs.DirStoreName {
 		return true
+	} else if isDir {
+		if r := m.rulesOf(path); r != nil && r.empty {
+			return true
+		}
+	}
+	if m.isRoot(path) {
+		return false
+	}
+
+	// Directories from the closest to the root
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if m.isRoot(dir) {
+			break
+		}
+	}
+
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		r := m.rulesOf(dirs[i])
+		if r == nil {
+			continue
+		}
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+		rel = filepath.ToSlash(rel)
+		for _, p := range r.patterns {
+			if p.match(rel, isDir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// Return true if path is ignored by the .docignore files, or is in an ignored
+// directory. isDir tells if path is a directory.
+func (m *Matcher) Match(path string, isDir bool) bool {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
 	}
-	return false
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if isDir {
+		return m.dirIgnored(path)
+	}
+	return m.match(path, false) || m.dirIgnored(filepath.Dir(path))
+}
+
+// Return true if path, a file or a directory, is ignored. See Match.
+func (m *Matcher) IsIgnored(path string) bool {
+	st, err := os.Lstat(path)
+	return m.Match(path, err == nil && st.IsDir())
+}
+
+// Return true if path is ignored, reading the .docignore files again. See
+// Matcher.Match.
+func Match(path string, isDir bool) bool {
+	return New().Match(path, isDir)
+}
+
+// Return true if path, a file or a directory, is ignored, reading the
+// .docignore files again. See Matcher.Match.
+func IsIgnored(path string) bool {
+	return New().IsIgnored(path)
 }
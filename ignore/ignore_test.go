@@ -0,0 +1,157 @@
+package ignore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mildred/doc/attrs"
+)
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		// Names match at any depth
+		{"*.o", "a.o", false, true},
+		{"*.o", "src/lib/a.o", false, true},
+		{"*.o", "a.c", false, false},
+		{"*.o", "a.o/b", false, false},
+		{"?.o", "ab.o", false, false},
+		{"[ab].o", "b.o", false, true},
+		{"[!ab].o", "b.o", false, false},
+		{"[!ab].o", "c.o", false, true},
+
+		// Anchored to the .docignore directory
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.html", "doc/a.html", false, true},
+		{"doc/*.html", "x/doc/a.html", false, false},
+		{"doc/*.html", "doc/sub/a.html", false, false},
+
+		// Double stars
+		{"**/logs", "logs", true, true},
+		{"**/logs", "a/b/logs", true, true},
+		{"a/**/b", "a/b", false, true},
+		{"a/**/b", "a/x/y/b", false, true},
+		{"a/**/b", "ab/b", false, false},
+		{"a/**", "a/x/y", false, true},
+		{"a/**", "a", true, false},
+		{"a**b", "a/x/b", false, false},
+
+		// Directories only
+		{"tmp/", "tmp", true, true},
+		{"tmp/", "tmp", false, false},
+		{"tmp/", "x/tmp", true, true},
+
+		// Escapes and spaces
+		{"\\#notes", "#notes", false, true},
+		{"\\!x", "!x", false, true},
+		{"trailing   ", "trailing", false, true},
+		{"space\\ ", "space ", false, true},
+		{"a.b", "axb", false, false},
+	}
+	for _, tt := range tests {
+		p, ok := parsePattern(tt.pattern)
+		if !ok {
+			t.Errorf("%q: not a pattern", tt.pattern)
+		} else if match := p.match(tt.path, tt.isDir); match != tt.match {
+			t.Errorf("%q matching %q (dir %v) = %v, want %v", tt.pattern, tt.path, tt.isDir, match, tt.match)
+		}
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	text := "# comment\n\n   \n!keep.o\n/\n*.o\n"
+	patterns, err := parsePatterns(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 2 || !patterns[0].negate || patterns[1].negate {
+		t.Errorf("parsed %+v, want !keep.o and *.o", patterns)
+	}
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		dir := filepath.Dir(path)
+		if strings.HasSuffix(name, "/") {
+			dir = path
+		}
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			t.Fatal(err)
+		} else if dir == path {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	root, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	writeFiles(t, root, map[string]string{
+		attrs.DirStoreName + "/":             "",
+		".docignore":                         "*.o\n!keep.o\nbuild/\n",
+		"src/.docignore":                     "!*.o\n/gen\n",
+		"src/gen/a.c":                        "",
+		"src/sub/gen/a.c":                    "",
+		"build/.docignore":                   "!*\n",
+		"build/out":                          "",
+		"empty/.docignore":                   "",
+		"empty/a":                            "",
+		"nested/.docignore":                  "*.o\n",
+		"nested/" + attrs.DirStoreName + "/": "",
+	})
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.o", false, true},
+		{"keep.o", false, false},
+		{"x/keep.o", false, false},
+		{"a.c", false, false},
+		{"src/a.o", false, false},
+		{"src/gen", true, true},
+		{"src/gen/a.c", false, true},
+		{"src/sub/gen/a.c", false, false},
+		{"build", true, true},
+		{"build/out", false, true},
+		{"empty", true, true},
+		{"empty/a", false, true},
+		{attrs.DirStoreName, true, true},
+		{"nested/a.o", false, true},
+		{"nested/keep.o", false, true},
+		{"nested/build", true, false},
+	}
+	m := New()
+	for _, tt := range tests {
+		path := filepath.Join(root, tt.path)
+		if ignored := m.Match(path, tt.isDir); ignored != tt.ignored {
+			t.Errorf("Match(%q, %v) = %v, want %v", tt.path, tt.isDir, ignored, tt.ignored)
+		}
+	}
+
+	// The .docignore files are read once per Matcher
+	writeFiles(t, root, map[string]string{".docignore": "*.c\n"})
+	if m.Match(filepath.Join(root, "a.c"), false) {
+		t.Errorf("Matcher read .docignore again")
+	}
+	if !Match(filepath.Join(root, "a.c"), false) {
+		t.Errorf("Match did not read .docignore again")
+	}
+}
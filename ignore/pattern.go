@@ -0,0 +1,122 @@
+package ignore
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// A line of a .docignore file
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Parse the patterns of a .docignore file, in the gitignore syntax
+func parsePatterns(r io.Reader) ([]pattern, error) {
+	var res []pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		p, ok := parsePattern(scanner.Text())
+		if ok {
+			res = append(res, p)
+		}
+	}
+	return res, scanner.Err()
+}
+
+func parsePattern(line string) (pattern, bool) {
+	var p pattern
+
+	// Trailing spaces are ignored unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return p, false
+	}
+
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false
+	}
+
+	// Patterns with a slash are relative to the .docignore directory, others
+	// match a name at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return p, false
+	}
+	p.re = re
+	return p, true
+}
+
+// Translate a glob with gitignore "**" to a regular expression
+func globRegexp(glob string) string {
+	var res strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/") && (i == 0 || glob[i-1] == '/'):
+			// Any number of directories, including none
+			res.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**") && i+2 == len(glob) && (i == 0 || glob[i-1] == '/'):
+			// Everything inside
+			res.WriteString(".*")
+			i++
+		case c == '*':
+			res.WriteString("[^/]*")
+		case c == '?':
+			res.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == -1 {
+				res.WriteString(regexp.QuoteMeta("["))
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			res.WriteString("[" + strings.Replace(class, "\\", "\\\\", -1) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			res.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			res.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return res.String()
+}
+
+// Return true if the pattern applies to path, relative to the .docignore
+// directory
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(rel)
+}
@@ -12,13 +12,14 @@ import (
 	mh "github.com/jbenet/go-multihash"
 	attrs "github.com/mildred/doc/attrs"
 	repo "github.com/mildred/doc/repo"
+	sparse "github.com/mildred/doc/sparse"
 )
 
 const infoUsage string = `doc info [OPTIONS...] FILE...
 
-Show information about each file presented, including its status, hash and
-conflict status. It can also run integrity check on the files. It is a more
-detailed version of doc status.
+Show information about each file presented, including its status, hash,
+conflict status and size (with the allocated size for sparse files). It can also
+run integrity check on the files. It is a more detailed version of doc status.
 
 Options:
 `
@@ -63,6 +64,12 @@ func mainInfo(args []string) int {
 
 		fmt.Printf("File: %s\n", path)
 
+		if sparse.IsSparse(info) {
+			fmt.Printf("Size: %d bytes (sparse, %d bytes allocated)\n", info.Size(), sparse.Allocated(info))
+		} else {
+			fmt.Printf("Size: %d bytes\n", info.Size())
+		}
+
 		if conflict := repo.ConflictFile(path); conflict != "" {
 			fmt.Printf("Conflict With: %s\n", conflict)
 		}
@@ -24,10 +24,16 @@ directory on a different device (as inode numbers are used to associate files to
 attributes).
 
 Also, creates an empty .dircommit if there is none.
+
+With -objects, an object store is created in the .dirstore to keep file
+contents by hash (see doc object).
+
+Options:
 `
 
 func mainInit(args []string) int {
 	f := flag.NewFlagSet("init", flag.ExitOnError)
+	opt_objects := f.Bool("objects", false, "Create an object store")
 	f.Usage = func() {
 		fmt.Print(initUsage)
 		f.PrintDefaults()
@@ -52,5 +58,13 @@ func mainInit(args []string) int {
 		fmt.Fprintln(os.Stderr, err.Error())
 		res = res + 1
 	}
+
+	if *opt_objects {
+		err = initObjectStore(dir)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			res = res + 1
+		}
+	}
 	return res
 }
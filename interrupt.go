@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Done on the first SIGINT or SIGTERM for the commands that handle
+// interruptions: they stop starting new work, complete the files in progress,
+// record what was done and print a summary. The second signal exits at once,
+// doc fsck then recovers the files left in progress.
+var interrupt context.Context = context.Background()
+
+// Commands that stop cleanly when interrupt is done, the other commands are
+// killed by the signals as usual. doc missing, doc attr and doc info only read.
+// The commands that never check interrupt complete their work before exiting.
+var interruptible = map[string]bool{
+	"status":   true,
+	"check":    true,
+	"commit":   true,
+	"diff":     true,
+	"cp":       true,
+	"sync":     true,
+	"pull":     true,
+	"push":     true,
+	"save":     true,
+	"dupes":    true,
+	"bundle":   true,
+	"object":   true,
+	"unannex":  true,
+	"trash":    true,
+	"versions": true,
+	"fsck":     true,
+	"init":     true,
+}
+
+func handleInterrupt() {
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt = ctx
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		fmt.Fprintf(os.Stderr, "\n%s: completing the files in progress, interrupt again to stop at once\n", sig)
+		cancel()
+		<-signals
+		os.Exit(130)
+	}()
+}
+
+// Return true if err reports that the command was interrupted
+func isInterrupt(err error) bool {
+	return err != nil && err == interrupt.Err()
+}
@@ -0,0 +1,405 @@
+// Package journal records operations in the dirstore when they start and when
+// they are done, so that incomplete operations can be found after an
+// interruption.
+package journal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"syscall"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+)
+
+const (
+	journalSuffix = ".journal"
+	lockSuffix    = ".lock"
+)
+
+type Record struct {
+	Id   string
+	Op   string
+	Args map[string]string
+}
+
+type Journal struct {
+	path    string
+	mu      gosync.Mutex
+	loaded  bool
+	pending map[string]Record
+	counter int
+
+	// Lock file, open while the journal is locked by the process, and
+	// number of lock holders in the process. lockMu is held while the
+	// journal is locked exclusively.
+	lockMu    gosync.Mutex
+	lockf     *os.File
+	locks     int
+	exclusive bool
+}
+
+var (
+	journalsMu gosync.Mutex
+	journals   = map[string]*Journal{}
+)
+
+// Return the journal name in the dirstore. The same journal is shared within
+// the process.
+func Open(dirstore, name string) *Journal {
+	path := filepath.Join(dirstore, name+journalSuffix)
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	journalsMu.Lock()
+	defer journalsMu.Unlock()
+	j := journals[path]
+	if j == nil {
+		j = &Journal{path: path}
+		journals[path] = j
+	}
+	return j
+}
+
+// Return the journal name in the dirstore of the repository containing dir,
+// nil if there is no dirstore.
+func ForDir(dir, name string) *Journal {
+	dirstore := attrs.FindDirStore(dir)
+	if dirstore == "" {
+		return nil
+	}
+	return Open(dirstore, name)
+}
+
+func escape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\t", "\\t", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return s
+}
+
+func unescape(s string) string {
+	var res []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 't':
+				res = append(res, '\t')
+			case 'n':
+				res = append(res, '\n')
+			default:
+				res = append(res, s[i])
+			}
+		} else {
+			res = append(res, s[i])
+		}
+	}
+	return string(res)
+}
+
+func (r Record) line() string {
+	var keys []string
+	for k := range r.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	line := "begin\t" + r.Id + "\t" + escape(r.Op)
+	for _, k := range keys {
+		line += "\t" + escape(k) + "=" + escape(r.Args[k])
+	}
+	return line + "\n"
+}
+
+func (j *Journal) load() error {
+	if j.loaded {
+		return nil
+	}
+	j.pending = map[string]Record{}
+
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		j.loaded = true
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		elems := strings.Split(scanner.Text(), "\t")
+		if len(elems) >= 3 && elems[0] == "begin" {
+			rec := Record{elems[1], unescape(elems[2]), map[string]string{}}
+			for _, kv := range elems[3:] {
+				s := strings.SplitN(kv, "=", 2)
+				if len(s) == 2 {
+					rec.Args[unescape(s[0])] = unescape(s[1])
+				}
+			}
+			j.pending[rec.Id] = rec
+		} else if len(elems) == 2 && elems[0] == "done" {
+			delete(j.pending, elems[1])
+		}
+		// Ignore truncated lines
+	}
+	j.loaded = true
+	return scanner.Err()
+}
+
+func (j *Journal) append(line string, sync bool) error {
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(line))
+	if err == nil && sync {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Record the start of an operation. The record is on disk when Begin returns.
+func (j *Journal) Begin(op string, args map[string]string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.load(); err != nil {
+		return "", err
+	}
+
+	j.counter++
+	rec := Record{fmt.Sprintf("%d.%d.%d", time.Now().UnixNano(), os.Getpid(), j.counter), op, args}
+	err := j.append(rec.line(), true)
+	if err != nil {
+		return "", err
+	}
+	j.pending[rec.Id] = rec
+	return rec.Id, nil
+}
+
+// Record that an operation is complete. The journal is emptied when there is
+// no operation pending any more.
+func (j *Journal) Done(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.load(); err != nil {
+		return err
+	}
+
+	delete(j.pending, id)
+	err := j.append("done\t"+id+"\n", false)
+	if err == nil && len(j.pending) == 0 {
+		j.removeUnused()
+	}
+	return err
+}
+
+// Remove the journal once no operation is pending, unless other processes are
+// recording operations in it. They may have appended records since the
+// journal was loaded: it is read again under an exclusive lock.
+func (j *Journal) removeUnused() {
+	if j.exclusive {
+		os.Remove(j.path)
+		return
+	}
+
+	f := j.lockf
+	if f == nil {
+		var err error
+		f, err = os.OpenFile(j.lockPath(), os.O_RDONLY|os.O_CREATE, 0666)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+	}
+	fd := int(f.Fd())
+	if syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+		// The conversion can release the shared lock before failing
+		if j.lockf != nil {
+			syscall.Flock(fd, syscall.LOCK_SH)
+		}
+		return
+	}
+	j.loaded = false
+	if j.load() == nil && len(j.pending) == 0 {
+		os.Remove(j.path)
+	}
+	if j.lockf != nil {
+		syscall.Flock(fd, syscall.LOCK_SH)
+	}
+}
+
+func (j *Journal) lockPath() string {
+	return strings.TrimSuffix(j.path, journalSuffix) + lockSuffix
+}
+
+// Return the operations that are not done, in the order they started
+func (j *Journal) Pending() ([]Record, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+
+	var res []Record
+	for _, rec := range j.pending {
+		res = append(res, rec)
+	}
+	sort.Sort(byId(res))
+	return res, nil
+}
+
+// Return the pending operations with the given operation name and arguments
+func (j *Journal) Find(op string, args map[string]string) ([]Record, error) {
+	pending, err := j.Pending()
+	if err != nil {
+		return nil, err
+	}
+	var res []Record
+	for _, rec := range pending {
+		if rec.Op != op {
+			continue
+		}
+		match := true
+		for k, v := range args {
+			if rec.Args[k] != v {
+				match = false
+				break
+			}
+		}
+		if match {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// Rewrite the journal with the pending operations only
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.load(); err != nil {
+		return err
+	}
+
+	if len(j.pending) == 0 {
+		err := os.Remove(j.path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return err
+	}
+
+	var recs []Record
+	for _, rec := range j.pending {
+		recs = append(recs, rec)
+	}
+	sort.Sort(byId(recs))
+
+	tmp := j.path + ".new"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		if _, err = f.Write([]byte(rec.line())); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// Lock the journal for the process until Unlock is called. Processes hold a
+// shared lock while they record operations. The first holder gets an exclusive
+// lock if no other process holds one: the pending operations are then those of
+// processes that stopped, and Lock returns true. Once they are recovered, Share
+// must be called. Other holders in the process wait until then.
+func (j *Journal) Lock() (bool, error) {
+	j.lockMu.Lock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.locks > 0 {
+		j.locks++
+		j.lockMu.Unlock()
+		return false, nil
+	}
+
+	f, err := os.OpenFile(j.lockPath(), os.O_RDONLY|os.O_CREATE, 0666)
+	if err != nil {
+		j.lockMu.Unlock()
+		return false, err
+	}
+	exclusive := true
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		exclusive = false
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	}
+	if err != nil {
+		f.Close()
+		j.lockMu.Unlock()
+		return false, err
+	}
+
+	j.lockf = f
+	j.locks = 1
+	j.exclusive = exclusive
+	if exclusive {
+		// Read the operations other processes recorded
+		j.loaded = false
+		return true, nil
+	}
+	j.lockMu.Unlock()
+	return false, nil
+}
+
+// Turn the exclusive lock Lock returned into a shared lock
+func (j *Journal) Share() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.lockMu.Unlock()
+	j.exclusive = false
+	return syscall.Flock(int(j.lockf.Fd()), syscall.LOCK_SH)
+}
+
+// Release the lock taken by Lock
+func (j *Journal) Unlock() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.locks--
+	if j.locks == 0 {
+		j.lockf.Close()
+		j.lockf = nil
+	}
+	if j.exclusive {
+		j.exclusive = false
+		j.lockMu.Unlock()
+	}
+}
+
+type byId []Record
+
+func (a byId) Len() int           { return len(a) }
+func (a byId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byId) Less(i, k int) bool { return a[i].Id < a[k].Id }
@@ -0,0 +1,201 @@
+package journal
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func tempJournal(t *testing.T) (*Journal, func()) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Open(dir, "test"), func() { os.RemoveAll(dir) }
+}
+
+// Return a journal reading the same file, as another process would
+func reopen(j *Journal) *Journal {
+	return &Journal{path: j.path}
+}
+
+func pendingIds(t *testing.T, j *Journal) []string {
+	recs, err := j.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, rec := range recs {
+		ids = append(ids, rec.Id)
+	}
+	return ids
+}
+
+func TestBeginDone(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	args := map[string]string{
+		"src":   "/a\tb\nc\\d",
+		"dst":   "x=y",
+		"empty": "",
+	}
+	id1, err := j.Begin("copy", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := j.Begin("trash", map[string]string{"src": "/e"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIds(t, j); !reflect.DeepEqual(ids, []string{id1, id2}) {
+		t.Errorf("pending %q, want %q", ids, []string{id1, id2})
+	}
+
+	recs, err := reopen(j).Find("copy", map[string]string{"empty": ""})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(recs) != 1 || recs[0].Id != id1 || !reflect.DeepEqual(recs[0].Args, args) {
+		t.Errorf("found %#v, want %s with %#v", recs, id1, args)
+	}
+
+	if err := j.Done(id1); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIds(t, reopen(j)); !reflect.DeepEqual(ids, []string{id2}) {
+		t.Errorf("pending %q after done, want %q", ids, []string{id2})
+	}
+
+	if err := j.Done(id2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Errorf("journal not removed once empty: %v", err)
+	}
+}
+
+func TestDoneKeepsOtherRecords(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+	other := reopen(j)
+
+	id, err := j.Begin("copy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherId, err := other.Begin("copy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Done(id); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIds(t, reopen(j)); !reflect.DeepEqual(ids, []string{otherId}) {
+		t.Errorf("pending %q, want %q", ids, []string{otherId})
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	id, err := j.Begin("copy", map[string]string{"src": "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.append("begin\t2.1.1", false); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIds(t, reopen(j)); !reflect.DeepEqual(ids, []string{id}) {
+		t.Errorf("pending %q, want %q", ids, []string{id})
+	}
+
+	if err := j.append("\ndone\t"+id+"\n", false); err != nil {
+		t.Fatal(err)
+	}
+	if ids := pendingIds(t, reopen(j)); len(ids) != 0 {
+		t.Errorf("pending %q, want none", ids)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := j.Begin("copy", map[string]string{"n": string(rune('a' + i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := j.Done(ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := (Record{ids[0], "copy", map[string]string{"n": "a"}}).line() +
+		(Record{ids[2], "copy", map[string]string{"n": "c"}}).line()
+	if string(data) != want {
+		t.Errorf("compacted to %q, want %q", data, want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	j, cleanup := tempJournal(t)
+	defer cleanup()
+	other := reopen(j)
+
+	exclusive, err := j.Lock()
+	if err != nil {
+		t.Fatal(err)
+	} else if !exclusive {
+		t.Fatal("first lock not exclusive")
+	}
+	if err := j.Share(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Holders in the same process and in other processes share the lock
+	if exclusive, err = j.Lock(); err != nil || exclusive {
+		t.Errorf("second lock in the process: exclusive %v, %v", exclusive, err)
+	}
+	j.Unlock()
+	if exclusive, err = other.Lock(); err != nil || exclusive {
+		t.Errorf("lock of another process: exclusive %v, %v", exclusive, err)
+	}
+
+	// The journal is kept while another process may record operations
+	id, err := j.Begin("copy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Done(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(j.path); err != nil {
+		t.Errorf("journal removed while locked by another process: %v", err)
+	}
+
+	// And removed once it is the only holder
+	other.Unlock()
+	id, err = j.Begin("copy", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Done(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(j.path); !os.IsNotExist(err) {
+		t.Errorf("journal not removed once empty: %v", err)
+	}
+	j.Unlock()
+}
@@ -0,0 +1,196 @@
+// Package meta replicates file metadata from one file to another: ownership,
+// permissions, extended attributes, POSIX ACLs and timestamps with nanosecond
+// precision. Symbolic links are never followed.
+package meta
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	gosync "sync"
+	"syscall"
+	"time"
+
+	"github.com/mildred/doc/attrs"
+)
+
+// POSIX ACLs are stored in these extended attributes
+var aclXattrs = []string{"system.posix_acl_access", "system.posix_acl_default"}
+
+// Metadata that could not be preserved on a file
+type Issue struct {
+	Path string
+	What string
+	Err  error
+}
+
+func (i *Issue) Error() string {
+	err := i.Err
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return fmt.Sprintf("%s: could not preserve %s: %s", i.Path, i.What, err.Error())
+}
+
+// Return the access and modification times of info
+func Times(info os.FileInfo) (atime, mtime time.Time) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(stat.Atim.Sec, stat.Atim.Nsec), time.Unix(stat.Mtim.Sec, stat.Mtim.Nsec)
+	}
+	return info.ModTime(), info.ModTime()
+}
+
+// Set the access and modification times of path, without following symlinks
+func SetTimes(path string, atime, mtime time.Time) error {
+	err := lutimesNano(path, [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	})
+	if err != nil {
+		return &Issue{path, "timestamps", err}
+	}
+	return nil
+}
+
+// Replicate all the metadata of src, described by info from os.Lstat, to dst.
+// Return the metadata that could not be preserved.
+func Copy(src string, info os.FileInfo, dst string) []error {
+	errs := CopyNoTimes(src, info, dst)
+	atime, mtime := Times(info)
+	if err := SetTimes(dst, atime, mtime); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Like Copy, without the timestamps. Use it for directories whose content is
+// not written yet, and set their times afterwards with DirTimes.
+func CopyNoTimes(src string, info os.FileInfo, dst string) []error {
+	var errs []error
+	symlink := info.Mode()&os.ModeSymlink != 0
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		err := os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+		if err != nil {
+			errs = append(errs, &Issue{dst, "ownership", err})
+		}
+	}
+
+	// Permissions of symlinks are not used
+	if !symlink {
+		err := os.Chmod(dst, info.Mode())
+		if err != nil {
+			errs = append(errs, &Issue{dst, "permissions", err})
+		}
+	}
+
+	return append(errs, copyXattrs(src, dst, symlink)...)
+}
+
+func isACL(name string) bool {
+	for _, acl := range aclXattrs {
+		if name == acl {
+			return true
+		}
+	}
+	return false
+}
+
+// Copy extended attributes, ACLs last because they must be set after the
+// permissions and other attributes.
+func copyXattrs(src, dst string, symlink bool) []error {
+	var errs []error
+	var names []string
+	var err error
+
+	if symlink {
+		names, err = llistxattr(src)
+		if err == syscall.ENOTSUP {
+			return nil
+		}
+	} else {
+		names, err = attrs.GetNameList(src)
+	}
+	if err != nil {
+		return []error{&Issue{dst, "extended attributes", err}}
+	}
+
+	var ordered, acls []string
+	for _, name := range names {
+		if isACL(name) {
+			acls = append(acls, name)
+		} else {
+			ordered = append(ordered, name)
+		}
+	}
+
+	for _, name := range append(ordered, acls...) {
+		what := "extended attribute " + name
+		if isACL(name) {
+			what = strings.TrimPrefix(name, "system.posix_acl_") + " ACL"
+		}
+
+		var value []byte
+		if symlink {
+			value, err = lgetxattr(src, name)
+		} else {
+			value, err = attrs.Get(src, name)
+		}
+		if err == nil {
+			if symlink {
+				err = lsetxattr(dst, name, value)
+			} else {
+				err = attrs.Set(dst, name, value)
+			}
+		}
+		if err != nil {
+			errs = append(errs, &Issue{dst, what, err})
+		}
+	}
+	return errs
+}
+
+type dirTime struct {
+	path  string
+	atime time.Time
+	mtime time.Time
+}
+
+// Timestamps of directories, applied once their content is written because
+// writing in a directory changes its modification time. DirTimes can be used
+// from several goroutines.
+type DirTimes struct {
+	mu   gosync.Mutex
+	dirs []dirTime
+}
+
+func (d *DirTimes) Add(path string, atime, mtime time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirs = append(d.dirs, dirTime{path, atime, mtime})
+}
+
+// Set the timestamps of the directories added so far
+func (d *DirTimes) Apply() []error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var errs []error
+	for i := len(d.dirs) - 1; i >= 0; i-- {
+		dir := d.dirs[i]
+		if err := SetTimes(dir.path, dir.atime, dir.mtime); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	d.dirs = nil
+	return errs
+}
+
+// Report the issues of a temporary file under its final path
+func ForPath(errs []error, path string) []error {
+	for _, err := range errs {
+		if issue, ok := err.(*Issue); ok {
+			issue.Path = path
+		}
+	}
+	return errs
+}
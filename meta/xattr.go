@@ -0,0 +1,103 @@
+package meta
+
+import (
+	"bytes"
+	"syscall"
+	"unsafe"
+)
+
+// Extended attribute syscalls that do not follow symlinks
+
+func llistxattr(path string) ([]string, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), 0, 0)
+		if errno != 0 {
+			return nil, errno
+		} else if size == 0 {
+			return nil, nil
+		}
+		buf := make([]byte, size)
+		n, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&buf[0])), size)
+		if errno == syscall.ERANGE {
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:n], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+func lgetxattr(path, name string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		size, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), 0, 0, 0, 0)
+		if errno != 0 {
+			return nil, errno
+		} else if size == 0 {
+			return []byte{}, nil
+		}
+		buf := make([]byte, size)
+		read, _, errno := syscall.Syscall6(syscall.SYS_LGETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(&buf[0])), size, 0, 0)
+		if errno == syscall.ERANGE {
+			continue
+		} else if errno != 0 {
+			return nil, errno
+		}
+		return buf[:read], nil
+	}
+}
+
+func lsetxattr(path, name string, value []byte) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	n, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var v unsafe.Pointer
+	if len(value) > 0 {
+		v = unsafe.Pointer(&value[0])
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_LSETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(n)), uintptr(v), uintptr(len(value)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+const (
+	atFdCwd           = -100
+	atSymlinkNoFollow = 0x100
+)
+
+func lutimesNano(path string, ts [2]syscall.Timespec) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	fd := atFdCwd
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(fd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -47,7 +47,7 @@ func mainMissing(args []string) int {
 	}
 
 	for _, s := range srcfiles.Entries {
-		did, hasd := dstfiles.ByPath[s.Path]
+		did, hasd := dstfiles.ByName[s.Name()]
 		if !hasd {
 			fmt.Printf("- %s\t%s\n", s.HashText(), commit.EncodePath(s.Path))
 		} else {
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	repo "github.com/mildred/doc/repo"
+)
+
+const objectUsage string = `doc object add FILE...
+doc object list [DIR]
+doc object cat HASH
+doc object checkout [-l] HASH DEST
+doc object rm HASH
+
+Manage the content addressed object store in .dirstore/objects. Objects are
+named after the hash of their content and can be kept even if no file in the
+tree has this content. doc pull and doc push take the content from the object
+store when a file is not checked out in the source, or when the destination
+store already has it. The object store is created with doc init -objects.
+
+add stores the content of each FILE in the object store.
+
+list shows the hash of each stored object.
+
+cat writes the object content on the standard output.
+
+checkout creates DEST with the object content. With -l, DEST is a hard link to
+the object and is read only.
+
+rm removes an object from the store.
+
+Options:
+`
+
+func mainObject(args []string) int {
+	f := flag.NewFlagSet("object", flag.ExitOnError)
+	opt_link := f.Bool("l", false, "Hard link the object instead of copying it (checkout)")
+	f.Usage = func() {
+		fmt.Print(objectUsage)
+		f.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		f.Usage()
+		return 1
+	}
+	cmd := args[0]
+	f.Parse(args[1:])
+
+	storeFor := func(path string) *repo.ObjectStore {
+		store := repo.GetObjectStore(path)
+		if store == nil {
+			fmt.Fprintf(os.Stderr, "%s: Could not find object store, please run doc init -objects\n", path)
+		}
+		return store
+	}
+
+	switch cmd {
+	case "add":
+		status := 0
+		for i, path := range f.Args() {
+			if interrupt.Err() != nil {
+				fmt.Fprintf(os.Stderr, "interrupted, %d files not added\n", f.NArg()-i)
+				return 1
+			}
+			store := storeFor(filepath.Dir(path))
+			if store == nil {
+				return 1
+			}
+			info, err := os.Lstat(path)
+			var digest []byte
+			if err == nil {
+				digest, err = repo.GetHash(path, info, true)
+			}
+			if err == nil {
+				_, err = store.Add(path, info, digest)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
+				status = 1
+				continue
+			}
+			fmt.Printf("%s %s\n", base58.Encode(digest), path)
+		}
+		return status
+	case "list":
+		dir := f.Arg(0)
+		if dir == "" {
+			dir = "."
+		}
+		store := storeFor(dir)
+		if store == nil {
+			return 1
+		}
+		digests, err := store.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		}
+		for _, digest := range digests {
+			fmt.Println(base58.Encode(digest))
+		}
+		return 0
+	case "cat", "checkout", "rm":
+		if f.NArg() < 1 {
+			f.Usage()
+			return 1
+		}
+		dir := "."
+		if cmd == "checkout" {
+			if f.NArg() != 2 {
+				f.Usage()
+				return 1
+			}
+			dir = filepath.Dir(f.Arg(1))
+		}
+		store := storeFor(dir)
+		if store == nil {
+			return 1
+		}
+		digest := base58.Decode(f.Arg(0))
+		var err error
+		switch cmd {
+		case "cat":
+			var obj *os.File
+			obj, err = store.Open(digest)
+			if err == nil {
+				_, err = io.Copy(os.Stdout, obj)
+				obj.Close()
+			}
+		case "checkout":
+			err = store.Checkout(digest, f.Arg(1), *opt_link)
+		case "rm":
+			err = store.Remove(digest)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", f.Arg(0), err.Error())
+			return 1
+		}
+		return 0
+	default:
+		f.Usage()
+		return 1
+	}
+}
+
+func initObjectStore(dir string) error {
+	_, err := repo.InitObjectStore(filepath.Join(dir, attrs.DirStoreName))
+	return err
+}
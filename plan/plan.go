@@ -0,0 +1,321 @@
+// Package plan reads and writes the actions of a copy in a text file, so they
+// can be reviewed and edited before being applied.
+//
+// The first line is "doc plan COMMAND", followed by the "source" and
+// "destination" lines. Each action is then a line of tab separated fields: the
+// kind, "C" for a conflict, "A" when the destination is moved aside or "-", the
+// source hash, the size, the source and the destination. Conflicts have two more
+// fields: the original destination file and its hash. Actions moving the
+// destination aside have the name it is moved to and its hash. Missing hashes
+// are written "-". Empty lines and lines starting with "#" are ignored.
+package plan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	commit "github.com/mildred/doc/commit"
+	repo "github.com/mildred/doc/repo"
+)
+
+const magic = "doc plan"
+
+type Kind string
+
+const (
+	Dir     Kind = "dir"
+	File    Kind = "file"
+	Symlink Kind = "symlink"
+	Special Kind = "special"
+)
+
+func KindOf(mode os.FileMode) Kind {
+	switch {
+	case mode.IsDir():
+		return Dir
+	case mode.IsRegular():
+		return File
+	case mode&os.ModeSymlink != 0:
+		return Symlink
+	default:
+		return Special
+	}
+}
+
+type Action struct {
+	Kind     Kind
+	Conflict bool
+	Hash     []byte
+	Size     int64
+	Src      string
+	Dst      string
+
+	// The file or symlink at Dst is moved aside to Original before the
+	// directory is created
+	Aside bool
+
+	// For conflicts, the destination file that Dst is an alternative of, and
+	// its hash when planned. When moving aside, the name the destination is
+	// moved to and the destination hash.
+	Original     string
+	OriginalHash []byte
+}
+
+type Plan struct {
+	// Command that made the plan, and that can apply it
+	Command string
+	Source  string
+	Dest    string
+	Actions []Action
+}
+
+func hashText(hash []byte) string {
+	if len(hash) == 0 {
+		return "-"
+	}
+	return base58.Encode(hash)
+}
+
+func textHash(text string) []byte {
+	if text == "-" {
+		return nil
+	}
+	return base58.Decode(text)
+}
+
+func (a *Action) line() string {
+	conflict := "-"
+	if a.Conflict {
+		conflict = "C"
+	} else if a.Aside {
+		conflict = "A"
+	}
+	fields := []string{
+		string(a.Kind),
+		conflict,
+		hashText(a.Hash),
+		strconv.FormatInt(a.Size, 10),
+		commit.EncodePath(a.Src),
+		commit.EncodePath(a.Dst),
+	}
+	if a.Conflict || a.Aside {
+		fields = append(fields, commit.EncodePath(a.Original), hashText(a.OriginalHash))
+	}
+	return strings.Join(fields, "\t") + "\n"
+}
+
+func Write(w io.Writer, p *Plan) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "%s %s\n", magic, p.Command)
+	fmt.Fprintf(bw, "source\t%s\n", commit.EncodePath(p.Source))
+	fmt.Fprintf(bw, "destination\t%s\n", commit.EncodePath(p.Dest))
+	fmt.Fprintf(bw, "# kind\tconflict\thash\tsize\tsource\tdestination\toriginal\toriginal hash\n")
+	for _, a := range p.Actions {
+		bw.WriteString(a.line())
+	}
+	return bw.Flush()
+}
+
+func WriteFile(path string, p *Plan) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = Write(f, p)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func parseAction(fields []string) (Action, error) {
+	var a Action
+	var err error
+	if len(fields) != 6 && len(fields) != 8 {
+		return a, fmt.Errorf("expected 6 or 8 fields, got %d", len(fields))
+	}
+
+	a.Kind = Kind(fields[0])
+	switch a.Kind {
+	case Dir, File, Symlink, Special:
+	default:
+		return a, fmt.Errorf("unknown kind %s", fields[0])
+	}
+
+	switch fields[1] {
+	case "C":
+		a.Conflict = true
+	case "A":
+		a.Aside = true
+	case "-":
+	default:
+		return a, fmt.Errorf("conflict must be C, A or -, not %s", fields[1])
+	}
+
+	a.Hash = textHash(fields[2])
+	a.Size, err = strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return a, err
+	}
+	a.Src = commit.DecodePath(fields[4])
+	a.Dst = commit.DecodePath(fields[5])
+
+	if (a.Conflict || a.Aside) != (len(fields) == 8) {
+		return a, fmt.Errorf("conflicts must have the original file and hash, and only them")
+	} else if a.Aside && a.Kind != Dir {
+		return a, fmt.Errorf("only directories can move the destination aside")
+	} else if a.Conflict || a.Aside {
+		a.Original = commit.DecodePath(fields[6])
+		a.OriginalHash = textHash(fields[7])
+	}
+	return a, nil
+}
+
+func Read(r io.Reader) (*Plan, error) {
+	p := &Plan{}
+	scanner := bufio.NewScanner(r)
+	num := 0
+	for scanner.Scan() {
+		num++
+		line := scanner.Text()
+		if num == 1 {
+			if !strings.HasPrefix(line, magic+" ") {
+				return nil, fmt.Errorf("not a plan, first line must be %#v", magic+" COMMAND")
+			}
+			p.Command = line[len(magic)+1:]
+			continue
+		} else if line == "" || line[0] == '#' {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		switch fields[0] {
+		case "source":
+			p.Source = commit.DecodePath(strings.Join(fields[1:], "\t"))
+		case "destination":
+			p.Dest = commit.DecodePath(strings.Join(fields[1:], "\t"))
+		default:
+			a, err := parseAction(fields)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", num, err.Error())
+			}
+			p.Actions = append(p.Actions, a)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if num == 0 {
+		return nil, fmt.Errorf("empty plan")
+	}
+	return p, nil
+}
+
+func ReadFile(path string) (*Plan, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return p, nil
+}
+
+// Return the absolute path of path, or path if it cannot be found
+func Abs(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// Return the hash of the file, computing it if it is not committed. Directories
+// and special files have no hash.
+func Hash(path string, info os.FileInfo) ([]byte, error) {
+	if k := KindOf(info.Mode()); k != File && k != Symlink {
+		return nil, nil
+	}
+	return repo.GetHash(path, info, true)
+}
+
+// Check that the source is of the planned kind and still has the planned hash.
+// Return its information, followed if it is a symlink planned as another kind.
+func (a *Action) CheckSource() (os.FileInfo, error) {
+	info, err := os.Lstat(a.Src)
+	if err == nil && a.Kind != Symlink && info.Mode()&os.ModeSymlink != 0 {
+		info, err = os.Stat(a.Src)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if KindOf(info.Mode()) != a.Kind {
+		return nil, fmt.Errorf("%s: not a %s any more", a.Src, a.Kind)
+	}
+
+	if a.Hash != nil {
+		hash, err := Hash(a.Src, info)
+		if err != nil {
+			return nil, err
+		} else if !bytes.Equal(hash, a.Hash) {
+			return nil, fmt.Errorf("%s: changed since the plan was made", a.Src)
+		}
+	}
+	return info, nil
+}
+
+// Check that the destination does not exist yet, and for conflicts, that the
+// original destination file did not change. When moving aside, check that the
+// destination did not change and that the name it is moved to is free.
+func (a *Action) CheckDest() error {
+	if a.Aside {
+		if _, err := os.Lstat(a.Original); err == nil {
+			return fmt.Errorf("%s: created since the plan was made", a.Original)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		return checkHash(a.Dst, a.OriginalHash)
+	}
+
+	// A parent that is not a directory is moved aside by another action
+	if _, err := os.Lstat(a.Dst); err == nil {
+		return fmt.Errorf("%s: created since the plan was made", a.Dst)
+	} else if !os.IsNotExist(err) && !attrs.IsErrno(err, syscall.ENOTDIR) {
+		return err
+	}
+
+	if !a.Conflict {
+		return nil
+	}
+	return checkHash(a.Original, a.OriginalHash)
+}
+
+// Check that path still has the planned hash. Without a planned hash, path may
+// not exist yet: it is copied by another action.
+func checkHash(path string, planned []byte) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) && planned == nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	hash, err := Hash(path, info)
+	if err != nil {
+		return err
+	} else if !bytes.Equal(hash, planned) {
+		return fmt.Errorf("%s: changed since the plan was made", path)
+	}
+	return nil
+}
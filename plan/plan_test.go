@@ -0,0 +1,81 @@
+package plan
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteRead(t *testing.T) {
+	p := &Plan{
+		Command: "push",
+		Source:  "/src/with\ttab",
+		Dest:    "/dst",
+		Actions: []Action{
+			{Kind: Dir, Src: "/src/dir", Dst: "/dst/dir"},
+			{Kind: File, Hash: []byte{0x11, 0x14, 1, 2, 3}, Size: 42, Src: "/src/a\\b", Dst: "/dst/a\\b"},
+			{Kind: Symlink, Hash: []byte{0x11, 0x14, 4}, Size: 3, Src: "/src/new\nline", Dst: "/dst/new\nline"},
+			{Kind: File, Conflict: true, Hash: []byte{0x11, 0x14, 5}, Size: 1, Src: "/src/c.txt", Dst: "/dst/c.txt.x.txt",
+				Original: "/dst/c.txt", OriginalHash: []byte{0x11, 0x14, 6}},
+			{Kind: File, Conflict: true, Hash: []byte{0x11, 0x14, 7}, Src: "/src/d", Dst: "/dst/d.x",
+				Original: "/dst/d"},
+			{Kind: Dir, Aside: true, Src: "/src/e", Dst: "/dst/e", Original: "/dst/e.x", OriginalHash: []byte{0x11, 0x14, 8}},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, p); err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if i >= 4 && strings.Count(line, "\t") != 5 && strings.Count(line, "\t") != 7 {
+			t.Errorf("line %d has %d fields: %q", i+1, strings.Count(line, "\t")+1, line)
+		}
+	}
+
+	read, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, p) {
+		t.Errorf("read %#v, want %#v", read, p)
+	}
+}
+
+func TestRead(t *testing.T) {
+	const header = "doc plan pull\nsource\t/src\ndestination\t/dst\n"
+	tests := []struct {
+		name    string
+		text    string
+		actions int
+		err     string
+	}{
+		{"header only", header, 0, ""},
+		{"comments and empty lines", header + "# comment\n\nfile\t-\t-\t0\t/src/a\t/dst/a\n", 1, ""},
+		{"empty", "", 0, "empty plan"},
+		{"no magic", "plan pull\n", 0, "not a plan"},
+		{"fields", header + "file\t-\t-\t0\t/src/a\n", 0, "line 4: expected 6 or 8 fields, got 5"},
+		{"kind", header + "fifo\t-\t-\t0\t/src/a\t/dst/a\n", 0, "line 4: unknown kind fifo"},
+		{"conflict flag", header + "file\tX\t-\t0\t/src/a\t/dst/a\n", 0, "line 4: conflict must be C, A or -, not X"},
+		{"size", header + "file\t-\t-\tbig\t/src/a\t/dst/a\n", 0, "line 4: strconv.ParseInt"},
+		{"conflict without original", header + "file\tC\t-\t0\t/src/a\t/dst/a\n", 0, "line 4: conflicts must have"},
+		{"original without conflict", header + "file\t-\t-\t0\t/src/a\t/dst/a\t/dst/b\t-\n", 0, "line 4: conflicts must have"},
+		{"aside file", header + "file\tA\t-\t0\t/src/a\t/dst/a\t/dst/b\t-\n", 0, "line 4: only directories"},
+	}
+	for _, tt := range tests {
+		p, err := Read(strings.NewReader(tt.text))
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if p.Command != "pull" || p.Source != "/src" || p.Dest != "/dst" || len(p.Actions) != tt.actions {
+			t.Errorf("%s: read %#v", tt.name, p)
+		}
+	}
+}
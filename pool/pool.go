@@ -0,0 +1,121 @@
+// Package pool runs copies concurrently, with a global limit and limits on the
+// number of copies reading from or writing to the same device.
+package pool
+
+import (
+	"os"
+	"path/filepath"
+	gosync "sync"
+	"syscall"
+)
+
+type Pool struct {
+	jobs      chan struct{}
+	perSource int
+	perDest   int
+	mu        gosync.Mutex
+	sources   map[uint64]chan struct{}
+	dests     map[uint64]chan struct{}
+	wg        gosync.WaitGroup
+}
+
+// Create a pool running at most jobs copies at the same time, with at most
+// perSource copies from the same device and perDest copies to the same device.
+// A limit of 0 means no limit.
+func New(jobs, perSource, perDest int) *Pool {
+	if jobs < 1 {
+		jobs = 1
+	}
+	return &Pool{
+		jobs:      make(chan struct{}, jobs),
+		perSource: perSource,
+		perDest:   perDest,
+		sources:   map[uint64]chan struct{}{},
+		dests:     map[uint64]chan struct{}{},
+	}
+}
+
+// Return the device of path, or of its closest existing parent directory
+func Device(path string) uint64 {
+	for {
+		st, err := os.Lstat(path)
+		if err == nil {
+			if stat, ok := st.Sys().(*syscall.Stat_t); ok {
+				return uint64(stat.Dev)
+			}
+			return 0
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return 0
+		}
+		path = parent
+	}
+}
+
+func (p *Pool) semaphore(sems map[uint64]chan struct{}, limit int, dev uint64) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sem := sems[dev]
+	if sem == nil {
+		sem = make(chan struct{}, limit)
+		sems[dev] = sem
+	}
+	return sem
+}
+
+// Run f in the pool to copy src to dst. Go blocks until a job slot is
+// available. The job then waits for wait to be closed (if not nil) before it
+// waits for the device limits and runs f.
+func (p *Pool) Go(src, dst string, wait <-chan struct{}, f func()) {
+	p.jobs <- struct{}{}
+	p.wg.Add(1)
+	go func() {
+		defer func() {
+			<-p.jobs
+			p.wg.Done()
+		}()
+
+		if wait != nil {
+			<-wait
+		}
+
+		srcsem := p.semaphore(p.sources, p.perSource, Device(src))
+		dstsem := p.semaphore(p.dests, p.perDest, Device(dst))
+		if srcsem != nil {
+			srcsem <- struct{}{}
+			defer func() { <-srcsem }()
+		}
+		if dstsem != nil {
+			dstsem <- struct{}{}
+			defer func() { <-dstsem }()
+		}
+
+		f()
+	}()
+}
+
+// Return a channel closed once a and b are both closed. A nil channel counts as
+// closed.
+func Both(a, b <-chan struct{}) <-chan struct{} {
+	if a == nil {
+		return b
+	} else if b == nil {
+		return a
+	}
+	c := make(chan struct{})
+	go func() {
+		<-a
+		<-b
+		close(c)
+	}()
+	return c
+}
+
+// Wait for all the jobs to complete
+func (p *Pool) Wait() {
+	p.wg.Wait()
+}
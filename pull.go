@@ -6,7 +6,9 @@ import (
 	"os"
 	"strings"
 
+	"github.com/mildred/doc/api"
 	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/plan"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
@@ -22,6 +24,36 @@ modified since last commit. It is assumed that no file is modified.
 
 You should run doc commit on the destination directory afterwards.
 
+Files ignored by the .docignore files of the source or the destination are not
+copied, unless -no-docignore is given.
+
+When a file differs in the destination, the new version is copied under a
+conflict name.
+
+With -j, several files are copied at the same time. -per-src and -per-dst limit
+the number of concurrent copies reading from or writing to the same device.
+
+With -safe-names, names that FAT, exFAT and NTFS do not accept are rewritten:
+the characters " * : < > ? \ | and control characters, and a trailing space or
+dot, are replaced by private use characters, a private use character is added
+to device names such as CON, NUL or aux.txt, and names too long are shortened.
+Conflict names are rewritten the same way. The original names are kept in the
+target .doccommit: later copies match the files by their original names, and
+copying them back restores these names. Only push and pull rewrite names, cp
+and sync do not.
+
+With -mirror, the committed target files that are not in the source, or whose
+content differs, are moved to the trash in .dirstore/trash instead of being kept
+as conflicts. Target files not committed are moved to the trash as well, unless
+they are ignored by .docignore files. The trash is never emptied on its own, use
+doc trash empty -keep AGE to only keep a retention period.
+
+With -plan FILE, nothing is copied and the files to copy are written to FILE
+instead, one per line with their source, destination, hash, size and conflict
+flag. The plan can be reviewed and edited, then copied with -apply FILE. Nothing
+is copied if a source no longer has its planned hash or if a destination changed
+since.
+
 Options:
 `
 
@@ -29,11 +61,34 @@ func mainPull(args []string) int {
 	f := flag.NewFlagSet("pull", flag.ExitOnError)
 	opt_quiet := f.Bool("q", false, "Quiet about attribute errors")
 	opt_verbose := f.Bool("v", false, "Print a log of operations")
+	opt_jobs := f.Int("j", 1, "Number of files to copy concurrently")
+	opt_per_src := f.Int("per-src", 0, "Maximum concurrent copies from the same device (0 for no limit)")
+	opt_per_dst := f.Int("per-dst", 0, "Maximum concurrent copies to the same device (0 for no limit)")
+	opt_plan := f.String("plan", "", "Write the files to copy to this plan file instead of copying them")
+	opt_apply := f.String("apply", "", "Copy the files of this plan file, unless the files changed since")
+	opt_mirror := f.Bool("mirror", false, "Move to the trash the target files not in the source")
+	opt_nodocignore := f.Bool("no-docignore", false, "Don't respect .docignore")
+	opt_safe_names := f.Bool("safe-names", false, "Rewrite the names FAT, exFAT and NTFS do not accept")
 	f.Usage = func() {
 		fmt.Print(pullPushUsage)
 		f.PrintDefaults()
 	}
 	f.Parse(args)
+	opts := copy.Options{
+		Jobs:        *opt_jobs,
+		PerSource:   *opt_per_src,
+		PerDest:     *opt_per_dst,
+		Mirror:      *opt_mirror,
+		NoDocIgnore: *opt_nodocignore,
+		SafeNames:   *opt_safe_names,
+	}
+	if *opt_mirror && (*opt_plan != "" || *opt_apply != "") {
+		fmt.Fprintf(os.Stderr, "-mirror cannot be used with -plan or -apply\n")
+		return 1
+	} else if *opt_apply != "" {
+		return applyPullPush("pull", *opt_apply, *opt_quiet, *opt_verbose, opts)
+	}
+
 	var src, target string
 	if f.NArg() == 1 {
 		target = "."
@@ -46,18 +101,44 @@ func mainPull(args []string) int {
 		return 1
 	}
 
-	return pullPush(src, target, *opt_quiet, *opt_verbose, false)
+	if *opt_plan != "" {
+		return planPullPush("pull", src, target, *opt_plan, *opt_quiet, opts)
+	}
+	return pullPush(src, target, *opt_quiet, *opt_verbose, opts)
 }
 
 func mainPush(args []string) int {
 	f := flag.NewFlagSet("pull", flag.ExitOnError)
 	opt_quiet := f.Bool("q", false, "Quiet about attribute errors")
 	opt_verbose := f.Bool("v", false, "Print a log of operations")
+	opt_jobs := f.Int("j", 1, "Number of files to copy concurrently")
+	opt_per_src := f.Int("per-src", 0, "Maximum concurrent copies from the same device (0 for no limit)")
+	opt_per_dst := f.Int("per-dst", 0, "Maximum concurrent copies to the same device (0 for no limit)")
+	opt_plan := f.String("plan", "", "Write the files to copy to this plan file instead of copying them")
+	opt_apply := f.String("apply", "", "Copy the files of this plan file, unless the files changed since")
+	opt_mirror := f.Bool("mirror", false, "Move to the trash the target files not in the source")
+	opt_nodocignore := f.Bool("no-docignore", false, "Don't respect .docignore")
+	opt_safe_names := f.Bool("safe-names", false, "Rewrite the names FAT, exFAT and NTFS do not accept")
 	f.Usage = func() {
 		fmt.Print(pullPushUsage)
 		f.PrintDefaults()
 	}
 	f.Parse(args)
+	opts := copy.Options{
+		Jobs:        *opt_jobs,
+		PerSource:   *opt_per_src,
+		PerDest:     *opt_per_dst,
+		Mirror:      *opt_mirror,
+		NoDocIgnore: *opt_nodocignore,
+		SafeNames:   *opt_safe_names,
+	}
+	if *opt_mirror && (*opt_plan != "" || *opt_apply != "") {
+		fmt.Fprintf(os.Stderr, "-mirror cannot be used with -plan or -apply\n")
+		return 1
+	} else if *opt_apply != "" {
+		return applyPullPush("push", *opt_apply, *opt_quiet, *opt_verbose, opts)
+	}
+
 	var src, target string
 	if f.NArg() == 1 {
 		src = "."
@@ -70,24 +151,66 @@ func mainPush(args []string) int {
 		return 1
 	}
 
-	return pullPush(src, target, *opt_quiet, *opt_verbose, false)
+	if *opt_plan != "" {
+		return planPullPush("push", src, target, *opt_plan, *opt_quiet, opts)
+	}
+	return pullPush(src, target, *opt_quiet, *opt_verbose, opts)
 }
 
-func pullPush(src, target string, quiet bool, verb, renames bool) int {
+func pullPush(src, target string, quiet bool, verb bool, opts copy.Options) int {
 	p := newPullProgress(verb)
 
 	res := 0
-	err, errs := copy.Copy(src, target, p, renames)
+	_, err, errs := api.Push(interrupt, src, target, api.PushOptions{Options: opts, Progress: p})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
 		res = 1
 	}
+	printWarnings(errs, quiet)
+	return res
+}
+
+func printWarnings(errs []error, quiet bool) {
 	if !quiet && len(errs) > 0 {
 		fmt.Fprintf(os.Stderr, "\n")
 		for _, e := range errs {
 			fmt.Fprintf(os.Stderr, "W: %s\n", e.Error())
 		}
 	}
+}
+
+func planPullPush(command, src, target, planFile string, quiet bool, opts copy.Options) int {
+	p, err, errs := copy.PlanCopy(command, src, target, opts)
+	if err == nil {
+		err = plan.WriteFile(planFile, p)
+	}
+	printWarnings(errs, quiet)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%d files to copy written to %s\n", len(p.Actions), planFile)
+	return 0
+}
+
+func applyPullPush(command, planFile string, quiet bool, verb bool, opts copy.Options) int {
+	p, err := plan.ReadFile(planFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	} else if p.Command != "pull" && p.Command != "push" {
+		fmt.Fprintf(os.Stderr, "%s: plan of doc %s cannot be applied by doc %s\n", planFile, p.Command, command)
+		return 1
+	}
+
+	res := 0
+	opts.Context = interrupt
+	err, errs := copy.ApplyPlan(p, newPullProgress(verb), opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		res = 1
+	}
+	printWarnings(errs, quiet && err == nil)
 	return res
 }
 
@@ -0,0 +1,176 @@
+package repo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	docattr "github.com/mildred/doc/docattr"
+)
+
+// Conflict file names are made from a template where these variables are
+// replaced:
+//
+//	{file}   the name of the original file
+//	{name}   the name of the original file without its extension
+//	{ext}    the extension of the original file, with its dot
+//	{hash}   the hash of the conflicting version
+//	{short}  the first 8 characters of the hash
+//	{host}   the host name of the computer making the copy
+//	{repo}   the name of the source repository
+//	{date}   the date of the copy, as 2006-01-02
+//	{time}   the date and time of the copy, as 20060102-150405
+//	{n}      a counter, starting at 1
+//
+// When the name is taken, the counter is incremented. Templates without {n}
+// get a counter inserted before the extension instead.
+const DefaultConflictName = "{file}.{hash}{ext}"
+
+// File in .dirstore holding the conflict name template of the repository
+const ConflictNameFile = "conflict-name"
+
+// Attribute of the .docattr files holding the conflict name template of the
+// files it applies to. It takes precedence over the repository template.
+const ConflictNameAttr = "conflict-name"
+
+// Names the conflict files created while copying from a source repository
+type ConflictNamer struct {
+	// Template of the destination repository, DefaultConflictName if empty
+	Template string
+
+	Host string
+	Repo string
+	Time time.Time
+
+	// Rewrites the names made from the template if not nil, the counter is
+	// incremented until the rewritten name is free
+	Rewrite func(name string) string
+}
+
+// Return the namer for the conflicts created in dst when copying from src
+func NewConflictNamer(src, dst string) ConflictNamer {
+	host, _ := os.Hostname()
+	n := ConflictNamer{
+		Host: host,
+		Repo: repoName(src),
+		Time: time.Now(),
+	}
+	if store := attrs.FindDirStore(dst); store != "" {
+		data, err := ioutil.ReadFile(filepath.Join(store, ConflictNameFile))
+		if err == nil {
+			n.Template = strings.TrimSpace(string(data))
+		}
+	}
+	return n
+}
+
+// Return the name of the repository containing path: the name of the directory
+// holding the .dirstore, or of path itself
+func repoName(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	if store := attrs.FindDirStore(path); store != "" {
+		path = filepath.Dir(store)
+	}
+	return filepath.Base(path)
+}
+
+// Return the template for the conflicts of path
+func (n ConflictNamer) template(path string) string {
+	if t := docattr.Get(path, ConflictNameAttr); t != "" {
+		return t
+	} else if n.Template != "" {
+		return n.Template
+	}
+	return DefaultConflictName
+}
+
+// Return the i-th candidate name for a conflict file of path with the given
+// hash, starting from 0
+func (n ConflictNamer) Name(path string, digest []byte, i int) string {
+	return n.expand(n.template(path), path, digest, i)
+}
+
+func (n ConflictNamer) expand(template, path string, digest []byte, i int) string {
+	file := filepath.Base(path)
+	ext := filepath.Ext(file)
+	hash := base58.Encode(digest)
+	short := hash
+	if len(short) > 8 {
+		short = short[:8]
+	}
+
+	if hash == "" {
+		// No hash for directories
+		template = strings.Replace(template, ".{hash}", "", -1)
+	}
+
+	counted := strings.Contains(template, "{n}")
+	name := strings.NewReplacer(
+		"{file}", file,
+		"{name}", strings.TrimSuffix(file, ext),
+		"{ext}", ext,
+		"{hash}", hash,
+		"{short}", short,
+		"{host}", n.Host,
+		"{repo}", n.Repo,
+		"{date}", n.Time.Format("2006-01-02"),
+		"{time}", n.Time.Format("20060102-150405"),
+		"{n}", strconv.Itoa(i+1),
+	).Replace(template)
+
+	// The conflict stays next to the original file
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		name = file
+	}
+
+	if i > 0 && !counted {
+		count := "." + strconv.Itoa(i-1)
+		if ext != "" && strings.HasSuffix(name, ext) {
+			name = strings.TrimSuffix(name, ext) + count + ext
+		} else {
+			name = name + count
+		}
+	}
+	if n.Rewrite != nil {
+		name = n.Rewrite(name)
+	}
+	return filepath.Join(filepath.Dir(path), name)
+}
+
+// Return the names the conflict files of path with the version digest may
+// have, whatever the template that named them: the alternatives recorded on
+// path and the default name
+func ConflictNames(path string, digest []byte) []string {
+	var names []string
+	dir := filepath.Dir(path)
+	for _, alt := range ConflictFileAlternatives(path) {
+		names = append(names, filepath.Join(dir, alt))
+	}
+	return append(names, ConflictNamer{}.expand(DefaultConflictName, path, digest, 0))
+}
+
+// Return true if a conflict file of path already holds the version digest. The
+// conflict files are hashed if needed, there are usually few of them.
+func HasConflict(path string, digest []byte) bool {
+	for _, name := range ConflictNames(path, digest) {
+		info, err := os.Lstat(name)
+		if err != nil {
+			continue
+		}
+		hash, err := GetHash(name, info, true)
+		if err == nil && bytes.Equal(hash, digest) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package repo
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+)
+
+func TestConflictNamerExpand(t *testing.T) {
+	digest := []byte{0x11, 0x14, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	hash := base58.Encode(digest)
+	n := ConflictNamer{
+		Host: "box/1",
+		Repo: "photos",
+		Time: time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC),
+	}
+
+	tests := []struct {
+		template string
+		path     string
+		digest   []byte
+		i        int
+		name     string
+	}{
+		{DefaultConflictName, "dir/a.txt", digest, 0, "dir/a.txt." + hash + ".txt"},
+		{DefaultConflictName, "dir/a.txt", digest, 1, "dir/a.txt." + hash + ".0.txt"},
+		{DefaultConflictName, "dir/a.txt", digest, 2, "dir/a.txt." + hash + ".1.txt"},
+		{DefaultConflictName, "Makefile", digest, 0, "Makefile." + hash},
+		{DefaultConflictName, "Makefile", digest, 1, "Makefile." + hash + ".0"},
+		{DefaultConflictName, "a.tar.gz", digest, 0, "a.tar.gz." + hash + ".gz"},
+
+		// Directories have no hash
+		{DefaultConflictName, "dir/sub", nil, 0, "dir/sub"},
+		{DefaultConflictName, "dir/sub", nil, 1, "dir/sub.0"},
+
+		{"{name}-{n}{ext}", "a.txt", digest, 0, "a-1.txt"},
+		{"{name}-{n}{ext}", "a.txt", digest, 1, "a-2.txt"},
+		{"{name}.{short}{ext}", "a.txt", digest, 0, "a." + hash[:8] + ".txt"},
+		{"{name}.{host}-{date}{ext}", "a.txt", digest, 0, "a.box_1-2020-03-04.txt"},
+		{"{name}.{repo}-{time}{ext}", "a.txt", digest, 1, "a.photos-20200304-050607.0.txt"},
+		{"{file}~", "a.txt", digest, 1, "a.txt~.0"},
+
+		// Names that cannot be used fall back to the file name
+		{"{ext}", "Makefile", digest, 0, "Makefile"},
+		{"..", "a.txt", digest, 0, "a.txt"},
+	}
+	for _, tt := range tests {
+		if name := n.expand(tt.template, tt.path, tt.digest, tt.i); name != tt.name {
+			t.Errorf("%q for %q, %d: %q, want %q", tt.template, tt.path, tt.i, name, tt.name)
+		}
+	}
+
+	// Rewritten names keep their counter
+	n.Rewrite = strings.ToUpper
+	if name := n.expand(DefaultConflictName, "dir/a.txt", digest, 1); name != "dir/"+strings.ToUpper("a.txt."+hash+".0.txt") {
+		t.Errorf("rewritten name %q", name)
+	}
+}
@@ -7,11 +7,12 @@ import (
 	"path/filepath"
 	"syscall"
 
-	base58 "github.com/jbenet/go-base58"
 	attrs "github.com/mildred/doc/attrs"
 )
 
-func MarkConflict(parentfile, dstpath string) []error {
+// Mark dstpath as a conflict alternative of parentfile for the version digest.
+// Once dstpath is complete, the conflict is recorded by RecordConflict.
+func MarkConflict(parentfile, dstpath string, digest []byte) []error {
 	var errs []error
 	// FIXME: mark conflicts for symlinks as well when the syscall is
 	// available
@@ -22,7 +23,7 @@ func MarkConflict(parentfile, dstpath string) []error {
 		if err != nil {
 			errs = append(errs, fmt.Errorf("%s: could not mark conflict: %s", dstpath, err.Error()))
 		}
-	} else {
+	} else if err != nil {
 		errs = append(errs, err)
 	}
 
@@ -32,7 +33,7 @@ func MarkConflict(parentfile, dstpath string) []error {
 		if err != nil {
 			errs = append(errs, fmt.Errorf("%s: could add conflict alternative: %s", dstpath, err.Error()))
 		}
-	} else {
+	} else if err != nil {
 		errs = append(errs, err)
 	}
 	return errs
@@ -64,7 +65,14 @@ func MarkConflictFor(path, conflictName string) error {
 	return attrs.Set(path, XattrConflict, []byte(conflictName))
 }
 
+// Add alternativeName to the conflict alternatives of path, unless it is
+// already listed
 func AddConflictAlternative(path, alternativeName string) error {
+	for _, alt := range ConflictFileAlternatives(path) {
+		if alt == alternativeName {
+			return nil
+		}
+	}
 	for i := 0; true; i++ {
 		err := attrs.Create(path, fmt.Sprintf("%s.%d", XattrConflict, i), []byte(alternativeName))
 		if err == nil {
@@ -78,27 +86,63 @@ func AddConflictAlternative(path, alternativeName string) error {
 	return nil
 }
 
-// Return a conflict filename to use. Return the empty string if the conflict
-// file already exists for the same hash.
-func FindConflictFileName(path string, digest []byte) string {
-	hashname := base58.Encode(digest)
-	hashext := ""
-	if len(hashname) != 0 {
-		hashext = "." + hashname
+// Remove alternativeName from the conflict alternatives of path. The remaining
+// alternatives are renumbered.
+func RemoveConflictAlternative(path, alternativeName string) error {
+	alternatives := ConflictFileAlternatives(path)
+	var keep []string
+	for _, alt := range alternatives {
+		if alt != alternativeName {
+			keep = append(keep, alt)
+		}
+	}
+	if len(keep) == len(alternatives) {
+		return nil
+	}
+
+	for i, alt := range keep {
+		err := attrs.Set(path, fmt.Sprintf("%s.%d", XattrConflict, i), []byte(alt))
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(keep); i < len(alternatives); i++ {
+		err := attrs.Remove(path, fmt.Sprintf("%s.%d", XattrConflict, i))
+		if err != nil && !IsNoData(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the first name given by n that is not taken, to move path aside or to
+// copy another version next to it
+func FreeConflictFileName(path string, digest []byte, n ConflictNamer) string {
+	for i := 0; true; i++ {
+		name := n.Name(path, digest, i)
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Return a conflict filename to use, named by n. Return the empty string if a
+// conflict file already exists for the same hash, or existed and was dismissed.
+func FindConflictFileName(path string, digest []byte, n ConflictNamer) string {
+	if HasConflict(path, digest) || ConflictRecorded(path, digest) {
+		return ""
 	}
-	ext := filepath.Ext(path)
-	dstname := fmt.Sprintf("%s%s%s", path, hashext, ext)
-	i := 0
-	for {
+	for i := 0; true; i++ {
+		dstname := n.Name(path, digest, i)
 		info, err := os.Lstat(dstname)
 		if os.IsNotExist(err) {
 			return dstname
 		}
-		hash, err := GetHash(dstname, info, false)
+		hash, err := GetHash(dstname, info, true)
 		if err == nil && bytes.Equal(hash, digest) {
 			return ""
 		}
-		dstname = fmt.Sprintf("%s%s.%d%s", path, hashext, i, ext)
-		i++
 	}
+	return ""
 }
@@ -0,0 +1,164 @@
+package repo
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	gosync "sync"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+)
+
+// Name of the file in the dirstore listing the conflicts created, one per line
+// with the hash of the conflicting version and the quoted path of the original
+// file relative to the repository root. A conflict listed there whose file is
+// gone was dismissed, and is not created again.
+const ConflictLogName string = "conflicts"
+
+// Conflicts created, by dirstore, read once per process
+var (
+	conflictLogMu gosync.Mutex
+	conflictLogs  = map[string]map[string]bool{}
+)
+
+// Return the conflict log of the repository containing path and the path
+// relative to the repository root. The log is nil if there is no dirstore.
+func conflictLog(path string) (string, string, map[string]bool, error) {
+	dirstore := attrs.FindDirStore(filepath.Dir(path))
+	if dirstore == "" {
+		return "", "", nil, nil
+	}
+	dirstore, err := filepath.Abs(dirstore)
+	if err != nil {
+		return "", "", nil, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", "", nil, err
+	}
+	rel, err := filepath.Rel(filepath.Dir(dirstore), abs)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	logfile := filepath.Join(dirstore, ConflictLogName)
+	if log, ok := conflictLogs[logfile]; ok {
+		return logfile, rel, log, nil
+	}
+
+	log := map[string]bool{}
+	f, err := os.Open(logfile)
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", nil, err
+	} else if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.SplitN(scanner.Text(), "\t", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			if p, err := strconv.Unquote(fields[1]); err == nil {
+				log[fields[0]+"\t"+p] = true
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", "", nil, err
+		}
+	}
+	conflictLogs[logfile] = log
+	return logfile, rel, log, nil
+}
+
+// Record that a conflict of path was created for the version digest. Nothing
+// is recorded if there is no dirstore.
+func RecordConflict(path string, digest []byte) error {
+	conflictLogMu.Lock()
+	defer conflictLogMu.Unlock()
+
+	logfile, rel, log, err := conflictLog(path)
+	if err != nil || log == nil || len(digest) == 0 {
+		return err
+	}
+	key := base58.Encode(digest) + "\t" + rel
+	if log[key] {
+		return nil
+	}
+
+	f, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s\t%s\n", base58.Encode(digest), strconv.Quote(rel))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		log[key] = true
+	}
+	return err
+}
+
+// Remove the record of the conflict of path for the version digest, when the
+// conflict file could not be created after all
+func ForgetConflict(path string, digest []byte) error {
+	conflictLogMu.Lock()
+	defer conflictLogMu.Unlock()
+
+	logfile, rel, log, err := conflictLog(path)
+	key := base58.Encode(digest) + "\t" + rel
+	if err != nil || !log[key] {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSuffix(line, "\n"), "\t", 2)
+		if len(fields) == 2 && fields[0]+"\t"+unquote(fields[1]) == key {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	tmp := logfile + ".new"
+	err = ioutil.WriteFile(tmp, []byte(strings.Join(lines, "")), 0666)
+	if err == nil {
+		err = os.Rename(tmp, logfile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	delete(log, key)
+	return nil
+}
+
+func unquote(s string) string {
+	if u, err := strconv.Unquote(s); err == nil {
+		return u
+	}
+	return s
+}
+
+// Return true if a conflict of path was created before for the version digest.
+// Unless HasConflict is true, the conflict was dismissed: its file was renamed,
+// removed or resolved.
+func ConflictRecorded(path string, digest []byte) bool {
+	conflictLogMu.Lock()
+	defer conflictLogMu.Unlock()
+
+	_, rel, log, err := conflictLog(path)
+	return err == nil && log[base58.Encode(digest)+"\t"+rel]
+}
@@ -8,8 +8,12 @@ import (
 	"syscall"
 	"time"
 
+	base58 "github.com/jbenet/go-base58"
 	mh "github.com/jbenet/go-multihash"
 	attrs "github.com/mildred/doc/attrs"
+	events "github.com/mildred/doc/events"
+	sparse "github.com/mildred/doc/sparse"
+	throttle "github.com/mildred/doc/throttle"
 )
 
 const XattrHash string = "user.doc.multihash"
@@ -29,7 +33,21 @@ func GetHashTime(path string) (time.Time, error) {
 	return time.Parse(time.RFC3339Nano, string(hashTimeStr))
 }
 
+// Compute the hash of path, emitting a FileHashed event
 func HashFile(path string, info os.FileInfo) (mh.Multihash, error) {
+	digest, err := hashFile(path, info)
+	if err == nil && events.Enabled() {
+		events.Emit(events.Event{
+			Type: events.FileHashed,
+			Path: path,
+			Hash: base58.Encode(digest),
+			Size: info.Size(),
+		})
+	}
+	return digest, err
+}
+
+func hashFile(path string, info os.FileInfo) (mh.Multihash, error) {
 	if info.Mode()&os.ModeSymlink != 0 {
 		return symlinkHash(path)
 	}
@@ -40,8 +58,15 @@ func HashFile(path string, info os.FileInfo) (mh.Multihash, error) {
 	}
 	defer f.Close()
 
+	// Holes are hashed as zeros without reading them
+	r, err := sparse.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	throttle.File()
 	hasher := sha1.New()
-	_, err = io.Copy(hasher, f)
+	_, err = io.Copy(hasher, throttle.Reader(r))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,238 @@
+package repo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	fastcopy "github.com/mildred/doc/fastcopy"
+)
+
+// Name of the object store directory inside the dirstore
+const ObjectsDirName string = "objects"
+
+var ErrObjectMissing = errors.New("Object not in store")
+
+// Content addressed store of file contents in the dirstore. Objects are named
+// after the base58 multihash of their content and are read only.
+type ObjectStore struct {
+	path string
+}
+
+// Return the object store of the repository containing path, nil if the
+// repository has no object store.
+func GetObjectStore(path string) *ObjectStore {
+	dirstore := attrs.FindDirStore(path)
+	if dirstore == "" {
+		return nil
+	}
+	store := filepath.Join(dirstore, ObjectsDirName)
+	if st, err := os.Stat(store); err != nil || !st.IsDir() {
+		return nil
+	}
+	return &ObjectStore{store}
+}
+
+// Create the object store in the given dirstore
+func InitObjectStore(dirstore string) (*ObjectStore, error) {
+	store := filepath.Join(dirstore, ObjectsDirName)
+	err := os.MkdirAll(store, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStore{store}, nil
+}
+
+func (s *ObjectStore) ObjectFile(digest []byte) string {
+	return filepath.Join(s.path, base58.Encode(digest))
+}
+
+func (s *ObjectStore) Has(digest []byte) bool {
+	if len(digest) == 0 {
+		return false
+	}
+	_, err := os.Lstat(s.ObjectFile(digest))
+	return err == nil
+}
+
+// Return the list of digests in the store
+func (s *ObjectStore) List() ([][]byte, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var res [][]byte
+	for _, name := range names {
+		if strings.HasPrefix(name, "temp") {
+			continue
+		}
+		digest := base58.Decode(name)
+		if len(digest) > 0 {
+			res = append(res, digest)
+		}
+	}
+	return res, nil
+}
+
+func (s *ObjectStore) Open(digest []byte) (*os.File, error) {
+	f, err := os.Open(s.ObjectFile(digest))
+	if os.IsNotExist(err) {
+		return nil, ErrObjectMissing
+	}
+	return f, err
+}
+
+// Store the content of path in the object store. The file content is checked
+// against digest while it is copied. Return false if the object already
+// existed.
+func (s *ObjectStore) Add(path string, info os.FileInfo, digest []byte) (bool, error) {
+	if !info.Mode().IsRegular() {
+		return false, fmt.Errorf("%s: only regular files can be stored", path)
+	}
+	if s.Has(digest) {
+		return false, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	f, err := ioutil.TempFile(s.path, "temp")
+	if err != nil {
+		return false, err
+	}
+	fname := f.Name()
+	defer func() {
+		if fname != "" {
+			os.Remove(fname)
+		}
+	}()
+
+	_, err = fastcopy.Copy(f, src, 0)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return false, err
+	}
+
+	tmpinfo, err := os.Lstat(fname)
+	if err != nil {
+		return false, err
+	}
+	actual, err := HashFile(fname, tmpinfo)
+	if err != nil {
+		return false, err
+	} else if !bytes.Equal(actual, digest) {
+		return false, fmt.Errorf("%s: modified while storing, hash mismatch", path)
+	}
+
+	// Keep the file times and permissions, without write permission
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+		err = os.Chtimes(fname, atime, info.ModTime())
+		if err != nil {
+			return false, err
+		}
+	}
+	tmpinfo, err = os.Lstat(fname)
+	if err == nil {
+		_, err = CommitFileHash(fname, tmpinfo, digest, false)
+	}
+	if err == nil {
+		err = os.Chmod(fname, info.Mode().Perm()&^0222)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Rename(fname, s.ObjectFile(digest))
+	if err != nil {
+		return false, err
+	}
+	fname = ""
+	return true, nil
+}
+
+// Place the object in the tree at dst, either as a hard link (the file will be
+// read only) or as a writable copy. dst must not exist, a copy is only renamed
+// to dst once complete.
+func (s *ObjectStore) Checkout(digest []byte, dst string, link bool) error {
+	if link {
+		if _, err := os.Lstat(s.ObjectFile(digest)); os.IsNotExist(err) {
+			return ErrObjectMissing
+		}
+		return os.Link(s.ObjectFile(digest), dst)
+	}
+
+	fname, err := s.CheckoutTemp(digest, dst)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Lstat(dst); err == nil {
+		err = fmt.Errorf("%s: already exists", dst)
+	} else if os.IsNotExist(err) {
+		err = os.Rename(fname, dst)
+	}
+	if err != nil {
+		os.Remove(fname)
+	}
+	return err
+}
+
+// Copy the object to a temporary file in the directory of dst, writable and
+// with its hash recorded, and return its name. The file is removed on error.
+func (s *ObjectStore) CheckoutTemp(digest []byte, dst string) (string, error) {
+	obj := s.ObjectFile(digest)
+	info, err := os.Lstat(obj)
+	if os.IsNotExist(err) {
+		return "", ErrObjectMissing
+	} else if err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dst), ".doctemp")
+	if err != nil {
+		return "", err
+	}
+	fname := f.Name()
+	f.Close()
+	os.Remove(fname)
+
+	_, err = fastcopy.CopyFile(obj, fname, info.Mode().Perm()|0200)
+	if err == nil {
+		err = os.Chtimes(fname, time.Now(), info.ModTime())
+	}
+	if err == nil {
+		info, err = os.Lstat(fname)
+	}
+	if err == nil {
+		_, err = CommitFileHash(fname, info, digest, false)
+	}
+	if err != nil {
+		os.Remove(fname)
+		return "", err
+	}
+	return fname, nil
+}
+
+func (s *ObjectStore) Remove(digest []byte) error {
+	return os.Remove(s.ObjectFile(digest))
+}
@@ -7,6 +7,7 @@ import (
 
 	base58 "github.com/jbenet/go-base58"
 	attrs "github.com/mildred/doc/attrs"
+	throttle "github.com/mildred/doc/throttle"
 )
 
 type Par2Repo struct {
@@ -49,6 +50,11 @@ func (r *Par2Repo) Create(path string, digest []byte) error {
 		return err
 	}
 	defer os.Remove(hashFile)
+
+	// par2create reads the file itself, several times and seeking, its reads
+	// cannot be paced and are not counted against the read limit
+	throttle.File()
+
 	cmd := exec.Command("par2create", "--", par2file, hashFile)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
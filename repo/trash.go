@@ -0,0 +1,204 @@
+package repo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	attrs "github.com/mildred/doc/attrs"
+)
+
+// Name of the trash directory inside the dirstore
+const TrashDirName string = "trash"
+
+// Layout of the trash batch names: files moved to the trash together are kept
+// in a directory named after the time they were moved. The name must be valid
+// on FAT and exFAT filesystems.
+const TrashTimeLayout string = "20060102-150405"
+
+// Layout of the trash batch names of older versions, still recognized
+const oldTrashTimeLayout string = "2006-01-02T15:04:05"
+
+// Files removed from the tree, kept in the dirstore with their path relative
+// to the repository root
+type Trash struct {
+	path string
+	root string
+}
+
+// Return the trash of the repository containing path, nil if there is no
+// dirstore. The trash directory is created when files are moved to it.
+func GetTrash(path string) *Trash {
+	dirstore := attrs.FindDirStore(path)
+	if dirstore == "" {
+		return nil
+	}
+	if abs, err := filepath.Abs(dirstore); err == nil {
+		dirstore = abs
+	}
+	return &Trash{filepath.Join(dirstore, TrashDirName), filepath.Dir(dirstore)}
+}
+
+// Return the repository root the trashed paths are relative to
+func (t *Trash) Root() string {
+	return t.root
+}
+
+// Return the name of a new batch for files trashed at now
+func (t *Trash) NewBatch(now time.Time) string {
+	name := now.Format(TrashTimeLayout)
+	batch := name
+	for i := 1; true; i++ {
+		if _, err := os.Lstat(filepath.Join(t.path, batch)); os.IsNotExist(err) {
+			break
+		}
+		batch = fmt.Sprintf("%s.%d", name, i)
+	}
+	return batch
+}
+
+// Return the time files of the batch were trashed at
+func BatchTime(batch string) (time.Time, error) {
+	when, _, err := parseBatch(batch)
+	return when, err
+}
+
+// Return the time of the batch and its counter, 0 for the first batch of a
+// given time
+func parseBatch(batch string) (time.Time, int, error) {
+	n := 0
+	if i := strings.LastIndex(batch, "."); i != -1 {
+		var err error
+		if n, err = strconv.Atoi(batch[i+1:]); err != nil {
+			return time.Time{}, 0, fmt.Errorf("%s: invalid trash batch name", batch)
+		}
+		batch = batch[:i]
+	}
+	when, err := time.ParseInLocation(TrashTimeLayout, batch, time.Local)
+	if err != nil {
+		when, err = time.ParseInLocation(oldTrashTimeLayout, batch, time.Local)
+	}
+	return when, n, err
+}
+
+// Return the path of the trashed file rel in batch
+func (t *Trash) File(batch, rel string) string {
+	return filepath.Join(t.path, batch, rel)
+}
+
+// Move path to the batch and return its new path
+func (t *Trash) Move(batch, path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(t.root, abs)
+	if err != nil {
+		return "", err
+	} else if rel == "." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: not in repository %s", path, t.root)
+	}
+
+	dst := t.File(batch, rel)
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("%s: already in the trash", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return "", err
+	}
+	return dst, os.Rename(abs, dst)
+}
+
+// Move back the file rel of the batch to the repository, unless a file exists
+// there. Return the restored path.
+func (t *Trash) Restore(batch, rel string) (string, error) {
+	dst := filepath.Join(t.root, rel)
+	if _, err := os.Lstat(dst); err == nil {
+		return "", fmt.Errorf("%s: already exists", dst)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return "", err
+	}
+	src := t.File(batch, rel)
+	if err := os.Rename(src, dst); err != nil {
+		return "", err
+	}
+
+	// Remove the directories left empty in the batch
+	for dir := filepath.Dir(src); dir != t.path; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return dst, nil
+}
+
+// Return the batch names, oldest first
+func (t *Trash) Batches() ([]string, error) {
+	f, err := os.Open(t.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	times := map[string]time.Time{}
+	counters := map[string]int{}
+	for _, name := range names {
+		if when, n, err := parseBatch(name); err == nil {
+			res = append(res, name)
+			times[name], counters[name] = when, n
+		}
+	}
+	// Batches named in both layouts are sorted by time
+	sort.Slice(res, func(i, j int) bool {
+		ti, tj := times[res[i]], times[res[j]]
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return counters[res[i]] < counters[res[j]]
+	})
+	return res, nil
+}
+
+// Return the paths of the files in the batch, relative to the repository root
+func (t *Trash) Files(batch string) ([]string, error) {
+	var res []string
+	dir := filepath.Join(t.path, batch)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		} else if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err == nil {
+			res = append(res, rel)
+		}
+		return err
+	})
+	return res, err
+}
+
+// Delete the batch and its files
+func (t *Trash) Remove(batch string) error {
+	dir := filepath.Join(t.path, batch)
+	// Read only directories cannot be emptied
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, info.Mode()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
@@ -0,0 +1,60 @@
+package repo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBatchTime(t *testing.T) {
+	when := time.Date(2020, 3, 4, 5, 6, 7, 0, time.Local)
+	tests := []struct {
+		batch string
+		ok    bool
+	}{
+		{"20200304-050607", true},
+		{"20200304-050607.2", true},
+		{"2020-03-04T05:06:07", true},
+		{"2020-03-04T05:06:07.1", true},
+		{"20200304-050607.x", false},
+		{"tmp", false},
+	}
+	for _, tt := range tests {
+		batch, err := BatchTime(tt.batch)
+		if ok := err == nil; ok != tt.ok || ok && !batch.Equal(when) {
+			t.Errorf("BatchTime(%q) = %v, %v", tt.batch, batch, err)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "doctest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	trash := &Trash{dir, filepath.Dir(dir)}
+	names := []string{"20200304-050607.10", "2020-03-04T05:06:07", "20200101-000000", "20200304-050607.2", "other"}
+	for _, name := range names {
+		if err := os.Mkdir(filepath.Join(dir, name), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batches, err := trash.Batches()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"20200101-000000", "2020-03-04T05:06:07", "20200304-050607.2", "20200304-050607.10"}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("batches %q, want %q", batches, want)
+	}
+
+	if batch := trash.NewBatch(time.Date(2020, 1, 1, 0, 0, 0, 0, time.Local)); batch != "20200101-000000.1" {
+		t.Errorf("new batch %q", batch)
+	}
+}
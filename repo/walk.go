@@ -1,9 +1,13 @@
 package repo
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"syscall"
 
 	attrs "github.com/mildred/doc/attrs"
 )
@@ -15,6 +19,8 @@ type ErrorList []error
 
 var SkipDir error = filepath.SkipDir
 
+var ErrLoop = errors.New("Filesystem loop detected, directory already traversed")
+
 func (el ErrorList) Error() string {
 	var l []string
 	for _, e := range el {
@@ -23,9 +29,155 @@ func (el ErrorList) Error() string {
 	return strings.Join(l, "\n")
 }
 
-func Walk(dir string, wh WalkHandler, eh ErrorHandler) ErrorList {
+// Return true if the error reports a directory that is its own ancestor
+func IsLoop(err error) bool {
+	if e, ok := err.(*os.PathError); ok {
+		err = e.Err
+	}
+	return err == ErrLoop
+}
+
+// Rules to traverse directory trees
+type WalkOptions struct {
+	// Follow symbolic links instead of reporting them as links. Loops are
+	// detected using the device and inode of directories.
+	FollowSymlinks bool
+
+	// Do not descend in directories on another filesystem than the root
+	OneFileSystem bool
+}
+
+// Lstat path, or Stat it when following symlinks. Broken symlinks are
+// returned as symlinks.
+func (o WalkOptions) Stat(path string) (os.FileInfo, error) {
+	info, err := os.Lstat(path)
+	if err == nil && o.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil {
+			return target, nil
+		}
+	}
+	return info, err
+}
+
+// Directories being traversed, from the root to the current directory
+type Visited struct {
+	opts      WalkOptions
+	root      uint64
+	hasRoot   bool
+	ancestors map[string]bool
+}
+
+func (o WalkOptions) NewVisited() *Visited {
+	return &Visited{opts: o, ancestors: map[string]bool{}}
+}
+
+func devIno(info os.FileInfo) (uint64, uint64, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), uint64(st.Ino), true
+	}
+	return 0, 0, false
+}
+
+// Called before traversing the directory path. Return false if the directory
+// must not be traversed because it is on another filesystem, or an error if it
+// is one of its own ancestors. If true is returned, Leave must be called once
+// the directory is traversed.
+func (v *Visited) Enter(path string, info os.FileInfo) (bool, error) {
+	dev, ino, ok := devIno(info)
+	if !ok {
+		return true, nil
+	}
+	if !v.hasRoot {
+		v.root = dev
+		v.hasRoot = true
+	} else if v.opts.OneFileSystem && dev != v.root {
+		return false, nil
+	}
+	key := fmt.Sprintf("%d:%d", dev, ino)
+	if v.ancestors[key] {
+		return false, &os.PathError{Op: "walk", Path: path, Err: ErrLoop}
+	}
+	v.ancestors[key] = true
+	return true, nil
+}
+
+func (v *Visited) Leave(info os.FileInfo) {
+	if dev, ino, ok := devIno(info); ok {
+		delete(v.ancestors, fmt.Sprintf("%d:%d", dev, ino))
+	}
+}
+
+// Like filepath.Walk, with the traversal rules of o. Directories that form a
+// loop are passed to fn with an error matching IsLoop. Directories on another
+// filesystem are passed to fn but not traversed.
+func (o WalkOptions) Walk(root string, fn filepath.WalkFunc) error {
+	info, err := o.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = o.walk(o.NewVisited(), root, info, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func (o WalkOptions) walk(v *Visited, path string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(path, info, nil)
+	}
+
+	descend, err := v.Enter(path, info)
+	if descend {
+		defer v.Leave(info)
+	}
+
+	var names []string
+	if descend && err == nil {
+		names, err = readDirNames(path)
+	}
+	err1 := fn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		fileInfo, err := o.Stat(filename)
+		if err != nil {
+			if err := fn(filename, fileInfo, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+		} else {
+			err = o.walk(v, filename, fileInfo, fn)
+			if err != nil {
+				if !fileInfo.IsDir() || err != filepath.SkipDir {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(dirname string) ([]string, error) {
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func Walk(dir string, opts WalkOptions, wh WalkHandler, eh ErrorHandler) ErrorList {
 	var el ErrorList = nil
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+	err := opts.Walk(dir, func(path string, info os.FileInfo, err error) error {
 		// Handle first error
 		if err != nil {
 			el = append(el, err)
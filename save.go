@@ -43,15 +43,22 @@ func mainSave(args []string) int {
 
 	status := 0
 
+	saved := 0
+	ignores := ignore.New()
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+		if interrupt.Err() != nil {
+			return interrupt.Err()
+		} else if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
 			status = 1
 			return err
 		}
 
-		if !*opt_nodocignore && ignore.IsIgnored(path) {
-			return filepath.SkipDir
+		if !*opt_nodocignore && ignores.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
 		}
 
 		// Skip .dirstore/ at root
@@ -90,11 +97,15 @@ func mainSave(args []string) int {
 			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
 			return nil
 		}
+		saved++
 
 		return nil
 	})
 
-	if err != nil {
+	if isInterrupt(err) {
+		fmt.Fprintf(os.Stderr, "interrupted after saving %d files\n", saved)
+		return 1
+	} else if err != nil {
 		fmt.Fprintf(os.Stderr, "%v", err)
 		os.Exit(1)
 	}
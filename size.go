@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parse a size in bytes with an optional K, M, G or T suffix (powers of 1024)
+func parseSize(s string) (int64, error) {
+	var mult int64 = 1
+	units := "KMGT"
+	upper := strings.TrimSuffix(strings.ToUpper(s), "B")
+	if len(upper) > 0 {
+		if i := strings.IndexByte(units, upper[len(upper)-1]); i >= 0 {
+			mult = 1 << uint(10*(i+1))
+			upper = upper[:len(upper)-1]
+		}
+	}
+	n, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %#v", s)
+	}
+	return n * mult, nil
+}
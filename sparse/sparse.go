@@ -0,0 +1,112 @@
+// Package sparse locates the holes of sparse files with SEEK_DATA and
+// SEEK_HOLE, so they can be copied and read without touching the disk.
+package sparse
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+var zeros [32 * 1024]byte
+
+// Return the first data segment [start, end) of f at or after off, or io.EOF if
+// there is no data after off. On filesystems that do not report holes, the
+// whole file is data. The file offset is changed.
+func NextData(f *os.File, off int64) (start, end int64, err error) {
+	fd := int(f.Fd())
+	start, err = syscall.Seek(fd, off, seekData)
+	if err == syscall.ENXIO {
+		return 0, 0, io.EOF
+	} else if err == syscall.EINVAL || err == syscall.EOPNOTSUPP {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, 0, err
+		} else if off >= info.Size() {
+			return 0, 0, io.EOF
+		}
+		return off, info.Size(), nil
+	} else if err != nil {
+		return 0, 0, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+	}
+
+	end, err = syscall.Seek(fd, start, seekHole)
+	if err != nil {
+		return 0, 0, &os.PathError{Op: "seek", Path: f.Name(), Err: err}
+	}
+	return start, end, nil
+}
+
+// Number of bytes allocated on disk for the file
+func Allocated(info os.FileInfo) int64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return info.Size()
+}
+
+// Return true if the file has less bytes allocated than its size
+func IsSparse(info os.FileInfo) bool {
+	return info.Mode().IsRegular() && Allocated(info) < info.Size()
+}
+
+// Reader reads a file from the start, returning zeros for its holes instead of
+// reading them from disk
+type Reader struct {
+	f     *os.File
+	size  int64
+	pos   int64
+	start int64
+	end   int64
+}
+
+func NewReader(f *os.File) (*Reader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{f: f, size: info.Size()}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.pos >= r.end {
+		var err error
+		r.start, r.end, err = NextData(r.f, r.pos)
+		if err == io.EOF {
+			r.start, r.end = r.size, r.size
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if r.pos < r.start {
+		n := r.start - r.pos
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		for i := int64(0); i < n; {
+			i += int64(copy(p[i:n], zeros[:]))
+		}
+		r.pos += n
+		return int(n), nil
+	}
+
+	if n := r.end - r.pos; n < int64(len(p)) {
+		p = p[:n]
+	}
+	n, err := r.f.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
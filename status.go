@@ -4,11 +4,9 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"path/filepath"
 
 	base58 "github.com/jbenet/go-base58"
-	attrs "github.com/mildred/doc/attrs"
-	ignore "github.com/mildred/doc/ignore"
+	api "github.com/mildred/doc/api"
 	repo "github.com/mildred/doc/repo"
 )
 
@@ -34,6 +32,8 @@ func mainStatus(args []string) int {
 	opt_no_par2 := f.Bool("n", false, "Do not show files missing PAR2 redundency data")
 	opt_show_only_hash := f.Bool("c", false, "Show only unchanged committed files with their hash")
 	opt_no_docignore := f.Bool("no-docignore", false, "Don't treat .docignore files specially")
+	opt_follow := f.Bool("L", false, "Follow symbolic links")
+	opt_one_fs := f.Bool("x", false, "Don't cross filesystem boundaries")
 	f.Usage = func() {
 		fmt.Print(usageStatus)
 		f.PrintDefaults()
@@ -44,87 +44,59 @@ func mainStatus(args []string) int {
 		dir = "."
 	}
 
-	rep := repo.GetRepo(dir)
-
-	status := 0
+	opts := api.StatusOptions{
+		Par2:        !*opt_show_only_hash,
+		NoDocIgnore: *opt_no_docignore,
+		Walk: repo.WalkOptions{
+			FollowSymlinks: *opt_follow,
+			OneFileSystem:  *opt_one_fs,
+		},
+	}
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
-			status = 1
-			return err
+	opts.Found = func(f api.FileStatus) {
+		if *opt_show_only_hash {
+			if f.Hash != nil {
+				fmt.Printf("%s\t%s\n", base58.Encode(f.Hash), f.Path)
+			}
+			return
 		}
 
-		// Skip directories containing an empty .docignore file
-		if !*opt_no_docignore && ignore.IsIgnored(path) {
-			return filepath.SkipDir
+		var conflict string = ""
+		if f.Alternative {
+			conflict = " c"
+		} else if f.Conflict {
+			conflict = " C"
 		}
 
-		// Skip .dirstore/ at root
-		if filepath.Base(path) == attrs.DirStoreName && filepath.Dir(path) == dir && info.IsDir() {
-			return filepath.SkipDir
-		} else if !info.Mode().IsRegular() {
-			return nil
+		var redundency string = ""
+		if f.Unsaved {
+			redundency = "*"
 		}
 
-		if *opt_show_only_hash {
-			hash, err := repo.GetHash(path, info, false)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
-				return nil
-			}
-
-			if hash != nil {
-				fmt.Printf("%s\t%s\n", base58.Encode(hash), path)
-			}
-
-		} else {
-
-			var conflict string = ""
-			if repo.ConflictFile(path) != "" {
-				conflict = " c"
-			} else if len(repo.ConflictFileAlternatives(path)) > 0 {
-				conflict = " C"
-			}
-
-			hashTime, err := repo.GetHashTime(path)
-			if repo.IsNoData(err) {
-				if info.Mode()&os.FileMode(0200) == 0 {
-					fmt.Printf("?%s (ro)\t%s\n", conflict, path)
-				} else {
-					fmt.Printf("?%s\t%s\n", conflict, path)
-				}
-				return nil
-			} else if err != nil {
-				fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
-				return nil
-			}
-
-			var redundency string = "*"
-			if rep != nil {
-				digest, err := repo.GetHash(path, info, true)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
-					return nil
-				}
-				if par2exists, _ := rep.Par2Exists(digest); par2exists {
-					redundency = ""
-				}
-			}
-
-			if hashTime != info.ModTime() {
-				fmt.Printf("+%s%s\t%s\n", conflict, redundency, path)
-			} else if conflict != "" || (redundency != "" && !*opt_no_par2) {
-				fmt.Printf("%s%s\t%s\n", conflict, redundency, path)
-			}
+		if f.Untracked && f.ReadOnly {
+			fmt.Printf("?%s (ro)\t%s\n", conflict, f.Path)
+		} else if f.Untracked {
+			fmt.Printf("?%s\t%s\n", conflict, f.Path)
+		} else if f.Modified {
+			fmt.Printf("+%s%s\t%s\n", conflict, redundency, f.Path)
+		} else if conflict != "" || (redundency != "" && !*opt_no_par2) {
+			fmt.Printf("%s%s\t%s\n", conflict, redundency, f.Path)
 		}
+	}
 
-		return nil
-	})
+	_, err, errs := api.Status(interrupt, dir, opts)
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v", err)
-		os.Exit(1)
+	status := 0
+	for _, e := range errs {
+		fmt.Fprintf(os.Stderr, "%s\n", e.Error())
+		status = 1
+	}
+	if isInterrupt(err) {
+		fmt.Fprintf(os.Stderr, "interrupted, only the files above were scanned\n")
+		status = 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		status = 1
 	}
 	return status
 }
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"os"
 
+	plan "github.com/mildred/doc/plan"
+	repo "github.com/mildred/doc/repo"
 	sync "github.com/mildred/doc/sync"
 )
 
@@ -29,6 +31,20 @@ synchronisation will be according to the following rules:
 
 Unless the force flag is specified, the operation will stop on the first error.
 
+Symbolic links are copied as links unless -L is given. Directories that are
+their own ancestors (through symlinks or bind mounts) are reported as errors and
+not traversed. With -x, directories on other filesystems are created but their
+content is not copied.
+
+With -j, several files are copied at the same time. A directory is always
+created before the files it contains. -per-src and -per-dst limit the number of
+concurrent copies reading from or writing to the same device.
+
+With -plan FILE, nothing is copied and the actions are written to FILE instead,
+one per line with their kind, source, destination, hash, size and conflict flag.
+The plan can be reviewed and edited, then run with -apply FILE. Nothing is done
+if a source no longer has its planned hash or if a destination changed since.
+
 The operatios is performed in two steps. The first step collects information
 about each file and deduce the action to perform, and the second step performs
 the actual copy. Interrupting the process during its first step leave your
@@ -60,6 +76,20 @@ destination in the following way:
 
 Unless the force flag is specified, the operation will stop on the first error.
 
+Symbolic links are copied as links unless -L is given. Directories that are
+their own ancestors (through symlinks or bind mounts) are reported as errors and
+not traversed. With -x, directories on other filesystems are created but their
+content is not copied.
+
+With -j, several files are copied at the same time. A directory is always
+created before the files it contains. -per-src and -per-dst limit the number of
+concurrent copies reading from or writing to the same device.
+
+With -plan FILE, nothing is copied and the actions are written to FILE instead,
+one per line with their kind, source, destination, hash, size and conflict flag.
+The plan can be reviewed and edited, then run with -apply FILE. Nothing is done
+if a source no longer has its planned hash or if a destination changed since.
+
 The operatios is performed in two steps. The first step collects information
 about each file and deduce the action to perform, and the second step performs
 the actual copy. Interrupting the process during its first step leave your
@@ -85,20 +115,35 @@ func mainCopy(args []string) int {
 	opt_commit := f.Bool("commit", false, "Commit the new hash if it has been computed (appear in both source and destination)")
 	opt_2pass := f.Bool("2", false, "Scan before copy in two distinct pass")
 	opt_nodocignore := f.Bool("no-docignore", false, "Don't respect .docignore")
+	opt_follow := f.Bool("L", false, "Follow symbolic links")
+	opt_one_fs := f.Bool("x", false, "Don't cross filesystem boundaries")
 	opt_verbose := f.Bool("v", false, "Verbose mode")
+	opt_jobs := f.Int("j", 1, "Number of files to copy concurrently")
+	opt_per_src := f.Int("per-src", 0, "Maximum concurrent copies from the same device (0 for no limit)")
+	opt_per_dst := f.Int("per-dst", 0, "Maximum concurrent copies to the same device (0 for no limit)")
+	opt_plan := f.String("plan", "", "Write the actions to this plan file instead of running them")
+	opt_apply := f.String("apply", "", "Run the actions of this plan file, unless the files changed since")
 	f.Usage = func() {
 		fmt.Print(copyUsage)
 		f.PrintDefaults()
 	}
 	f.Parse(args)
 
-	src, dst := findSourceDest(*opt_from, *opt_to, f.Args())
+	// With -apply, the source and destination are in the plan
+	var src, dst string
+	if *opt_apply == "" {
+		src, dst = findSourceDest(*opt_from, *opt_to, f.Args())
+	}
 	sync_opts := sync.SyncOptions{
 		Preparator: &sync.FilePreparatorOpts{
 			Commit:    *opt_commit,
 			CheckHash: *opt_hash,
 			Bidir:     false,
 			DocIgnore: !*opt_nodocignore,
+			Walk: repo.WalkOptions{
+				FollowSymlinks: *opt_follow,
+				OneFileSystem:  *opt_one_fs,
+			},
 		},
 		DryRun:    *opt_dry_run,
 		Force:     *opt_force,
@@ -107,8 +152,11 @@ func mainCopy(args []string) int {
 		DeleteDup: *opt_dd,
 		TwoPass:   *opt_2pass,
 		Verbose:   *opt_verbose,
+		Jobs:      *opt_jobs,
+		PerSource: *opt_per_src,
+		PerDest:   *opt_per_dst,
 	}
-	if sync.Sync(src, dst, sync_opts) > 0 {
+	if runSync("cp", src, dst, *opt_plan, *opt_apply, sync_opts) > 0 {
 		os.Exit(1)
 	}
 	return 0
@@ -124,20 +172,35 @@ func mainSync(args []string) int {
 	opt_commit := f.Bool("commit", false, "Commit the new hash if it has been computed")
 	opt_2pass := f.Bool("2", false, "Scan before copy in two distinct pass")
 	opt_nodocignore := f.Bool("no-docignore", false, "Don't respect .docignore")
+	opt_follow := f.Bool("L", false, "Follow symbolic links")
+	opt_one_fs := f.Bool("x", false, "Don't cross filesystem boundaries")
 	opt_verbose := f.Bool("v", false, "Verbose mode")
+	opt_jobs := f.Int("j", 1, "Number of files to copy concurrently")
+	opt_per_src := f.Int("per-src", 0, "Maximum concurrent copies from the same device (0 for no limit)")
+	opt_per_dst := f.Int("per-dst", 0, "Maximum concurrent copies to the same device (0 for no limit)")
+	opt_plan := f.String("plan", "", "Write the actions to this plan file instead of running them")
+	opt_apply := f.String("apply", "", "Run the actions of this plan file, unless the files changed since")
 	f.Usage = func() {
 		fmt.Print(syncUsage)
 		f.PrintDefaults()
 	}
 	f.Parse(args)
 
-	src, dst := findSourceDest(*opt_from, *opt_to, f.Args())
+	// With -apply, the source and destination are in the plan
+	var src, dst string
+	if *opt_apply == "" {
+		src, dst = findSourceDest(*opt_from, *opt_to, f.Args())
+	}
 	sync_opts := sync.SyncOptions{
 		Preparator: &sync.FilePreparatorOpts{
 			Commit:    *opt_commit,
 			CheckHash: false,
 			Bidir:     true,
 			DocIgnore: !*opt_nodocignore,
+			Walk: repo.WalkOptions{
+				FollowSymlinks: *opt_follow,
+				OneFileSystem:  *opt_one_fs,
+			},
 		},
 		DryRun:    *opt_dry_run,
 		Force:     *opt_force,
@@ -146,9 +209,44 @@ func mainSync(args []string) int {
 		DeleteDup: false,
 		TwoPass:   *opt_2pass,
 		Verbose:   *opt_verbose,
+		Jobs:      *opt_jobs,
+		PerSource: *opt_per_src,
+		PerDest:   *opt_per_dst,
 	}
-	if sync.Sync(src, dst, sync_opts) > 0 {
+	if runSync("sync", src, dst, *opt_plan, *opt_apply, sync_opts) > 0 {
 		os.Exit(1)
 	}
 	return 0
 }
+
+// Run the synchronisation, or write its plan to planFile, or apply the plan in
+// applyFile. Return the number of errors.
+func runSync(command, src, dst, planFile, applyFile string, opts sync.SyncOptions) int {
+	if applyFile != "" {
+		p, err := plan.ReadFile(applyFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			return 1
+		} else if p.Command != "cp" && p.Command != "sync" {
+			fmt.Fprintf(os.Stderr, "%s: plan of doc %s cannot be applied by doc %s\n", applyFile, p.Command, command)
+			return 1
+		}
+		opts.Apply = p
+	} else if planFile != "" {
+		opts.Plan = &plan.Plan{Command: command, Source: plan.Abs(src), Dest: plan.Abs(dst)}
+	}
+
+	opts.Context = interrupt
+	numErrors := sync.Sync(src, dst, opts)
+	if numErrors > 0 || opts.Plan == nil {
+		return numErrors
+	}
+
+	err := plan.WriteFile(planFile, opts.Plan)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("%d actions written to %s\n", len(opts.Plan.Actions), planFile)
+	return 0
+}
@@ -2,16 +2,16 @@ package sync
 
 import (
 	"fmt"
-	"io"
-	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"syscall"
-	"time"
 
 	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/fastcopy"
+	"github.com/mildred/doc/meta"
 	"github.com/mildred/doc/repo"
+	"github.com/mildred/doc/throttle"
 )
 
 type CopyAction struct {
@@ -24,8 +24,21 @@ type CopyAction struct {
 	Link        bool
 	SrcMode     os.FileMode
 	OrigDstMode os.FileMode
-	manualMode  bool
-	srcInfo     os.FileInfo
+	DirTimes    *meta.DirTimes
+
+	// When not empty, the file or symlink at Dst is moved to Aside before the
+	// directory is created, and marked as its conflict alternative. AsideHash
+	// is the hash of the entry moved aside.
+	Aside     string
+	AsideHash []byte
+
+	manualMode bool
+	srcInfo    os.FileInfo
+	link       *copy.Link
+	linkFirst  bool
+
+	// The content was copied, its bytes are counted by fastcopy.Copied
+	copied bool
 }
 
 func NewCopyAction(
@@ -37,7 +50,16 @@ func NewCopyAction(
 	conflict bool,
 	srcMode os.FileMode,
 	origDstMode os.FileMode) *CopyAction {
-	return &CopyAction{src, dst, hash, size, originaldst, conflict, false, srcMode, origDstMode, false, nil}
+	return &CopyAction{
+		Src:         src,
+		Dst:         dst,
+		Hash:        hash,
+		Size:        size,
+		OriginalDst: originaldst,
+		Conflict:    conflict,
+		SrcMode:     srcMode,
+		OrigDstMode: origDstMode,
+	}
 }
 
 func NewCopyFile(
@@ -45,22 +67,24 @@ func NewCopyFile(
 	dst string,
 	hash []byte,
 	info os.FileInfo) *CopyAction {
-	return &CopyAction{src, dst, hash, size(info), "", false, false, info.Mode(), 0, true, info}
+	return &CopyAction{
+		Src:        src,
+		Dst:        dst,
+		Hash:       hash,
+		Size:       size(info),
+		SrcMode:    info.Mode(),
+		manualMode: true,
+		srcInfo:    info,
+	}
 }
 
 func NewCreateDir(src string, dst string, srcInfo os.FileInfo) *CopyAction {
 	return &CopyAction{
-		src,
-		dst,
-		nil,
-		0,
-		"",
-		false,
-		false,
-		srcInfo.Mode(),
-		0,
-		true,
-		srcInfo,
+		Src:        src,
+		Dst:        dst,
+		SrcMode:    srcInfo.Mode(),
+		manualMode: true,
+		srcInfo:    srcInfo,
 	}
 }
 
@@ -69,125 +93,97 @@ func (act *CopyAction) IsConflict() bool {
 }
 
 func (act *CopyAction) Show() string {
-	if act.Link {
+	if act.link != nil && !act.linkFirst {
+		return fmt.Sprintf("ln %s %s\n", act.link.Dst, act.Dst)
+	} else if act.Link {
 		return fmt.Sprintf("ln %s %s\n", act.Src, act.Dst)
+	} else if act.Aside != "" {
+		return fmt.Sprintf("mv %s %s\ncp %s %s\n", act.Dst, act.Aside, act.Src, act.Dst)
 	} else {
-		return fmt.Sprintf("cp -a --reflink=auto %s %s\n", act.Src, act.Dst)
+		return fmt.Sprintf("cp %s %s\n", act.Src, act.Dst)
 	}
 }
 
-func (act *CopyAction) Run() error {
+// Run the action. First error is fatal, other errors are metadata that could
+// not be preserved.
+func (act *CopyAction) Run() (error, []error) {
 	var err error
-	if act.Link {
-		err = os.Link(act.Src, act.Dst)
-		if err != nil {
-			return fmt.Errorf("link %s: %s", act.Dst, err.Error())
-		}
-	} else if act.manualMode && act.srcInfo.Mode()&^(os.ModeDir /*|os.ModeSymlink*/) == 0 { // FIXME: enable symlinks
-		stat, ok := act.srcInfo.Sys().(*syscall.Stat_t)
-
-		if !ok {
-			panic("Could not get Stat_t")
-		}
-
-		symlink := act.srcInfo.Mode()&os.ModeSymlink != 0
-
-		if act.srcInfo.IsDir() {
-			err = os.Mkdir(act.Dst, 0700)
-			if err != nil {
-				return err
-			}
-		} else if symlink {
-			link, err := os.Readlink(act.Src)
-			if err != nil {
-				return err
-			}
+	var issues []error
 
-			err = os.Symlink(link, act.Dst)
-			if err != nil {
-				return err
-			}
-		} else {
-			f, err := os.OpenFile(act.Dst, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
-			if err != nil {
-				return err
-			}
-			defer f.Close()
+	throttle.File()
 
-			f0, err := os.Open(act.Src)
-			if err != nil {
-				return err
-			}
-			defer f0.Close()
+	linked := false
+	if act.link != nil && !act.linkFirst {
+		// Hard link to the copy of another link of the source
+		if !act.manualMode {
+			os.MkdirAll(filepath.Dir(act.Dst), 0755) // Ignore error
+		}
+		linked = act.link.Link(act.Dst)
+	} else if act.Link {
+		err = os.Link(act.Src, act.Dst)
+		if err == nil {
+			linked = true
+		} else if !attrs.IsErrno(err, syscall.EXDEV) && !attrs.IsErrno(err, syscall.EMLINK) {
+			return fmt.Errorf("link %s: %s", act.Dst, err.Error()), nil
+		}
+		// Otherwise copy the duplicate, a reflink still shares the data
+	}
 
-			_, err = io.Copy(f, f0)
+	if !linked {
+		info := act.srcInfo
+		if info == nil || act.Link {
+			info, err = act.srcStat()
 			if err != nil {
-				return err
+				return err, nil
 			}
 		}
 
-		err = os.Lchown(act.Dst, int(stat.Uid), int(stat.Gid))
-		if err != nil {
-			log.Println(err)
-			err = nil
+		if !act.manualMode {
+			os.MkdirAll(filepath.Dir(act.Dst), 0755) // Ignore error
 		}
 
-		if !symlink {
-
-			atime := time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
-			err = os.Chtimes(act.Dst, atime, act.srcInfo.ModTime())
-			if err != nil {
-				return err
+		if act.Aside != "" {
+			if _, err := os.Lstat(act.Aside); err == nil {
+				return fmt.Errorf("move aside %s: %s already exists", act.Dst, act.Aside), nil
 			}
-
-			err = os.Chmod(act.Dst, act.SrcMode)
-			if err != nil {
-				return err
-			}
-
-			// FIXME: extended attributes for symlinks
-			// golang is missing some syscalls
-
-			xattr, values, err := attrs.GetList(act.Src)
+			err = os.Rename(act.Dst, act.Aside)
 			if err != nil {
-				return err
-			}
-
-			for i, attrname := range xattr {
-				err = attrs.Set(act.Src, attrname, values[i])
-				if err != nil {
-					return err
-				}
+				return fmt.Errorf("move aside %s: %s", act.Dst, err.Error()), nil
 			}
-
 		}
 
-		return nil
-	} else {
-		os.MkdirAll(filepath.Dir(act.Dst), 0755) // Ignore error
-		cmd := exec.Command("/bin/cp", "-a", "--no-preserve=mode", "--reflink=auto", "-d", "-T", act.Src, act.Dst)
-		cmd.Stderr = os.Stderr
-		err = cmd.Run()
+		err = create(act.Src, info, act.Dst)
+		act.copied = info.Mode().IsRegular()
 		if err != nil {
-			return fmt.Errorf("cp %s %s: %s", act.Src, act.Dst, err.Error())
+			return fmt.Errorf("copy %s %s: %s", act.Src, act.Dst, err.Error()), nil
 		}
-		err = os.Chmod(act.Dst, act.SrcMode)
-		if err != nil {
-			return err
+
+		if info.IsDir() && act.DirTimes != nil {
+			atime, mtime := meta.Times(info)
+			act.DirTimes.Add(act.Dst, atime, mtime)
+			issues = meta.CopyNoTimes(act.Src, info, act.Dst)
+		} else {
+			issues = meta.Copy(act.Src, info, act.Dst)
 		}
 	}
 
+	if act.Aside != "" {
+		issues = append(issues, repo.MarkConflict(act.Dst, act.Aside, act.AsideHash)...)
+		if err := repo.RecordConflict(act.Dst, act.AsideHash); err != nil {
+			issues = append(issues, fmt.Errorf("%s: could not record conflict: %s", act.Aside, err.Error()))
+		}
+	}
 	if act.Conflict {
 		if act.SrcMode&os.ModeSymlink == 0 {
 			err = repo.MarkConflictFor(act.Dst, filepath.Base(act.OriginalDst))
 			if err != nil {
-				return fmt.Errorf("%s: could not mark conflict: %s", act.Dst, err.Error())
+				return fmt.Errorf("%s: could not mark conflict: %s", act.Dst, err.Error()), issues
 			}
 		}
 		if act.OrigDstMode&os.ModeSymlink == 0 {
 			err = repo.AddConflictAlternative(act.OriginalDst, filepath.Base(act.Dst))
 			if err != nil {
-				return fmt.Errorf("%s: could add conflict alternative: %s", act.Dst, err.Error())
+				return fmt.Errorf("%s: could add conflict alternative: %s", act.Dst, err.Error()), issues
 			}
 		}
 	}
@@ -195,28 +191,69 @@ func (act *CopyAction) Run() error {
 		if act.Hash != nil {
 			info, err := os.Lstat(act.Dst)
 			if err != nil {
-				return fmt.Errorf("%s: could add lstat: %s", act.Dst, err.Error())
+				return fmt.Errorf("%s: could add lstat: %s", act.Dst, err.Error()), issues
 			}
 			_, err = repo.CommitFileHash(act.Dst, info, act.Hash, false)
 			if err != nil {
-				return fmt.Errorf("%s: could not commit: %s", act.Dst, err.Error())
+				return fmt.Errorf("%s: could not commit: %s", act.Dst, err.Error()), issues
 			}
 		} else {
 			hash, err := attrs.Get(act.Src, repo.XattrHash)
 			if err == nil {
 				err = attrs.Set(act.Dst, repo.XattrHash, hash)
 				if err != nil {
-					return fmt.Errorf("%s: could add xattr %s: %s", act.Dst, repo.XattrHash, err.Error())
+					return fmt.Errorf("%s: could add xattr %s: %s", act.Dst, repo.XattrHash, err.Error()), issues
 				}
 			}
 			hashTime, err := attrs.Get(act.Src, repo.XattrHashTime)
 			if err == nil {
 				err = attrs.Set(act.Dst, repo.XattrHashTime, hashTime)
 				if err != nil {
-					return fmt.Errorf("%s: could add xattr %s: %s", act.Dst, repo.XattrHashTime, err.Error())
+					return fmt.Errorf("%s: could add xattr %s: %s", act.Dst, repo.XattrHashTime, err.Error()), issues
 				}
 			}
 		}
 	}
-	return nil
+	return nil, issues
+}
+
+// Return the source information, as scanned if available
+func (act *CopyAction) stat() (os.FileInfo, error) {
+	if act.srcInfo != nil {
+		return act.srcInfo, nil
+	}
+	return act.srcStat()
+}
+
+// Stat the source, following it if it is a symlink followed by the preparator
+func (act *CopyAction) srcStat() (os.FileInfo, error) {
+	if act.SrcMode&os.ModeSymlink != 0 {
+		return os.Lstat(act.Src)
+	}
+	return os.Stat(act.Src)
+}
+
+// Create dst with the type and content of src, described by info
+func create(src string, info os.FileInfo, dst string) error {
+	mode := info.Mode()
+	switch {
+	case mode.IsDir():
+		return os.Mkdir(dst, 0700)
+	case mode&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, dst)
+	case mode.IsRegular():
+		_, err := fastcopy.CopyFile(src, dst, 0600)
+		return err
+	}
+
+	// Devices, fifos and sockets
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("%s: unsupported file type", src)
+	}
+	return syscall.Mknod(dst, stat.Mode, int(stat.Rdev))
 }
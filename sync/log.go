@@ -2,12 +2,40 @@ package sync
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
+	gosync "sync"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/plan"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
+const (
+	// Minimum time between two redraws of the status on a terminal
+	redrawInterval = 100 * time.Millisecond
+
+	// Time between two status lines when stdout is not a terminal
+	plainInterval = 10 * time.Second
+
+	// Width of the status when the terminal size is unknown
+	defaultWidth = 80
+
+	// Status lines are indented after the "Scan: " and "Copy: " headers
+	indent = "      "
+)
+
+// Logger can be called from the preparator and the executor goroutines at the
+// same time. On a terminal, it keeps a multi-line status up to date below the
+// log lines. Otherwise, it prints a status line periodically. The logger also
+// emits the events of the sync engine.
 type Logger struct {
+	mu      gosync.Mutex
 	quiet   bool
 	verbose bool
+	tty     bool
 	scan    struct {
 		src         string
 		src_hash    bool
@@ -16,97 +44,352 @@ type Logger struct {
 		num_files   uint64
 		total_files uint64
 		total_bytes uint64
+		copy_bytes  uint64
 	}
 	copying bool
 	exec    struct {
+		start time.Time
 		src   string
 		dst   string
 		item  uint64
 		bytes uint64
 	}
 	num_errors int
+	warnings   []error
+
+	// Length of the status lines on screen, to move back over them
+	drawn    []int
+	lastDraw time.Time
+	cleared  bool
+	done     chan struct{}
 }
 
 func NewLogger(quiet, verbose bool) *Logger {
-	return &Logger{quiet: quiet}
+	l := &Logger{
+		quiet:   quiet,
+		verbose: verbose,
+		tty:     terminal.IsTerminal(int(os.Stdout.Fd())),
+		done:    make(chan struct{}),
+	}
+	l.lastDraw = time.Now()
+	if !quiet {
+		go l.refresh()
+	}
+	return l
+}
+
+// Update the status even when nothing happens, for the throughput, the time
+// remaining and the terminal size
+func (l *Logger) refresh() {
+	interval := time.Second
+	if !l.tty {
+		interval = plainInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.print(true)
+			l.mu.Unlock()
+		}
+	}
 }
 
 func (l *Logger) LogPrepare(p Preparator, src, dst string, hash_src, hash_dst bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.scan.src = src
 	l.scan.src_hash = hash_src
 	l.scan.dst = dst
 	l.scan.dst_hash = hash_dst
 	l.scan.num_files, l.scan.total_bytes = p.ScanStatus()
-	l.Print()
+	l.print(false)
 }
 
 func (l *Logger) AddFile(act *CopyAction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.scan.total_files++
-	l.Print()
+	if act.Size > 0 {
+		l.scan.copy_bytes += uint64(act.Size)
+	}
+	if events.Enabled() {
+		e := events.Event{
+			Type: events.ActionPlanned,
+			Src:  act.Src,
+			Dst:  act.Dst,
+			Kind: string(plan.KindOf(act.SrcMode)),
+			Size: act.Size,
+		}
+		if act.Hash != nil {
+			e.Hash = base58.Encode(act.Hash)
+		}
+		if act.Conflict {
+			e.Original = act.OriginalDst
+		}
+		events.Emit(e)
+		if act.Aside != "" {
+			events.Emit(events.Event{
+				Type:     events.ActionPlanned,
+				Src:      act.Dst,
+				Dst:      act.Aside,
+				Kind:     string(plan.KindOf(act.OrigDstMode)),
+				Hash:     base58.Encode(act.AsideHash),
+				Original: act.Dst,
+			})
+		}
+	}
+	l.print(false)
 }
 
 func (l *Logger) LogExec(act *CopyAction, bytes uint64, items uint64) {
-	l.copying = true
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.copying {
+		l.copying = true
+		l.exec.start = time.Now()
+	}
 	l.exec.src = act.Src
 	l.exec.dst = act.Dst
 	l.exec.bytes = bytes
 	l.exec.item = items
-	l.Print()
+	if items > 0 {
+		events.Emit(events.Event{
+			Type:       events.CopyProgress,
+			Src:        act.Src,
+			Dst:        act.Dst,
+			Files:      items,
+			TotalFiles: l.scan.total_files,
+			Bytes:      bytes,
+			TotalBytes: l.scan.copy_bytes,
+		})
+	}
+	if l.verbose && items > 0 && !l.quiet {
+		l.printLine(act.Show())
+		return
+	}
+	l.print(false)
+}
+
+// Update the bytes copied while a file is being copied
+func (l *Logger) LogBytes(bytes uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.copying || bytes == l.exec.bytes {
+		return
+	}
+	l.exec.bytes = bytes
+	events.Emit(events.Event{
+		Type:       events.CopyProgress,
+		Src:        l.exec.src,
+		Dst:        l.exec.dst,
+		Files:      l.exec.item,
+		TotalFiles: l.scan.total_files,
+		Bytes:      bytes,
+		TotalBytes: l.scan.copy_bytes,
+	})
+	l.print(false)
 }
 
 func (l *Logger) LogError(e error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	l.num_errors++
-	fmt.Printf("\x1b[K%s\n", e.Error())
-	l.Print()
+	events.EmitError("", e)
+	l.printLine(e.Error() + "\n")
+}
+
+// Record metadata that could not be preserved, listed by PrintWarnings
+func (l *Logger) LogWarning(e error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.warnings = append(l.warnings, e)
+	events.EmitWarnings([]error{e})
+}
+
+// Print the warnings after the status, which is not updated anymore
+func (l *Logger) PrintWarnings() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clear()
+	for _, e := range l.warnings {
+		fmt.Fprintf(os.Stderr, "W: %s\n", e.Error())
+	}
 }
 
 func (l *Logger) NumErrors() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.num_errors
 }
 
+// Return the number of files copied
+func (l *Logger) NumCopied() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exec.item
+}
+
+// Return the number of files found to copy
+func (l *Logger) NumPlanned() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.scan.total_files
+}
+
 func (l *Logger) Print() {
-	if l.quiet {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.print(true)
+}
+
+// Terminal width, minus one column so lines never wrap
+func (l *Logger) width() int {
+	cols, _, err := terminal.GetSize(int(os.Stdout.Fd()))
+	if err != nil || cols <= 0 {
+		cols = defaultWidth
+	}
+	return cols - 1
+}
+
+// Print a log line above the status
+func (l *Logger) printLine(line string) {
+	if l.tty && !l.quiet && !l.cleared {
+		l.erase()
+		fmt.Print(line)
+		l.print(true)
+	} else {
+		fmt.Print(line)
+	}
+}
+
+// Move the cursor back to the first status line and erase the status
+func (l *Logger) erase() {
+	if len(l.drawn) == 0 {
 		return
 	}
-	fmt.Printf("\x1b[K\n")
-	fmt.Printf(
-		"\x1b[KScanning: %d files (%d bytes, %d files to copy)\n"+
-			"\x1b[K  %s\n",
-		l.scan.num_files, l.scan.total_bytes, l.scan.total_files, filepath.Base(l.scan.src))
+	// Lines longer than the terminal, if it shrunk, take several rows
+	cols := l.width() + 1
+	rows := 0
+	for _, n := range l.drawn {
+		rows++
+		if n > cols {
+			rows += (n - 1) / cols
+		}
+	}
+	fmt.Printf("\r\x1b[%dA\x1b[J", rows)
+	l.drawn = nil
+}
+
+func (l *Logger) status(width int) []string {
+	var lines []string
+	w := width - len(indent)
+
+	scanned := "scanned"
+	path := l.scan.src
 	if l.scan.src_hash {
-		fmt.Printf("\x1b[K  From: %s (hashing)\n", filepath.Dir(l.scan.src))
-	} else {
-		fmt.Printf("\x1b[K  From: %s\n", filepath.Dir(l.scan.src))
+		scanned = "scanned, hashing source"
+	} else if l.scan.dst_hash {
+		scanned = "scanned, hashing destination"
+		path = l.scan.dst
 	}
-	if l.scan.dst_hash {
-		fmt.Printf("\x1b[K  To:   %s (hashing)\n", filepath.Dir(l.scan.dst))
-	} else {
-		fmt.Printf("\x1b[K  To:   %s\n", filepath.Dir(l.scan.dst))
-	}
-
-	if l.copying {
-		percentItems := 100.0 * float64(l.exec.item) / float64(l.scan.total_files)
-		percentBytes := 100.0 * float64(l.exec.bytes) / float64(l.scan.total_bytes)
-		fmt.Printf(
-			"\x1b[KCopying: %d bytes %2.0f%% (file %d %2.0f%%)\n"+
-				"\x1b[K  %s\n"+
-				"\x1b[K  From: %s\n"+
-				"\x1b[K  To:   %s\n",
-			l.exec.bytes, percentBytes, l.exec.item, percentItems, filepath.Base(l.exec.dst),
-			filepath.Dir(l.exec.src),
-			filepath.Dir(l.exec.dst))
-		fmt.Printf("\x1b[K\x1b[9A")
-	} else {
-		fmt.Printf("\x1b[K\x1b[5A")
+	lines = append(lines,
+		fmt.Sprintf("Scan: %d files %s, %d bytes, %d files to copy",
+			l.scan.num_files, scanned, l.scan.total_bytes, l.scan.total_files))
+	if l.tty && path != "" {
+		lines = append(lines,
+			indent+truncatePath(filepath.Dir(path), w),
+			indent+truncateName(filepath.Base(path), w))
+	}
+
+	if !l.copying {
+		return lines
+	}
+
+	fraction := 0.0
+	if l.scan.copy_bytes > 0 {
+		fraction = float64(l.exec.bytes) / float64(l.scan.copy_bytes)
+	} else if l.scan.total_files > 0 {
+		fraction = float64(l.exec.item) / float64(l.scan.total_files)
 	}
+	progress := fmt.Sprintf("%d/%d files, %d/%d bytes",
+		l.exec.item, l.scan.total_files, l.exec.bytes, l.scan.copy_bytes)
+	if elapsed := time.Since(l.exec.start); elapsed >= time.Second && l.exec.bytes > 0 {
+		rate := float64(l.exec.bytes) / elapsed.Seconds()
+		progress += ", " + formatRate(rate)
+		if l.scan.copy_bytes > l.exec.bytes {
+			left := time.Duration(float64(l.scan.copy_bytes-l.exec.bytes) / rate * float64(time.Second))
+			progress += ", " + formatDuration(left) + " left"
+		}
+	}
+
+	if !l.tty {
+		return append(lines, fmt.Sprintf("Copy: %d%%, %s", int(100*fraction), progress))
+	}
+	bar := w - len(" 100%")
+	if bar > 50 {
+		bar = 50
+	}
+	return append(lines,
+		fmt.Sprintf("Copy: %s %d%%", progressBar(fraction, bar-2), int(100*fraction)),
+		indent+progress,
+		indent+truncatePath(filepath.Dir(l.exec.dst), w),
+		indent+truncateName(filepath.Base(l.exec.dst), w))
 }
 
-func (l *Logger) Clear() {
-	if l.quiet {
+// Draw the status. On a terminal, it is drawn at most every redrawInterval
+// unless forced. Otherwise, it is only printed when forced.
+func (l *Logger) print(force bool) {
+	if l.quiet || l.cleared {
 		return
 	}
-	fmt.Printf("\n\n\n\n\n")
-	if l.copying {
-		fmt.Printf("\n\n\n\n")
+	now := time.Now()
+	if !l.tty {
+		if force {
+			for _, line := range l.status(0) {
+				fmt.Println(line)
+			}
+		}
+		return
+	} else if !force && now.Sub(l.lastDraw) < redrawInterval {
+		return
+	}
+	l.lastDraw = now
+
+	width := l.width()
+	l.erase()
+	for _, line := range l.status(width) {
+		line = cutLine(line, width)
+		fmt.Printf("%s\x1b[K\n", line)
+		l.drawn = append(l.drawn, len([]rune(line)))
 	}
 }
+
+// Draw the final status, it stays on screen and is not updated anymore
+func (l *Logger) clear() {
+	if l.cleared {
+		return
+	}
+	if !l.quiet {
+		close(l.done)
+		if l.tty {
+			l.print(true)
+		} else if l.scan.num_files > 0 || l.copying {
+			for _, line := range l.status(0) {
+				fmt.Println(line)
+			}
+		}
+	}
+	l.drawn = nil
+	l.cleared = true
+}
+
+func (l *Logger) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clear()
+}
@@ -0,0 +1,114 @@
+package sync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mildred/doc/plan"
+)
+
+// Return the plan action for act, hashing the files that are not committed
+func (act *CopyAction) planAction() (plan.Action, error) {
+	info, err := act.stat()
+	if err != nil {
+		return plan.Action{}, err
+	}
+
+	a := plan.Action{
+		Kind:     plan.KindOf(info.Mode()),
+		Conflict: act.Conflict,
+		Hash:     act.Hash,
+		Size:     act.Size,
+		Src:      plan.Abs(act.Src),
+		Dst:      plan.Abs(act.Dst),
+	}
+	if a.Hash == nil {
+		a.Hash, err = plan.Hash(act.Src, info)
+		if err != nil {
+			return a, err
+		}
+	}
+
+	if act.Conflict {
+		a.Original = plan.Abs(act.OriginalDst)
+		orig, err := os.Lstat(act.OriginalDst)
+		if os.IsNotExist(err) {
+			// Copied by another action, under a name colliding with Src
+			return a, nil
+		} else if err != nil {
+			return a, err
+		}
+		a.OriginalHash, err = plan.Hash(act.OriginalDst, orig)
+		if err != nil {
+			return a, err
+		}
+	} else if act.Aside != "" {
+		a.Aside = true
+		a.Original = plan.Abs(act.Aside)
+		a.OriginalHash = act.AsideHash
+	}
+	return a, nil
+}
+
+// Return the actions of the plan, or the errors of the actions that cannot be
+// applied any more
+func plannedActions(p *plan.Plan) ([]*CopyAction, []error) {
+	var actions []*CopyAction
+	var errs []error
+	for _, a := range p.Actions {
+		err := checkInside(p.Source, a.Src)
+		if err == nil {
+			err = checkInside(p.Dest, a.Dst)
+		}
+		if err == nil && (a.Conflict || a.Aside) {
+			err = checkInside(p.Dest, a.Original)
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		info, err := a.CheckSource()
+		if err == nil {
+			err = a.CheckDest()
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var origMode os.FileMode
+		if a.Conflict {
+			if orig, err := os.Lstat(a.Original); err == nil {
+				origMode = orig.Mode()
+			}
+		} else if a.Aside {
+			if orig, err := os.Lstat(a.Dst); err == nil {
+				origMode = orig.Mode()
+			}
+		}
+		act := NewCopyAction(a.Src, a.Dst, a.Hash, a.Size, "", a.Conflict, info.Mode(), origMode)
+		if a.Conflict {
+			act.OriginalDst = a.Original
+		} else if a.Aside {
+			act.Aside, act.AsideHash = a.Original, a.OriginalHash
+		}
+		actions = append(actions, act)
+	}
+	return actions, errs
+}
+
+// Return an error unless path is dir or a path in it. The source and the
+// destination of a sync can be files, then the plan has a single action on
+// them.
+func checkInside(dir, path string) error {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return err
+	} else if rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("%s: not in %s", path, dir)
+	}
+	return nil
+}
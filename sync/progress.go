@@ -0,0 +1,113 @@
+package sync
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Number of characters kept at the end of truncated names, to keep the
+// extension visible
+const nameTail = 10
+
+const ellipsis = "..."
+
+// Truncate name to width characters by keeping the first characters, the
+// ellipsis and the last characters. At least one character is kept.
+func truncateName(name string, width int) string {
+	if width < 1 {
+		width = 1
+	}
+	runes := []rune(name)
+	if len(runes) <= width {
+		return name
+	} else if width <= len(ellipsis) {
+		return string(runes[:width])
+	}
+	tail := nameTail
+	if width-len(ellipsis) <= tail {
+		tail = (width - len(ellipsis)) / 2
+	}
+	head := width - len(ellipsis) - tail
+	return string(runes[:head]) + ellipsis + string(runes[len(runes)-tail:])
+}
+
+// Truncate path to width characters. Every item of the path is truncated to
+// the same length, the longest that lets the path fit.
+func truncatePath(path string, width int) string {
+	if utf8.RuneCountInString(path) <= width {
+		return path
+	}
+	items := strings.Split(path, string(filepath.Separator))
+	longest := 0
+	for _, item := range items {
+		if n := utf8.RuneCountInString(item); n > longest {
+			longest = n
+		}
+	}
+	var res string
+	for n := longest; n > 0; n-- {
+		truncated := make([]string, len(items))
+		for i, item := range items {
+			truncated[i] = truncateName(item, n)
+		}
+		res = strings.Join(truncated, string(filepath.Separator))
+		if utf8.RuneCountInString(res) <= width {
+			return res
+		}
+	}
+	return truncateName(res, width)
+}
+
+// Cut a status line so it does not wrap
+func cutLine(line string, width int) string {
+	if width <= 0 || utf8.RuneCountInString(line) <= width {
+		return line
+	}
+	return string([]rune(line)[:width])
+}
+
+func progressBar(fraction float64, width int) string {
+	if fraction < 0 {
+		fraction = 0
+	} else if fraction > 1 {
+		fraction = 1
+	}
+	if width < 1 {
+		width = 1
+	}
+	done := int(fraction * float64(width))
+	bar := strings.Repeat("=", done)
+	if done < width {
+		bar += ">" + strings.Repeat(" ", width-done-1)
+	}
+	return "[" + bar + "]"
+}
+
+// Format a throughput with binary units
+func formatRate(bytesPerSec float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for bytesPerSec >= 1024 && i < len(units)-1 {
+		bytesPerSec /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s/s", bytesPerSec, units[i])
+}
+
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Second)
+	h := d / time.Hour
+	m := (d % time.Hour) / time.Minute
+	s := (d % time.Minute) / time.Second
+	switch {
+	case h > 0:
+		return fmt.Sprintf("%dh%02dm", h, m)
+	case m > 0:
+		return fmt.Sprintf("%dm%02ds", m, s)
+	default:
+		return fmt.Sprintf("%ds", s)
+	}
+}
@@ -1,5 +1,18 @@
 package sync
 
+import (
+	"context"
+	"path/filepath"
+	gosync "sync"
+	"time"
+
+	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/fastcopy"
+	"github.com/mildred/doc/meta"
+	"github.com/mildred/doc/pool"
+)
+
 type Executor struct {
 	// Dry run: only show actions
 	DryRun bool
@@ -7,28 +20,105 @@ type Executor struct {
 	// Force operation even after first error
 	Force bool
 
+	// Number of actions to run concurrently, 0 or 1 to run them one at a time
+	Jobs int
+
+	// Maximum number of concurrent actions reading from the same device, 0 for
+	// no limit
+	PerSource int
+
+	// Maximum number of concurrent actions writing to the same device, 0 for no
+	// limit
+	PerDest int
+
 	// If not nil, this is a map that associate a list of files for each hash (in
 	// binary form). This is used to hard link from those files instead of copying
 	// from the source directory. if nil, deduplication is desactivated.
 	Dedup map[string][]string
 
+	// If not nil, the files are recorded in this journal while they are
+	// created, so an interruption can be recovered from
+	Operations *copy.Operations
+
+	// No new action is started once the context is done, can be nil
+	Context context.Context
+
 	// Called to log an action (both dry mode and normal mode)
 	LogAction func(act *CopyAction, bytes uint64, items uint64)
 
+	// Called every events.ProgressInterval while files are copied, with the
+	// bytes copied so far
+	LogBytes func(bytes uint64)
+
 	// Called when there is an error
 	LogError func(e error)
+
+	// Called for metadata that could not be preserved, the action itself
+	// succeeded
+	LogWarning func(e error)
 }
 
 func (e *Executor) Execute(actions <-chan *CopyAction) (conflicts []string, duplicate_hashes [][]byte) {
-	var execBytes uint64 = 0
 	var numFiles uint64 = 0
+	var numDone uint64 = 0
+
+	// Bytes are counted as they are copied, the actions that copy no content
+	// count their size once done
+	var skippedBytes uint64
+	startBytes := fastcopy.Copied()
+	execBytes := func() uint64 {
+		return fastcopy.Copied() - startBytes + skippedBytes
+	}
+
+	// With concurrent jobs, a directory must be created before the actions
+	// inside it can run, and a file before its conflicts are marked. The
+	// channel of each directory and file is closed once it is done.
+	var workers *pool.Pool
+	var mu gosync.Mutex
+	var failed bool
+	created := map[string]chan struct{}{}
+	dirtimes := &meta.DirTimes{}
+	links := &copy.Links{}
+	if e.Jobs > 1 && !e.DryRun {
+		workers = pool.New(e.Jobs, e.PerSource, e.PerDest)
+	}
+	stopProgress := make(chan struct{})
+	defer close(stopProgress)
+	if e.LogBytes != nil && !e.DryRun {
+		go func() {
+			ticker := time.NewTicker(events.ProgressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-stopProgress:
+					return
+				case <-ticker.C:
+					mu.Lock()
+					e.LogBytes(execBytes())
+					mu.Unlock()
+				}
+			}
+		}()
+	}
 
 	for act := range actions {
+		if e.Context != nil && e.Context.Err() != nil {
+			break
+		}
 		numFiles++
+		act.DirTimes = dirtimes
 		if act.Conflict {
 			conflicts = append(conflicts, act.Dst)
+		} else if act.Aside != "" {
+			conflicts = append(conflicts, act.Aside)
 		}
-		if e.Dedup != nil && act.Hash != nil && !act.Conflict {
+		if !act.Conflict && !act.SrcMode.IsDir() {
+			// Hard links in the source are linked in the destination as well
+			if info, err := act.stat(); err == nil {
+				act.link, act.linkFirst = links.Register(info, act.Dst)
+			}
+		}
+		if e.Dedup != nil && act.Hash != nil && !act.Conflict && (act.link == nil || act.linkFirst) {
 			if files, ok := e.Dedup[string(act.Hash)]; ok && len(files) > 0 {
 				duplicate_hashes = append(duplicate_hashes, act.Hash)
 				act.Src = files[0]
@@ -36,11 +126,68 @@ func (e *Executor) Execute(actions <-chan *CopyAction) (conflicts []string, dupl
 			}
 		}
 		if e.LogAction != nil && numFiles == 1 {
-			e.LogAction(act, execBytes, 0)
+			mu.Lock()
+			e.LogAction(act, execBytes(), 0)
+			mu.Unlock()
+		}
+		if workers != nil {
+			mu.Lock()
+			stop := failed
+			mu.Unlock()
+			if stop {
+				break
+			}
+
+			var done chan struct{}
+			if !act.Conflict {
+				done = make(chan struct{})
+				created[act.Dst] = done
+			}
+			var wait <-chan struct{} = created[filepath.Dir(act.Dst)]
+			if act.Conflict {
+				wait = pool.Both(wait, created[act.OriginalDst])
+			}
+			if act.link != nil && !act.linkFirst {
+				wait = pool.Both(wait, act.link.Wait())
+			}
+			act := act
+			workers.Go(act.Src, act.Dst, wait, func() {
+				err, issues := e.run(act)
+				if done != nil {
+					close(done)
+				}
+				if act.linkFirst {
+					act.link.Done(err == nil)
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if !act.copied {
+					skippedBytes += uint64(act.Size)
+				}
+				numDone++
+				e.logWarnings(issues)
+				if err != nil {
+					e.LogError(err)
+					if !e.Force {
+						failed = true
+					}
+				} else if e.LogAction != nil {
+					e.LogAction(act, execBytes(), numDone)
+				}
+			})
+			continue
 		}
 		if !e.DryRun {
-			err := act.Run()
-			execBytes += uint64(act.Size)
+			err, issues := e.run(act)
+			if act.linkFirst {
+				act.link.Done(err == nil)
+			}
+			mu.Lock()
+			if !act.copied {
+				skippedBytes += uint64(act.Size)
+			}
+			mu.Unlock()
+			e.logWarnings(issues)
 			if err != nil {
 				e.LogError(err)
 				if !e.Force {
@@ -49,9 +196,74 @@ func (e *Executor) Execute(actions <-chan *CopyAction) (conflicts []string, dupl
 				continue
 			}
 		}
+		mu.Lock()
+		if e.DryRun {
+			skippedBytes += uint64(act.Size)
+		}
 		if e.LogAction != nil {
-			e.LogAction(act, execBytes, uint64(numFiles))
+			e.LogAction(act, execBytes(), uint64(numFiles))
 		}
+		mu.Unlock()
 	}
+
+	if workers != nil {
+		workers.Wait()
+	}
+
+	// Directory times are set once their content is written
+	e.logWarnings(dirtimes.Apply())
 	return
 }
+
+// Run the action, recorded in the operations journal when it places a file or
+// moves one aside
+func (e *Executor) run(act *CopyAction) (error, []error) {
+	if act.SrcMode.IsDir() && act.Aside == "" {
+		return act.Run()
+	} else if act.SrcMode.IsDir() {
+		id, err := e.Operations.BeginAside(act.Dst, act.Aside, act.Src, act.AsideHash)
+		if err != nil {
+			return err, nil
+		}
+		err, issues := act.Run()
+		done, ers := e.Operations.FinishAside(id, err == nil)
+		issues = append(issues, ers...)
+		if err != nil && done {
+			// The file was moved aside and the move is completed
+			err, issues = nil, append(issues, err)
+		}
+		if err == nil {
+			events.Emit(events.Event{Type: events.ConflictCreated, Path: act.Aside, Original: act.Dst})
+		}
+		return err, issues
+	}
+
+	pl := copy.Placement{Dst: act.Dst, Src: act.Src, Hash: act.Hash}
+	if act.Conflict {
+		pl.Original = act.OriginalDst
+	}
+	id, err := e.Operations.Begin(pl)
+	if err != nil {
+		return err, nil
+	}
+
+	err, issues := act.Run()
+	placed, ers := e.Operations.Finish(id, err == nil)
+	issues = append(issues, ers...)
+	if err != nil && placed {
+		// The file was complete and is rolled forward
+		err, issues = nil, append(issues, err)
+	}
+	if err == nil && act.Conflict {
+		events.Emit(events.Event{Type: events.ConflictCreated, Path: act.Dst, Original: act.OriginalDst})
+	}
+	return err, issues
+}
+
+func (e *Executor) logWarnings(errs []error) {
+	if e.LogWarning != nil {
+		for _, err := range errs {
+			e.LogWarning(err)
+		}
+	}
+}
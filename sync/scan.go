@@ -3,10 +3,13 @@ package sync
 import (
 	"bytes"
 	"fmt"
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/fold"
 	"github.com/mildred/doc/ignore"
 	"github.com/mildred/doc/repo"
 	"os"
 	"path/filepath"
+	"syscall"
 )
 
 type FilePreparatorOpts struct {
@@ -22,6 +25,9 @@ type FilePreparatorOpts struct {
 
 	// Respect .docignore files
 	DocIgnore bool
+
+	// How to traverse symbolic links and mount points
+	Walk repo.WalkOptions
 }
 
 type FilePreparator struct {
@@ -39,12 +45,39 @@ type FilePreparator struct {
 
 	// for Log function
 	hashingMsg bool
+
+	// Directories being traversed in source and destination
+	srcVisited *repo.Visited
+	dstVisited *repo.Visited
+
+	// Name the conflicts created in the destination and, when bidirectional,
+	// in the source
+	dstNamer repo.ConflictNamer
+	srcNamer repo.ConflictNamer
+
+	// How the destination and the source filesystems compare names
+	dstFS fold.FS
+	srcFS fold.FS
+
+	// Files and directories copied under a name that was not there, by key of
+	// that name, in the destination and in the source
+	dstCopied map[string]copied
+	srcCopied map[string]copied
+
+	// .docignore files read during the scan
+	ignores *ignore.Matcher
+}
+
+// A file or a directory copied from a path to another
+type copied struct {
+	from, to string
 }
 
 func (p *FilePreparatorOpts) Preparator(args *PreparatorArgs) Preparator {
 	return &FilePreparator{
 		PreparatorArgs:     *args,
 		FilePreparatorOpts: *p,
+		ignores:            ignore.New(),
 	}
 }
 
@@ -61,19 +94,303 @@ func size(info os.FileInfo) int64 {
 }
 
 func (p *FilePreparator) PrepareCopy(src, dst string) {
+	p.srcVisited = p.Walk.NewVisited()
+	p.dstVisited = p.Walk.NewVisited()
+	p.dstNamer = repo.NewConflictNamer(src, dst)
+	p.srcNamer = repo.NewConflictNamer(dst, src)
+	p.dstCopied = map[string]copied{}
+	p.srcCopied = map[string]copied{}
+	p.dstFS = p.probe(dst)
+	if p.Bidir {
+		p.srcFS = p.probe(src)
+	}
+	if p.Verbose {
+		showFS(dst, p.dstFS)
+		showFS(src, p.srcFS)
+	}
 	p.prepareCopy(src, dst)
 }
 
+// Return how the filesystem of dir compares names, probed without writing in dry
+// runs
+func (p *FilePreparator) probe(dir string) fold.FS {
+	fs, err := fold.Probe(dir, p.DryRun)
+	if err != nil && p.HandleWarning != nil {
+		p.HandleWarning(err)
+	}
+	return fs
+}
+
+// Tell when the filesystem of dir does not tell all names apart
+func showFS(dir string, fs fold.FS) {
+	if fs.IgnoreCase {
+		fmt.Printf("Names differing by case are the same file in %s\n", dir)
+	}
+	if fs.Normalizing {
+		fmt.Printf("Names differing by Unicode normalisation are the same file in %s\n", dir)
+	}
+}
+
+// Enter the directory to traverse. Return false with a nil error if the
+// directory must not be traversed. v.Leave must be called if true is returned.
+func (p *FilePreparator) enter(v *repo.Visited, path string, info os.FileInfo) (bool, error) {
+	descend, err := v.Enter(path, info)
+	if err == nil && !descend && p.Verbose {
+		fmt.Printf("Not crossing filesystem boundary %s\n", path)
+	}
+	return descend, err
+}
+
+// Return a not exist error if err tells that a parent of path is not a
+// directory: that parent is moved aside and replaced by a directory
+func notDirAsNotExist(path string, err error) error {
+	if attrs.IsErrno(err, syscall.ENOTDIR) {
+		return &os.PathError{Op: "stat", Path: path, Err: syscall.ENOENT}
+	}
+	return err
+}
+
+// Return true if path, with its information or stat error, is ignored by the
+// .docignore files
+func (p *FilePreparator) ignored(path string, info os.FileInfo, err error) bool {
+	return p.DocIgnore && err == nil && p.ignores.Match(path, info.IsDir())
+}
+
+// Copy the source directory over the destination file or symlink, moved aside
+// under a conflict name. When reverse is true, the destination directory is
+// copied over the source file instead.
+func (p *FilePreparator) prepareAside(src, dst string, srci, dsti os.FileInfo, reverse bool) bool {
+	from, to, fromi, toi := src, dst, srci, dsti
+	visited, namer := p.srcVisited, p.dstNamer
+	if reverse {
+		from, to, fromi, toi = dst, src, dsti, srci
+		visited, namer = p.dstVisited, p.srcNamer
+	}
+
+	hash, err := repo.GetHash(to, toi, true)
+	if err != nil {
+		return p.HandleError(err)
+	}
+
+	descend, err := p.enter(visited, from, fromi)
+	if err != nil {
+		return p.HandleError(err)
+	}
+
+	act := NewCreateDir(from, to, fromi)
+	act.Aside = repo.FreeConflictFileName(to, hash, namer)
+	act.AsideHash = hash
+	act.OrigDstMode = toi.Mode()
+	res := p.HandleAction(*act)
+	if !res || !descend {
+		return res
+	}
+	defer visited.Leave(fromi)
+
+	names, err := readNames(from)
+	if err != nil {
+		return p.HandleError(err)
+	}
+
+	if reverse {
+		return p.prepareNames(src, dst, nil, names)
+	}
+	return p.prepareNames(src, dst, names, nil)
+}
+
+// Read the names of the directory path
+func readNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// Prepare the copy of the names of the source directory src to the destination
+// directory dst and, when bidirectional, of the names of dst to src.
+//
+// Names are matched to the names of the other side that are the same file
+// there: in another Unicode normalisation form or, on a case-insensitive
+// filesystem, in another case. A file colliding that way with another file of
+// the other side, or with a file copied there, is copied as its conflict.
+// Colliding directories are merged.
+func (p *FilePreparator) prepareNames(src, dst string, srcnames, dstnames []string) bool {
+	// Names of each side, by key as compared on the other side
+	dstkeys := map[string]string{}
+	srckeys := map[string]string{}
+	exact := map[string]bool{}
+	insrc := map[string]bool{}
+	for _, name := range dstnames {
+		exact[name] = true
+		if k := p.dstFS.Key(name); dstkeys[k] == "" {
+			dstkeys[k] = name
+		}
+	}
+	for _, name := range srcnames {
+		insrc[name] = true
+		if k := p.srcFS.Key(name); srckeys[k] == "" {
+			srckeys[k] = name
+		}
+	}
+
+	used := map[string]bool{}
+	for _, name := range srcnames {
+		from, to := filepath.Join(src, name), filepath.Join(dst, name)
+		if !exact[name] {
+			if t := dstkeys[p.dstFS.Key(name)]; t != "" && insrc[t] {
+				if !p.prepareCollision(from, filepath.Join(dst, t), filepath.Join(src, t), p.dstNamer, false) {
+					return false
+				}
+				continue
+			} else if t != "" {
+				to = filepath.Join(dst, t)
+				used[t] = true
+			} else if c, ok := p.dstCopied[p.dstFS.Key(to)]; ok {
+				if !p.prepareCollision(from, c.to, c.from, p.dstNamer, false) {
+					return false
+				}
+				continue
+			} else {
+				p.dstCopied[p.dstFS.Key(to)] = copied{from, to}
+			}
+		}
+		used[name] = true
+		if !p.prepareCopy(from, to) {
+			return false
+		}
+	}
+
+	if !p.Bidir {
+		return true
+	}
+
+	for _, name := range dstnames {
+		if used[name] {
+			continue
+		}
+		from, to := filepath.Join(dst, name), filepath.Join(src, name)
+		if t := srckeys[p.srcFS.Key(name)]; t != "" && t != name {
+			if !p.prepareCollision(from, filepath.Join(src, t), filepath.Join(dst, t), p.srcNamer, true) {
+				return false
+			}
+			continue
+		} else if c, ok := p.srcCopied[p.srcFS.Key(to)]; ok && t == "" {
+			if !p.prepareCollision(from, c.to, c.from, p.srcNamer, true) {
+				return false
+			}
+			continue
+		} else if t == "" {
+			p.srcCopied[p.srcFS.Key(to)] = copied{from, to}
+		}
+		if !p.prepareCopy(to, from) {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy from as a conflict of to, a file that to's filesystem does not tell
+// apart from from. to may not exist yet, copied from other: nothing is copied
+// if from has the same content. Directories are merged into to instead. When
+// reverse is true, from is in the destination and to in the source.
+func (p *FilePreparator) prepareCollision(from, to, other string, namer repo.ConflictNamer, reverse bool) bool {
+	fromi, err := p.Walk.Stat(from)
+	if err != nil {
+		return p.HandleError(err)
+	} else if p.ignored(from, fromi, err) {
+		return true
+	}
+
+	// The original is the file already there, or the file copied there
+	orig := to
+	origi, err := os.Lstat(orig)
+	if os.IsNotExist(err) {
+		orig = other
+		origi, err = p.Walk.Stat(orig)
+	}
+	if err != nil {
+		return p.HandleError(err)
+	}
+
+	if fromi.IsDir() && origi.IsDir() {
+		if reverse {
+			return p.prepareMerge(to, from, true)
+		}
+		return p.prepareMerge(from, to, false)
+	} else if fromi.IsDir() || origi.IsDir() {
+		return p.HandleError(fmt.Errorf("%s: not copied, %s has the same name there", from, to))
+	}
+
+	hash, err := repo.GetHash(from, fromi, true)
+	if err != nil {
+		return p.HandleError(err)
+	}
+	orighash, err := repo.GetHash(orig, origi, true)
+	if err == nil && bytes.Equal(hash, orighash) && fromi.Mode()&os.ModeSymlink == origi.Mode()&os.ModeSymlink {
+		return true
+	}
+
+	name := repo.FindConflictFileName(to, hash, namer)
+	if name == "" {
+		return true
+	}
+	p.TotalBytes += uint64(size(fromi))
+	return p.HandleAction(*NewCopyAction(from, name, hash, size(fromi), to, true, fromi.Mode(), origi.Mode()))
+}
+
+// Merge the source directory src into the destination directory dst, created
+// by another action, or the destination directory into the source directory
+// when reverse is true
+func (p *FilePreparator) prepareMerge(src, dst string, reverse bool) bool {
+	from, visited := src, p.srcVisited
+	if reverse {
+		from, visited = dst, p.dstVisited
+	}
+	info, err := p.Walk.Stat(from)
+	if err != nil {
+		return p.HandleError(err)
+	}
+	descend, err := p.enter(visited, from, info)
+	if err != nil || !descend {
+		return err == nil || p.HandleError(err)
+	}
+	defer visited.Leave(info)
+
+	names, err := readNames(from)
+	if err != nil {
+		return p.HandleError(err)
+	}
+	if reverse {
+		return p.prepareNames(src, dst, nil, names)
+	}
+	return p.prepareNames(src, dst, names, nil)
+}
+
 func (p *FilePreparator) prepareCopy(src, dst string) bool {
 	var err error
 
+	if p.Context != nil && p.Context.Err() != nil {
+		return false
+	}
+
 	if p.Logger != nil {
 		p.Logger(p, src, dst, false, false)
 	}
 	p.NumFiles += 1
 
-	srci, srcerr := os.Lstat(src)
-	dsti, dsterr := os.Lstat(dst)
+	srci, srcerr := p.Walk.Stat(src)
+	dsti, dsterr := p.Walk.Stat(dst)
+	srcerr = notDirAsNotExist(src, srcerr)
+	dsterr = notDirAsNotExist(dst, dsterr)
+
+	if p.ignored(src, srci, srcerr) || p.ignored(dst, dsti, dsterr) {
+		if p.Verbose {
+			fmt.Printf("Ignoring %s\n", src)
+		}
+		return true
+	}
 
 	//
 	// File in source but not in destination
@@ -83,36 +400,22 @@ func (p *FilePreparator) prepareCopy(src, dst string) bool {
 
 		if srci.IsDir() {
 
-			if p.DocIgnore && ignore.IsIgnored(src) {
-				if p.Verbose {
-					fmt.Printf("Ignoring %s\n", src)
-				}
-				return true
+			descend, err := p.enter(p.srcVisited, src, srci)
+			if err != nil {
+				return p.HandleError(err)
 			}
 
 			res := p.HandleAction(*NewCreateDir(src, dst, srci))
-			if !res {
-				return false
-			}
-
-			f, err := os.Open(src)
-			if err != nil {
-				return p.HandleError(err)
+			if !res || !descend {
+				return res
 			}
-			defer f.Close()
+			defer p.srcVisited.Leave(srci)
 
-			names, err := f.Readdirnames(-1)
+			names, err := readNames(src)
 			if err != nil {
 				return p.HandleError(err)
 			}
-
-			for _, name := range names {
-				if !p.prepareCopy(filepath.Join(src, name), filepath.Join(dst, name)) {
-					return false
-				}
-			}
-
-			return true
+			return p.prepareNames(src, dst, names, nil)
 
 		} else {
 
@@ -143,36 +446,22 @@ func (p *FilePreparator) prepareCopy(src, dst string) bool {
 
 		if dsti.IsDir() {
 
-			if p.DocIgnore && ignore.IsIgnored(dst) {
-				if p.Verbose {
-					fmt.Printf("Ignoring %s\n", dst)
-				}
-				return true
+			descend, err := p.enter(p.dstVisited, dst, dsti)
+			if err != nil {
+				return p.HandleError(err)
 			}
 
 			res := p.HandleAction(*NewCreateDir(dst, src, dsti))
-			if !res {
-				return false
+			if !res || !descend {
+				return res
 			}
+			defer p.dstVisited.Leave(dsti)
 
-			f, err := os.Open(dst)
+			names, err := readNames(dst)
 			if err != nil {
 				return p.HandleError(err)
 			}
-			defer f.Close()
-
-			names, err := f.Readdirnames(-1)
-			if err != nil {
-				return p.HandleError(err)
-			}
-
-			for _, name := range names {
-				if !p.prepareCopy(filepath.Join(src, name), filepath.Join(dst, name)) {
-					return false
-				}
-			}
-
-			return true
+			return p.prepareNames(src, dst, nil, names)
 
 		} else {
 
@@ -218,69 +507,56 @@ func (p *FilePreparator) prepareCopy(src, dst string) bool {
 		return p.HandleError(dsterr)
 	}
 
+	//
+	// A directory and a file or a symlink: the file is moved aside and the
+	// directory copied in its place. Unless bidirectional, a source file is
+	// copied next to the destination directory instead.
+	//
+
+	if srci.IsDir() && !dsti.IsDir() {
+		return p.prepareAside(src, dst, srci, dsti, false)
+	} else if !srci.IsDir() && dsti.IsDir() && p.Bidir {
+		return p.prepareAside(src, dst, srci, dsti, true)
+	} else if !srci.IsDir() && dsti.IsDir() {
+		srch, err := repo.GetHash(src, srci, true)
+		if err != nil {
+			return p.HandleError(err)
+		}
+		dstname := repo.FindConflictFileName(dst, srch, p.dstNamer)
+		if dstname == "" {
+			return true
+		}
+		p.TotalBytes += uint64(size(srci))
+		return p.HandleAction(*NewCopyAction(src, dstname, srch, size(srci), dst, true, srci.Mode(), dsti.Mode()))
+	}
+
 	//
 	// Both source and destination are directories, merge
 	//
 
 	if srci.IsDir() && dsti.IsDir() {
 
-		if p.DocIgnore && (ignore.IsIgnored(src) || ignore.IsIgnored(dst)) {
-			if p.Verbose {
-				fmt.Printf("Ignoring %s (source and destination)\n", src)
-			}
-			return true
+		descend, err := p.enter(p.srcVisited, src, srci)
+		if err != nil || !descend {
+			return err == nil || p.HandleError(err)
 		}
+		defer p.srcVisited.Leave(srci)
 
-		var srcnames map[string]bool
-
-		if p.Bidir {
-			srcnames = map[string]bool{}
+		descend, err = p.enter(p.dstVisited, dst, dsti)
+		if err != nil || !descend {
+			return err == nil || p.HandleError(err)
 		}
+		defer p.dstVisited.Leave(dsti)
 
-		f, err := os.Open(src)
+		names, err := readNames(src)
 		if err != nil {
 			return p.HandleError(err)
 		}
-		defer f.Close()
-		names, err := f.Readdirnames(-1)
+		dstnames, err := readNames(dst)
 		if err != nil {
 			return p.HandleError(err)
 		}
-
-		for _, name := range names {
-			if p.Bidir {
-				srcnames[name] = true
-			}
-			if !p.prepareCopy(filepath.Join(src, name), filepath.Join(dst, name)) {
-				return false
-			}
-		}
-
-		if p.Bidir {
-
-			f, err := os.Open(dst)
-			if err != nil {
-				return p.HandleError(err)
-			}
-			defer f.Close()
-			dstnames, err := f.Readdirnames(-1)
-			if err != nil {
-				return p.HandleError(err)
-			}
-
-			for _, name := range dstnames {
-				if srcnames[name] {
-					continue
-				}
-				if !p.prepareCopy(filepath.Join(src, name), filepath.Join(dst, name)) {
-					return false
-				}
-			}
-
-		}
-
-		return true
-
+		return p.prepareNames(src, dst, names, dstnames)
 	}
 
 	//
@@ -328,7 +604,7 @@ func (p *FilePreparator) prepareCopy(src, dst string) bool {
 	}
 
 	if repo.ConflictFile(src) == "" {
-		dstname := repo.FindConflictFileName(dst, srch)
+		dstname := repo.FindConflictFileName(dst, srch, p.dstNamer)
 		if dstname != "" {
 			p.TotalBytes += uint64(size(srci))
 			if !p.HandleAction(*NewCopyAction(src, dstname, srch, size(srci), dst, true, srci.Mode(), dsti.Mode())) {
@@ -338,7 +614,7 @@ func (p *FilePreparator) prepareCopy(src, dst string) bool {
 	}
 
 	if p.Bidir && repo.ConflictFile(dst) == "" {
-		srcname := repo.FindConflictFileName(src, dsth)
+		srcname := repo.FindConflictFileName(src, dsth, p.srcNamer)
 		if srcname != "" {
 			p.TotalBytes += uint64(size(dsti))
 			if !p.HandleAction(*NewCopyAction(dst, srcname, dsth, size(dsti), src, true, dsti.Mode(), srci.Mode())) {
@@ -1,8 +1,16 @@
 package sync
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"path/filepath"
+
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/copy"
+	"github.com/mildred/doc/events"
+	"github.com/mildred/doc/plan"
+	"github.com/mildred/doc/versions"
 )
 
 type Preparator interface {
@@ -24,11 +32,20 @@ type PreparatorArgs struct {
 	// scanning or false to stop scaning.
 	HandleError func(e error) bool
 
+	// Called with the issues that do not stop scanning, can be nil
+	HandleWarning func(e error)
+
+	// Nothing is written, the filesystems are probed without creating files
+	DryRun bool
+
 	// Logger to be called for each scanned item
 	// Always called with hashing to false. When performing hashing, it is called
 	// a second or a third time with either hash_src or hash_dst set to true,
 	// depending on which file is being hashed.
 	Logger func(p Preparator, src, dst string, hash_src, hash_dst bool)
+
+	// Scanning stops once the context is done, can be nil
+	Context context.Context
 }
 
 type PreparatorOptions interface {
@@ -55,11 +72,28 @@ type SyncOptions struct {
 	// Delete duplicates in destination that are not in source
 	DeleteDup bool
 
+	// Number of concurrent copies and limits per source and destination
+	// device, see Executor
+	Jobs      int
+	PerSource int
+	PerDest   int
+
 	// Scan first and copy after scanning is completed only.
 	TwoPass bool
 
 	// Verbose
 	Verbose bool
+
+	// If not nil, the actions are added to the plan instead of being run
+	Plan *plan.Plan
+
+	// If not nil, run the actions of this plan instead of scanning. Nothing is
+	// done if the sources or destinations changed since the plan was made.
+	Apply *plan.Plan
+
+	// Once the context is done, scanning stops and no new copy is started. The
+	// copies in progress are completed. Nil for no cancellation.
+	Context context.Context
 }
 
 func Sync(src, dst string, opt SyncOptions) (numErrors int) {
@@ -68,24 +102,66 @@ func Sync(src, dst string, opt SyncOptions) (numErrors int) {
 		dedup_map = map[string][]string{}
 	}
 
+	if opt.Apply != nil {
+		src = opt.Apply.Source
+		dst = opt.Apply.Dest
+	}
+
 	if !opt.Quiet {
 		fmt.Printf("Source:      %s\n", src)
 		fmt.Printf("Destination: %s\n", dst)
 	}
 
 	logger := NewLogger(opt.Quiet, opt.Verbose)
+	events.Emit(events.Event{Type: events.ScanStarted, Src: src, Dst: dst})
+	defer func() {
+		events.Emit(events.Event{
+			Type:   events.Finished,
+			Src:    src,
+			Dst:    dst,
+			Files:  logger.NumCopied(),
+			Errors: numErrors,
+		})
+	}()
+
+	// The plan is made after the scan, like in two pass mode
+	twoPass := opt.TwoPass || opt.Plan != nil
+
+	// ctx is also cancelled when the executor stops, to stop scanning
+	interrupt := opt.Context
+	if interrupt == nil {
+		interrupt = context.Background()
+	}
+	ctx, cancel := context.WithCancel(interrupt)
+	defer cancel()
 
 	var actions_chan chan *CopyAction = make(chan *CopyAction, 100)
 	var actions_slice []*CopyAction
 	var actions_closed bool = false
 
+	// Send an action to the executor, unless interrupted
+	send := func(act *CopyAction) bool {
+		select {
+		case actions_chan <- act:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	// Closed once nothing is sent to actions_chan any more
+	sent := make(chan struct{})
+
 	prep := opt.Preparator.Preparator(&PreparatorArgs{
-		Dedup:  dedup_map,
-		Logger: logger.LogPrepare,
+		Dedup:         dedup_map,
+		Context:       ctx,
+		Logger:        logger.LogPrepare,
+		HandleWarning: logger.LogWarning,
+		DryRun:        opt.DryRun || opt.Plan != nil,
 		HandleError: func(e error) bool {
 			logger.LogError(e)
 			if !opt.Force && !opt.DryRun {
-				if !opt.TwoPass {
+				if !twoPass {
 					close(actions_chan)
 					actions_closed = true
 				}
@@ -95,13 +171,12 @@ func Sync(src, dst string, opt SyncOptions) (numErrors int) {
 		},
 		HandleAction: func(act CopyAction) bool {
 			logger.AddFile(&act)
-			if opt.TwoPass {
+			if twoPass {
 				actions_slice = append(actions_slice, &act)
 				return true
 			} else {
 				if !actions_closed {
-					actions_chan <- &act
-					return true
+					return send(&act)
 				}
 				return false
 			}
@@ -110,45 +185,126 @@ func Sync(src, dst string, opt SyncOptions) (numErrors int) {
 
 	defer logger.Clear()
 
-	if opt.TwoPass {
+	// Operations interrupted last time are completed or undone first
+	var ops *copy.Operations
+	if !opt.DryRun && opt.Plan == nil {
+		var errs []error
+		ops, errs = copy.OpenOperations(dst)
+		for _, err := range errs {
+			logger.LogWarning(err)
+		}
+		defer ops.Close()
+	}
+
+	if opt.Apply != nil {
+		acts, errs := plannedActions(opt.Apply)
+		for _, err := range errs {
+			logger.LogError(err)
+		}
+		if len(errs) > 0 {
+			logger.Clear()
+			fmt.Println("Stopping because the plan is out of date")
+			return logger.NumErrors()
+		}
+
+		go func() {
+			for _, act := range acts {
+				if !send(act) {
+					break
+				}
+			}
+			close(actions_chan)
+			close(sent)
+		}()
+	} else if twoPass {
 		prep.PrepareCopy(src, dst)
 
-		if logger.NumErrors() > 0 && !opt.Force && !opt.DryRun {
+		if interrupt.Err() != nil {
+			logger.LogError(fmt.Errorf("interrupted while scanning, nothing was copied"))
+			return logger.NumErrors()
+		} else if logger.NumErrors() > 0 && !opt.Force && !opt.DryRun {
+			logger.Clear()
 			fmt.Println("Stopping because of errors")
 			return logger.NumErrors()
 		}
 
+		if opt.Plan != nil {
+			for _, act := range actions_slice {
+				a, err := act.planAction()
+				if err != nil {
+					logger.LogError(err)
+					continue
+				}
+				opt.Plan.Actions = append(opt.Plan.Actions, a)
+			}
+			return logger.NumErrors()
+		}
+
 		go func() {
 			for _, act := range actions_slice {
-				actions_chan <- act
+				if !send(act) {
+					break
+				}
 			}
 			close(actions_chan)
 			actions_closed = true
+			close(sent)
 		}()
 	} else {
 		go func() {
 			prep.PrepareCopy(src, dst)
-			close(actions_chan)
+			if !actions_closed {
+				close(actions_chan)
+			}
+			close(sent)
 		}()
 	}
 
 	exec := &Executor{
-		DryRun:    opt.DryRun,
-		Force:     opt.Force,
-		Dedup:     dedup_map,
-		LogAction: logger.LogExec,
-		LogError:  logger.LogError,
+		DryRun:     opt.DryRun,
+		Force:      opt.Force,
+		Jobs:       opt.Jobs,
+		PerSource:  opt.PerSource,
+		PerDest:    opt.PerDest,
+		Dedup:      dedup_map,
+		Operations: ops,
+		Context:    ctx,
+		LogAction:  logger.LogExec,
+		LogBytes:   logger.LogBytes,
+		LogError:   logger.LogError,
+		LogWarning: logger.LogWarning,
 	}
 
 	conflicts, dup_hashes := exec.Execute(actions_chan)
 
-	if opt.DeleteDup {
+	// The executor stops early on errors or when interrupted, the scan is then
+	// stopped as well
+	cancel()
+	<-sent
+	if interrupt.Err() != nil {
+		copied, planned := logger.NumCopied(), logger.NumPlanned()
+		logger.LogError(fmt.Errorf("interrupted, %d files copied, %d files found not copied", copied, planned-copied))
+	} else if opt.DeleteDup {
+		warned := false
 		for _, h := range dup_hashes {
 			for _, path := range dedup_map[string(h)] {
 				if opt.DryRun {
 					fmt.Sprintf("rm -f %s\n", path)
+				} else if versions.Get(filepath.Dir(path)) == nil {
+					// Without a dirstore, duplicates are removed as
+					// they always were
+					if !warned {
+						logger.LogWarning(fmt.Errorf("%s: no %s, duplicates are removed without saving them", path, attrs.DirStoreName))
+						warned = true
+					}
+					if err := os.Remove(path); err != nil {
+						logger.LogError(fmt.Errorf("remove %s: %s", path, err.Error()))
+					}
 				} else {
-					err := os.Remove(path)
+					_, err := versions.Save(path, "duplicate")
+					if err == nil {
+						err = os.Remove(path)
+					}
 					if err != nil {
 						logger.LogError(fmt.Errorf("remove %s: %s", path, err.Error()))
 					}
@@ -157,6 +313,8 @@ func Sync(src, dst string, opt SyncOptions) (numErrors int) {
 		}
 	}
 
+	logger.PrintWarnings()
+
 	for _, c := range conflicts {
 		fmt.Fprintf(os.Stderr, "CONFLICT %s\n", c)
 	}
@@ -0,0 +1,114 @@
+package throttle
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Parse a rate, a number with an optional K, M or G suffix (powers of 1024)
+func ParseRate(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	mult := 1.0
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil || rate < 0 {
+		return 0, fmt.Errorf("invalid rate %#v", s)
+	}
+	return rate * mult, nil
+}
+
+// Read the limits from a control file with "read=RATE", "write=RATE" and
+// "files=RATE" lines. Limits missing from the file are removed.
+func LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	limits := map[string]float64{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s: invalid line %#v", path, line)
+		}
+		key := strings.TrimSpace(kv[0])
+		if key != "read" && key != "write" && key != "files" {
+			return fmt.Errorf("%s: unknown limit %s", path, key)
+		}
+		rate, err := ParseRate(kv[1])
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err.Error())
+		}
+		limits[key] = rate
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	Read.SetRate(limits["read"])
+	Write.SetRate(limits["write"])
+	Files.SetRate(limits["files"])
+	return nil
+}
+
+// Load the control file, and reload it when it is modified or when the process
+// receives SIGUSR1. Errors are printed as warnings, the limits are then kept.
+func Watch(path string) error {
+	err := LoadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var mtime time.Time
+	if info, err := os.Stat(path); err == nil {
+		mtime = info.ModTime()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1)
+	ticker := time.NewTicker(time.Second)
+
+	go func() {
+		for {
+			select {
+			case <-sigs:
+			case <-ticker.C:
+				info, err := os.Stat(path)
+				if err != nil || info.ModTime().Equal(mtime) {
+					continue
+				}
+			}
+			if info, err := os.Stat(path); err == nil {
+				mtime = info.ModTime()
+			}
+			if err := LoadFile(path); err != nil {
+				fmt.Fprintf(os.Stderr, "W: %s\n", err.Error())
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,113 @@
+// Package throttle paces reads, writes and file operations so that long
+// transfers and scans leave the disks usable. The limits are global to the
+// process and shared by concurrent copies.
+package throttle
+
+import (
+	"io"
+	gosync "sync"
+	"time"
+)
+
+// Limiter lets through a number of units per second, with bursts of at most
+// one second
+type Limiter struct {
+	mu    gosync.Mutex
+	rate  float64
+	avail float64
+	last  time.Time
+}
+
+var (
+	// Bytes read per second
+	Read = &Limiter{}
+
+	// Bytes written per second
+	Write = &Limiter{}
+
+	// Files read, copied or hashed per second
+	Files = &Limiter{}
+)
+
+// Set the number of units per second, 0 for no limit
+func (l *Limiter) SetRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	l.rate = rate
+	l.avail = 0
+	l.last = time.Now()
+}
+
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Wait until n units can be used
+func (l *Limiter) Wait(n int64) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	l.avail += now.Sub(l.last).Seconds() * l.rate
+	if l.avail > l.rate {
+		l.avail = l.rate
+	}
+	l.last = now
+	l.avail -= float64(n)
+
+	var delay time.Duration
+	if l.avail < 0 {
+		delay = time.Duration(-l.avail / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Return true if reads or writes are limited. Copies must then go through user
+// space instead of the kernel to be paced.
+func Enabled() bool {
+	return Read.Rate() > 0 || Write.Rate() > 0
+}
+
+// Wait before the next file operation
+func File() {
+	Files.Wait(1)
+}
+
+type reader struct {
+	r io.Reader
+}
+
+func (r reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	Read.Wait(int64(n))
+	return n, err
+}
+
+// Return a reader paced by the read limit
+func Reader(r io.Reader) io.Reader {
+	return reader{r}
+}
+
+type writer struct {
+	w io.Writer
+}
+
+func (w writer) Write(p []byte) (int, error) {
+	Write.Wait(int64(len(p)))
+	return w.w.Write(p)
+}
+
+// Return a writer paced by the write limit
+func Writer(w io.Writer) io.Writer {
+	return writer{w}
+}
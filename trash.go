@@ -0,0 +1,266 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	attrs "github.com/mildred/doc/attrs"
+	commit "github.com/mildred/doc/commit"
+	repo "github.com/mildred/doc/repo"
+)
+
+const trashUsage string = `doc trash list [DIR]
+doc trash restore [-C DIR] BATCH [PATH...]
+doc trash empty [-keep AGE] [DIR]
+
+Manage the files moved to .dirstore/trash by doc push -mirror and doc pull
+-mirror. Files moved together are kept in a batch named after the time they
+were moved, with their path relative to the repository root.
+
+list shows the files of each batch, one per line with the batch name and the
+path.
+
+restore moves back the files of BATCH, or only the given paths and the files
+under them, and adds them to the commit. Files that exist again in the
+repository are not restored.
+
+empty deletes the batches, or with -keep only those older than AGE. AGE is a
+number of days with a d suffix, of weeks with a w suffix, or a duration such
+as 12h.
+
+Options:
+`
+
+func mainTrash(args []string) int {
+	f := flag.NewFlagSet("trash", flag.ExitOnError)
+	opt_dir := f.String("C", ".", "Repository to restore the files in (restore)")
+	opt_keep := f.String("keep", "", "Keep the batches younger than this age (empty)")
+	f.Usage = func() {
+		fmt.Print(trashUsage)
+		f.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		f.Usage()
+		return 1
+	}
+	cmd := args[0]
+	f.Parse(args[1:])
+
+	trashFor := func(dir string) *repo.Trash {
+		t := repo.GetTrash(dir)
+		if t == nil {
+			fmt.Fprintf(os.Stderr, "%s: Could not find %s, please run doc init\n", dir, attrs.DirStoreName)
+		}
+		return t
+	}
+
+	switch cmd {
+	case "list":
+		dir := f.Arg(0)
+		if dir == "" {
+			dir = "."
+		}
+		t := trashFor(dir)
+		if t == nil {
+			return 1
+		}
+		return listTrash(t)
+	case "restore":
+		if f.NArg() < 1 {
+			f.Usage()
+			return 1
+		}
+		t := trashFor(*opt_dir)
+		if t == nil {
+			return 1
+		}
+		return restoreTrash(t, f.Arg(0), f.Args()[1:])
+	case "empty":
+		dir := f.Arg(0)
+		if dir == "" {
+			dir = "."
+		}
+		var keep time.Duration
+		if *opt_keep != "" {
+			var err error
+			keep, err = parseAge(*opt_keep)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+				return 1
+			}
+		}
+		t := trashFor(dir)
+		if t == nil {
+			return 1
+		}
+		return emptyTrash(t, keep)
+	default:
+		f.Usage()
+		return 1
+	}
+}
+
+// Parse an age in days (d suffix), weeks (w suffix) or as a duration
+func parseAge(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(s)
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid age %#v", s)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+func listTrash(t *repo.Trash) int {
+	batches, err := t.Batches()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	status := 0
+	for _, batch := range batches {
+		files, err := t.Files(batch)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			status = 1
+		}
+		for _, file := range files {
+			fmt.Printf("%s\t%s\n", batch, commit.EncodePath(file))
+		}
+	}
+	return status
+}
+
+func restoreTrash(t *repo.Trash, batch string, paths []string) int {
+	files, err := t.Files(batch)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	status := 0
+	var entries []commit.Entry
+	for i, file := range files {
+		if !underAny(file, paths) {
+			continue
+		}
+		// The files restored so far are still added to the commit
+		if interrupt.Err() != nil {
+			fmt.Fprintf(os.Stderr, "interrupted, %d files not restored\n", countUnder(files[i:], paths))
+			status = 1
+			break
+		}
+
+		path, err := t.Restore(batch, file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			status = 1
+			continue
+		}
+		fmt.Printf("%s\n", path)
+
+		// Conflict files are alternatives of their original file again
+		if conflict := repo.ConflictFile(path); conflict != "" {
+			original := filepath.Join(filepath.Dir(path), conflict)
+			if info, err := os.Lstat(original); err == nil && info.Mode()&os.ModeSymlink == 0 {
+				err = repo.AddConflictAlternative(original, filepath.Base(path))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %s\n", original, err.Error())
+					status = 1
+				}
+			}
+		}
+
+		info, err := os.Lstat(path)
+		var digest []byte
+		if err == nil {
+			digest, err = repo.GetHash(path, info, true)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			status = 1
+			continue
+		}
+		e := commit.Entry{Hash: digest, Path: file}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			e.Device, e.Inode = uint64(st.Dev), st.Ino
+		}
+		entries = append(entries, e)
+	}
+
+	if len(entries) > 0 {
+		if err := commit.WriteDirAppend(t.Root(), entries); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			status = 1
+		}
+	}
+	return status
+}
+
+// Return the number of files under the paths
+func countUnder(files []string, paths []string) int {
+	n := 0
+	for _, file := range files {
+		if underAny(file, paths) {
+			n++
+		}
+	}
+	return n
+}
+
+// Return true if file is one of the paths or is in one of them, or if there
+// are no paths
+func underAny(file string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		if file == p || strings.HasPrefix(file, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func emptyTrash(t *repo.Trash, keep time.Duration) int {
+	batches, err := t.Batches()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	status := 0
+	for _, batch := range batches {
+		if interrupt.Err() != nil {
+			fmt.Fprintf(os.Stderr, "interrupted, the other batches were kept\n")
+			return 1
+		}
+		when, _ := repo.BatchTime(batch)
+		if keep > 0 && time.Since(when) < keep {
+			continue
+		}
+		if err := t.Remove(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			status = 1
+			continue
+		}
+		fmt.Printf("rm %s\n", batch)
+	}
+	return status
+}
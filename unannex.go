@@ -36,7 +36,9 @@ func mainUnannex(args []string) int {
 	missing := 0
 
 	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+		if interrupt.Err() != nil {
+			return interrupt.Err()
+		} else if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err.Error())
 			return err
 		}
@@ -53,7 +55,10 @@ func mainUnannex(args []string) int {
 		return nil
 	})
 
-	if err != nil {
+	if isInterrupt(err) {
+		fmt.Fprintf(os.Stderr, "interrupted, the links not reached are unchanged\n")
+		return 1
+	} else if err != nil {
 		fmt.Fprintf(os.Stderr, "%v", err)
 		return 1
 	}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+	attrs "github.com/mildred/doc/attrs"
+	copy "github.com/mildred/doc/copy"
+	versions "github.com/mildred/doc/versions"
+)
+
+const versionsUsage string = `doc versions [-restore HASH] FILE
+
+List the versions of FILE saved in .dirstore/versions, oldest first, with the
+time they were saved, their hash and the reason. A version is saved before doc
+replaces or discards the content of a file: when doc dupes -d replaces it by a
+link, when doc cp -dd removes a duplicate, or when another version is restored.
+
+With -restore, the version with this hash is put back at FILE, and the current
+content of FILE is saved as a version first. Run doc commit afterwards to record
+the change.
+
+Options:
+`
+
+func mainVersions(args []string) int {
+	f := flag.NewFlagSet("versions", flag.ExitOnError)
+	opt_restore := f.String("restore", "", "Put back the version with this hash")
+	f.Usage = func() {
+		fmt.Print(versionsUsage)
+		f.PrintDefaults()
+	}
+	f.Parse(args)
+	if f.NArg() != 1 {
+		f.Usage()
+		return 1
+	}
+	path := f.Arg(0)
+
+	store := versions.Get(filepath.Dir(path))
+	if store == nil {
+		fmt.Fprintf(os.Stderr, "%s: Could not find %s\n", path, attrs.DirStoreName)
+		return 1
+	}
+
+	list, err := store.List(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	if *opt_restore == "" {
+		for _, v := range list {
+			fmt.Printf("%s\t%s\t%s\n", v.Time.Format(time.RFC3339), base58.Encode(v.Hash), v.Reason)
+		}
+		return 0
+	}
+
+	for i := len(list) - 1; i >= 0; i-- {
+		if base58.Encode(list[i].Hash) != *opt_restore {
+			continue
+		}
+		// The temporary file must not be removed by copies running meanwhile
+		transfers, err := copy.LockTransfers(filepath.Dir(path))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			return 1
+		}
+		defer transfers.Unlock()
+		if err := store.Restore(list[i], path); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err.Error())
+			return 1
+		}
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%s: no version %s\n", path, *opt_restore)
+	return 1
+}
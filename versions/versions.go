@@ -0,0 +1,250 @@
+// Package versions keeps in the dirstore the file contents doc is about to
+// replace or discard. Contents are stored once by hash in .dirstore/versions,
+// and an index records for each saved version the time, the hash, the path
+// relative to the repository root and the reason it was saved.
+package versions
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	base58 "github.com/jbenet/go-base58"
+	"github.com/mildred/doc/attrs"
+	"github.com/mildred/doc/commit"
+	"github.com/mildred/doc/fastcopy"
+	"github.com/mildred/doc/repo"
+)
+
+// Name of the versions directory inside the dirstore
+const DirName = "versions"
+
+const indexName = "index"
+
+type Version struct {
+	Time   time.Time
+	Hash   []byte
+	Path   string
+	Reason string
+}
+
+// Saved versions of the files of a repository
+type Store struct {
+	path string
+	root string
+}
+
+// Return the versions of the repository containing path, nil if there is no
+// dirstore
+func Get(path string) *Store {
+	dirstore := attrs.FindDirStore(path)
+	if dirstore == "" {
+		return nil
+	}
+	if abs, err := filepath.Abs(dirstore); err == nil {
+		dirstore = abs
+	}
+	return &Store{filepath.Join(dirstore, DirName), filepath.Dir(dirstore)}
+}
+
+// Save the content of path before it is replaced or removed. An error is
+// returned if the repository has no dirstore, the file must then be kept.
+func Save(path, reason string) (*Version, error) {
+	s := Get(filepath.Dir(path))
+	if s == nil {
+		return nil, fmt.Errorf("%s: Could not find %s to save the previous version", path, attrs.DirStoreName)
+	}
+	return s.Save(path, reason)
+}
+
+func (s *Store) rel(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(s.root, abs)
+	if err != nil {
+		return "", err
+	} else if rel == "." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s: not in repository %s", path, s.root)
+	}
+	return rel, nil
+}
+
+// Return the file holding the content with the given hash
+func (s *Store) File(hash []byte) string {
+	return filepath.Join(s.path, base58.Encode(hash))
+}
+
+// Copy the content of the regular file path to the store and record it in the
+// index. Both are on disk when Save returns, path can then be replaced.
+func (s *Store) Save(path, reason string) (*Version, error) {
+	rel, err := s.rel(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	} else if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s: only regular files can be saved", path)
+	}
+
+	if err := os.MkdirAll(s.path, 0777); err != nil {
+		return nil, err
+	}
+
+	// The content is hashed once copied, the recorded hash could be out of date
+	tmp, err := ioutil.TempFile(s.path, ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpname := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpname)
+	defer os.Remove(tmpname)
+
+	if _, err := fastcopy.CopyFile(path, tmpname, 0444); err != nil {
+		return nil, err
+	}
+	tmpinfo, err := os.Lstat(tmpname)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := repo.HashFile(tmpname, tmpinfo)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Lstat(s.File(hash)); os.IsNotExist(err) {
+		if err := syncPath(tmpname); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmpname, s.File(hash)); err != nil {
+			return nil, err
+		}
+		if err := syncPath(s.path); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &Version{time.Now(), hash, rel, reason}
+	return v, s.record(v)
+}
+
+// Append v to the index, flushed to disk along with the versions directory
+// when the index is created
+func (s *Store) record(v *Version) error {
+	index := filepath.Join(s.path, indexName)
+	_, err := os.Lstat(index)
+	created := os.IsNotExist(err)
+	f, err := os.OpenFile(index, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	line := strings.Join([]string{
+		v.Time.Format(time.RFC3339Nano),
+		base58.Encode(v.Hash),
+		commit.EncodePath(v.Path),
+		v.Reason,
+	}, "\t")
+	_, err = f.Write([]byte(line + "\n"))
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil && created {
+		err = syncPath(s.path)
+	}
+	return err
+}
+
+// Flush to disk the file or directory path
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Return the saved versions of path, oldest first
+func (s *Store) List(path string) ([]Version, error) {
+	rel, err := s.rel(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(s.path, indexName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var res []Version
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(fields) != 4 || commit.DecodePath(fields[2]) != rel {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			continue
+		}
+		res = append(res, Version{t, base58.Decode(fields[1]), rel, fields[3]})
+	}
+	return res, scanner.Err()
+}
+
+// Put back the content of v at path. The current content of path, if any, is
+// saved first.
+func (s *Store) Restore(v Version, path string) error {
+	if _, err := os.Lstat(s.File(v.Hash)); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".doctemp")
+	if err != nil {
+		return err
+	}
+	tmpname := tmp.Name()
+	tmp.Close()
+	os.Remove(tmpname)
+
+	if _, err := fastcopy.CopyFile(s.File(v.Hash), tmpname, 0666); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	if info, err := os.Lstat(path); err == nil && info.Mode().IsRegular() {
+		if _, err := s.Save(path, "restore"); err != nil {
+			os.Remove(tmpname)
+			return err
+		}
+		os.Chmod(tmpname, info.Mode().Perm())
+	}
+
+	if err := os.Rename(tmpname, path); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	info, err := os.Lstat(path)
+	if err == nil {
+		_, err = repo.CommitFileHash(path, info, v.Hash, false)
+	}
+	return err
+}